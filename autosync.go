@@ -0,0 +1,122 @@
+package main
+
+/* This file lets the library schedule conversations with peers on its
+   own, see StartAutoSync */
+
+// #include "gdp_types.h"
+import "C"
+
+import (
+	"errors"
+	"time"
+	"unsafe"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/scheduler"
+)
+
+var (
+	errNoCallback     = errors.New("auto sync requires a callback, see RegisterMsgCallback")
+	errAutoSyncFailed = errors.New("failed to initiate sync, see GetLastError")
+)
+
+/* SetPeers sets the peers that StartAutoSync syncs with, replacing the
+   previous ones. Takes effect from the next round.
+
+   Return code is LOG_SYNC_OK or an error code, see LogSyncError.
+
+   Memory convention:
+   Memory pointed to by peers is managed by the caller.
+*/
+//export SetPeers
+func SetPeers(handle C.LogSyncHandle, peers *C.PeerAddr, n C.int) (code C.int) {
+	ticket := uint32(handle.handleTicket)
+	defer recoverPanic(ticket, &code)
+
+	ctx, err := getLogSyncCtx(ticket)
+	if err != nil {
+		return fail(ticket, C.LOG_SYNC_ERR_INVALID_HANDLE, err)
+	}
+	if n < 0 || (n > 0 && peers == nil) {
+		return fail(ticket, C.LOG_SYNC_ERR_INVALID_ARGUMENT, errors.New("invalid peer array"))
+	}
+
+	addrs := make([]gdp.Hash, 0, int(n))
+	if n > 0 {
+		for _, peer := range (*[1 << 20]C.PeerAddr)(unsafe.Pointer(peers))[:n:n] {
+			addrs = append(addrs, peerAddrToHash(peer))
+		}
+	}
+	ctx.scheduler.SetPeers(addrs)
+	return C.LOG_SYNC_OK
+}
+
+/* StartAutoSync initiates a sync with fanout of the peers set with
+   SetPeers every intervalMs milliseconds, until StopAutoSync or
+   ReleaseLogSyncHandle is called. strategy is a SyncStrategy.
+
+   Messages are sent through the callback registered with
+   RegisterMsgCallback, which is called from a thread of the library.
+
+   Return code is LOG_SYNC_OK or an error code, see LogSyncError.
+*/
+//export StartAutoSync
+func StartAutoSync(handle C.LogSyncHandle, intervalMs C.uint32_t, fanout C.int, strategy C.int) (code C.int) {
+	ticket := uint32(handle.handleTicket)
+	defer recoverPanic(ticket, &code)
+
+	ctx, err := getLogSyncCtx(ticket)
+	if err != nil {
+		return fail(ticket, C.LOG_SYNC_ERR_INVALID_HANDLE, err)
+	}
+	if ctx.getCallback() == nil {
+		return fail(ticket, C.LOG_SYNC_ERR_INVALID_ARGUMENT, errNoCallback)
+	}
+
+	err = ctx.scheduler.Start(
+		time.Duration(intervalMs)*time.Millisecond,
+		int(fanout),
+		scheduler.Strategy(strategy),
+	)
+	if err != nil {
+		return fail(ticket, C.LOG_SYNC_ERR_INVALID_ARGUMENT, err)
+	}
+	return C.LOG_SYNC_OK
+}
+
+/* StopAutoSync stops the rounds started by StartAutoSync and waits for
+   the round in progress. Must not be called from the callback.
+
+   Return code is LOG_SYNC_OK or an error code, see LogSyncError.
+*/
+//export StopAutoSync
+func StopAutoSync(handle C.LogSyncHandle) (code C.int) {
+	ticket := uint32(handle.handleTicket)
+	defer recoverPanic(ticket, &code)
+
+	ctx, err := getLogSyncCtx(ticket)
+	if err != nil {
+		return fail(ticket, C.LOG_SYNC_ERR_INVALID_HANDLE, err)
+	}
+
+	ctx.scheduler.Stop()
+	return C.LOG_SYNC_OK
+}
+
+// autoSync initiates a sync with peer for the scheduler of a handle
+func (ctx *LogSyncCtx) autoSync(ticket HandleTicket, peer gdp.Hash) error {
+	if ctx.getCallback() == nil {
+		return errNoCallback
+	}
+
+	msg, code := initSync(ticket, peer)
+	if code != C.LOG_SYNC_OK {
+		return errAutoSyncFailed
+	}
+
+	// the callback was removed meanwhile, nobody will release msg
+	if msg.data != nil {
+		freeMsg(msg)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func TestAutoSync(t *testing.T) {
+	aHandle, code := CreateLogSyncHandle(newTestLog(t, "a", 5))
+	assert.Equal(t, 0, int(code))
+	bHandle, code := CreateLogSyncHandle(newTestLog(t, "b", 5))
+	assert.Equal(t, 0, int(code))
+	defer ReleaseLogSyncHandle(bHandle)
+
+	a := uint32(aHandle.handleTicket)
+	b := uint32(bHandle.handleTicket)
+	aAddr := gdp.GenerateHash("a")
+	bAddr := gdp.GenerateHash("b")
+
+	// Without a callback there is nowhere to send messages
+	assert.Equal(t, 7, int(StartAutoSync(aHandle, 10, 1, 0)))
+
+	aCtx, err := getLogSyncCtx(a)
+	assert.Nil(t, err)
+	bCtx, err := getLogSyncCtx(b)
+	assert.Nil(t, err)
+
+	var finished int32
+	aCtx.setCallback(func(peer gdp.Hash, msg cMessage) {
+		assert.Equal(t, bAddr, peer)
+		_, code := handleMsg(b, aAddr, msg)
+		freeMsg(msg)
+		if code == -1 {
+			atomic.AddInt32(&finished, 1)
+		}
+	})
+	bCtx.setCallback(func(peer gdp.Hash, msg cMessage) {
+		_, code := handleMsg(a, bAddr, msg)
+		freeMsg(msg)
+		if code == -1 {
+			atomic.AddInt32(&finished, 1)
+		}
+	})
+	aCtx.scheduler.SetPeers([]gdp.Hash{bAddr})
+
+	assert.Equal(t, 7, int(StartAutoSync(aHandle, 0, 1, 0)))
+	assert.Equal(t, 7, int(StartAutoSync(aHandle, 10, 1, 3)))
+	assert.Equal(t, 0, int(StartAutoSync(aHandle, 10, 1, 0)))
+	assert.Equal(t, 7, int(StartAutoSync(aHandle, 10, 1, 0)))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&finished) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, atomic.LoadInt32(&finished) >= 2)
+
+	// No round runs after StopAutoSync returns
+	assert.Equal(t, 0, int(StopAutoSync(aHandle)))
+	stopped := atomic.LoadInt32(&finished)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, stopped, atomic.LoadInt32(&finished))
+
+	// Releasing the handle stops its rounds as well
+	assert.Equal(t, 0, int(StartAutoSync(aHandle, 10, 1, 0)))
+	ReleaseLogSyncHandle(aHandle)
+	assert.Equal(t, 2, int(StopAutoSync(aHandle)))
+}
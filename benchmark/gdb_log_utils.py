@@ -22,6 +22,8 @@ def wipe_all_records(name):
     except sqlite3.Error as e:
         print(e)
 
+# The schema is owned by the logserver package, see logserver/schema.go;
+# replicas create or migrate it when they open a database
 def create_fresh_logdb(name):
     conn = create_connection(name)
     sql_create_table = """ CREATE TABLE IF NOT EXISTS log_entry (
@@ -0,0 +1,31 @@
+import re
+import urllib.request
+
+# Reads the metrics of a replica from the /metrics endpoint of its admin
+# API, e.g. scrape_metrics('10.0.0.1:8080')
+
+SAMPLE = re.compile(r'^(\w+)(?:\{(.*)\})?\s+(\S+)$')
+LABEL = re.compile(r'(\w+)="((?:[^"\\]|\\.)*)"')
+
+
+def scrape_metrics(admin_addr):
+    with urllib.request.urlopen('http://{0}/metrics'.format(admin_addr)) as response:
+        return parse_metrics(response.read().decode('utf-8'))
+
+# Returns a dict from (name, ((label, value), ...)) to the sample value
+def parse_metrics(text):
+    samples = {}
+    for line in text.splitlines():
+        if not line or line.startswith('#'):
+            continue
+        match = SAMPLE.match(line)
+        if match is None:
+            continue
+        name, labels, value = match.groups()
+        labels = tuple(sorted(LABEL.findall(labels or '')))
+        samples[(name, labels)] = float(value)
+    return samples
+
+# Sums the samples of a metric over all labels
+def total(samples, name):
+    return sum(value for (sample, _), value in samples.items() if sample == name)
@@ -0,0 +1,76 @@
+package main
+
+/* This file lets the library send messages through a callback of the
+   host, see RegisterMsgCallback */
+
+// #include "gdp_types.h"
+// #include "gdp_helper.h"
+import "C"
+
+import (
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// cMessage names C.Msg in files without cgo, such as tests
+type cMessage = C.Msg
+
+// msgCallback sends a message to a peer. It takes ownership of msg.
+type msgCallback func(peer gdp.Hash, msg cMessage)
+
+/* RegisterMsgCallback switches a handle to callback mode: InitSync and
+   HandleMsg pass the message to send to callback instead of returning
+   it, so the host only delivers incoming messages to HandleMsg.
+   callback is called on the thread of InitSync or HandleMsg before
+   they return, and may itself call HandleMsg.
+
+   A NULL callback switches the handle back to returning messages.
+
+   Return code is LOG_SYNC_OK or an error code, see LogSyncError.
+*/
+//export RegisterMsgCallback
+func RegisterMsgCallback(handle C.LogSyncHandle, callback C.MsgCallbackFunc) (code C.int) {
+	ticket := uint32(handle.handleTicket)
+	defer recoverPanic(ticket, &code)
+
+	ctx, err := getLogSyncCtx(ticket)
+	if err != nil {
+		return fail(ticket, C.LOG_SYNC_ERR_INVALID_HANDLE, err)
+	}
+
+	if callback == nil {
+		ctx.setCallback(nil)
+		return C.LOG_SYNC_OK
+	}
+
+	ctx.setCallback(func(peer gdp.Hash, msg C.Msg) {
+		C.bridgeMsgCallbackFunc(callback, hashToPeerAddr(peer), msg)
+	})
+	return C.LOG_SYNC_OK
+}
+
+func (ctx *LogSyncCtx) setCallback(callback msgCallback) {
+	ctx.callbackMutex.Lock()
+	defer ctx.callbackMutex.Unlock()
+	ctx.callback = callback
+}
+
+func (ctx *LogSyncCtx) getCallback() msgCallback {
+	ctx.callbackMutex.RLock()
+	defer ctx.callbackMutex.RUnlock()
+	return ctx.callback
+}
+
+// sendMsg encodes msg for peer and passes it to the callback of ctx,
+// or returns it if ctx is not in callback mode
+func (ctx *LogSyncCtx) sendMsg(ticket HandleTicket, peer gdp.Hash, msg interface{}) (C.Msg, C.int) {
+	cMsg, err := toCMsg(msg, ctx.codec)
+	if err != nil {
+		return C.Msg{}, fail(ticket, C.LOG_SYNC_ERR_ENCODE, err)
+	}
+
+	if callback := ctx.getCallback(); callback != nil {
+		callback(peer, cMsg)
+		return C.Msg{}, C.LOG_SYNC_OK
+	}
+	return cMsg, C.LOG_SYNC_OK
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func TestMsgCallback(t *testing.T) {
+	aPath := newTestLog(t, "a", 5)
+	bPath := newTestLog(t, "b", 20)
+
+	aHandle, code := CreateLogSyncHandle(aPath)
+	assert.Equal(t, 0, int(code))
+	defer ReleaseLogSyncHandle(aHandle)
+	bHandle, code := CreateLogSyncHandle(bPath)
+	assert.Equal(t, 0, int(code))
+	defer ReleaseLogSyncHandle(bHandle)
+
+	a := uint32(aHandle.handleTicket)
+	b := uint32(bHandle.handleTicket)
+	addrs := map[HandleTicket]gdp.Hash{
+		a: gdp.GenerateHash("a"),
+		b: gdp.GenerateHash("b"),
+	}
+
+	// Each side delivers outgoing messages straight to the other
+	numMsgs := 0
+	finished := 0
+	connect := func(from, to HandleTicket) {
+		ctx, err := getLogSyncCtx(from)
+		assert.Nil(t, err)
+		ctx.setCallback(func(peer gdp.Hash, msg cMessage) {
+			assert.Equal(t, addrs[to], peer)
+			numMsgs++
+
+			_, code := handleMsg(to, addrs[from], msg)
+			freeMsg(msg)
+			if code == -1 {
+				finished++
+			} else {
+				assert.Equal(t, 0, int(code))
+			}
+		})
+	}
+	connect(a, b)
+	connect(b, a)
+
+	// The whole conversation runs within InitSync
+	_, code = initSync(a, addrs[b])
+	assert.Equal(t, 0, int(code))
+	assert.Equal(t, 1, finished)
+	assert.True(t, numMsgs >= 3)
+}
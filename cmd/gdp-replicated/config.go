@@ -0,0 +1,415 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/daemon"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/membership"
+	"github.com/tonyyanga/gdp-replicate/peers"
+	"github.com/tonyyanga/gdp-replicate/policy"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration file of the daemon, in YAML.
+//
+//	listen: 0.0.0.0:8000
+//	address: <GDP address of this replica, 64 hex digits>
+//	policy: graph
+//	verify: signature
+//	logs:
+//	  - address: <GDP address of the log>
+//	    database: /var/lib/gdp/log.db
+//	    publicKey: /etc/gdp/log-pub.pem
+//	fanout: 2
+//	interval: 500ms
+//	peers:
+//	  - address: <GDP address of the peer>
+//	    listen: 10.0.0.2:8000
+//	admin: 127.0.0.1:8080
+//	trace: /var/log/gdp/trace.jsonl
+//	pooled: true
+//	tls:
+//	  cert: /etc/gdp/replica.pem
+//	  key: /etc/gdp/replica-key.pem
+//	  ca: /etc/gdp/ca.pem
+type Config struct {
+	// Address to listen on for peers
+	Listen string `yaml:"listen"`
+
+	// GDP address of this replica, in hex
+	Address string `yaml:"address"`
+
+	// Path to the SQLite database of a log without address, which is
+	// replicated like by single log replicas
+	Database string `yaml:"database"`
+
+	// Logs hosted with an address
+	Logs []LogConfig `yaml:"logs"`
+
+	// Name of the policy of logs, see policy.Names. Defaults to "graph".
+	Policy string `yaml:"policy"`
+
+	// Options of the policy, zero values keep the defaults
+	BatchSize           int           `yaml:"batchSize"`
+	ConversationTimeout time.Duration `yaml:"conversationTimeout"`
+	ExpectedDifference  int           `yaml:"expectedDifference"`
+
+	// How records received from peers are checked before they are
+	// written: "none", "hash" or "signature". Defaults to "none".
+	Verify string `yaml:"verify"`
+
+	// Path to the PEM encoded public key of the log, required to
+	// verify signatures
+	PublicKey string `yaml:"publicKey"`
+
+	// Number of peers to send heart beats to in each round
+	Fanout int `yaml:"fanout"`
+
+	// Time between two rounds of heart beats
+	Interval time.Duration `yaml:"interval"`
+
+	// Time after which a peer that stopped gossiping is considered
+	// failed. Defaults to membership.DefaultFailTimeout.
+	FailTimeout time.Duration `yaml:"failTimeout"`
+
+	// Peers known at start, others are discovered through gossip
+	Peers []PeerConfig `yaml:"peers"`
+
+	// Address to serve the admin API and metrics on, see
+	// daemon.AdminHandler. Disabled if empty.
+	Admin string `yaml:"admin"`
+
+	// Path of the file records written from peers are traced to, see
+	// package trace. Disabled if empty.
+	Trace string `yaml:"trace"`
+
+	// Keep one long-lived connection to each peer instead of one
+	// connection per message, see peers.PooledGobServer
+	Pooled bool `yaml:"pooled"`
+
+	// Connections to peers use mutually authenticated TLS if set
+	TLS *TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig locates the PEM files of the TLS identity of the replica,
+// see peers.NewTLSConfig
+type TLSConfig struct {
+	// Certificate bound to the GDP address of this replica
+	Cert string `yaml:"cert"`
+
+	// Private key of the certificate
+	Key string `yaml:"key"`
+
+	// Certificate of the CA that issued the certificates of peers
+	CA string `yaml:"ca"`
+}
+
+// LogConfig locates a log
+type LogConfig struct {
+	// GDP address of the log, in hex
+	Address string `yaml:"address"`
+
+	// Path to the SQLite database of the log
+	Database string `yaml:"database"`
+
+	// Name of the policy of the log, defaults to the policy of Config
+	Policy string `yaml:"policy"`
+
+	// Record verification of the log, defaults to the one of Config
+	Verify    string `yaml:"verify"`
+	PublicKey string `yaml:"publicKey"`
+}
+
+// PeerConfig locates a peer
+type PeerConfig struct {
+	// GDP address of the peer, in hex
+	Address string `yaml:"address"`
+
+	// Address the peer listens on
+	Listen string `yaml:"listen"`
+}
+
+var (
+	errNoListen   = errors.New("listen address is required")
+	errNoDatabase = errors.New("database or logs are required")
+	errBadFanout  = errors.New("fanout must be positive")
+
+	errIncompleteTLS = errors.New("tls.cert, tls.key and tls.ca are required")
+
+	errNoPublicKey = errors.New("publicKey is required to verify signatures")
+	errNoPEM       = errors.New("no PEM encoded key found")
+	errNotECDSAKey = errors.New("public key is not an ECDSA key")
+)
+
+// Record verifications of Config.Verify, see gdp.HashChainVerifier
+const (
+	verifyNone      = "none"
+	verifyHash      = "hash"
+	verifySignature = "signature"
+)
+
+// LoadConfig reads and validates the config file at path. Defaults
+// are filled in for missing optional fields.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{
+		Policy:      policy.GraphDiffPolicyName,
+		Fanout:      1,
+		Interval:    daemon.DefaultHeartBeatInterval,
+		FailTimeout: membership.DefaultFailTimeout,
+	}
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate checks that the config can be used to run a daemon
+func (config *Config) Validate() error {
+	if config.Listen == "" {
+		return errNoListen
+	}
+	if _, err := gdp.ParseHash(config.Address); err != nil {
+		return fmt.Errorf("address: %v", err)
+	}
+	if config.Database == "" && len(config.Logs) == 0 {
+		return errNoDatabase
+	}
+	if err := validatePolicy(config.Policy); err != nil {
+		return err
+	}
+	if config.Database != "" {
+		if err := validateVerify(config.Verify, config.PublicKey); err != nil {
+			return err
+		}
+	}
+
+	logs := make(map[gdp.Hash]bool)
+	for i, log := range config.Logs {
+		addr, err := gdp.ParseHash(log.Address)
+		if err != nil {
+			return fmt.Errorf("logs[%d].address: %v", i, err)
+		}
+		if logs[addr] {
+			return fmt.Errorf("logs[%d].address is not unique", i)
+		}
+		logs[addr] = true
+
+		if log.Database == "" {
+			return fmt.Errorf("logs[%d].database is required", i)
+		}
+		if log.Policy != "" {
+			if err := validatePolicy(log.Policy); err != nil {
+				return fmt.Errorf("logs[%d]: %v", i, err)
+			}
+		}
+		verify, publicKey := config.logVerify(log)
+		if err := validateVerify(verify, publicKey); err != nil {
+			return fmt.Errorf("logs[%d]: %v", i, err)
+		}
+	}
+
+	if config.Fanout <= 0 {
+		return errBadFanout
+	}
+	if config.Interval <= 0 {
+		return fmt.Errorf("interval must be positive, got %v", config.Interval)
+	}
+
+	if config.FailTimeout < 0 {
+		return fmt.Errorf("failTimeout must not be negative, got %v", config.FailTimeout)
+	}
+	for i, peer := range config.Peers {
+		if _, err := gdp.ParseHash(peer.Address); err != nil {
+			return fmt.Errorf("peers[%d].address: %v", i, err)
+		}
+		if peer.Listen == "" {
+			return fmt.Errorf("peers[%d].listen is required", i)
+		}
+	}
+
+	if tls := config.TLS; tls != nil {
+		if tls.Cert == "" || tls.Key == "" || tls.CA == "" {
+			return errIncompleteTLS
+		}
+	}
+	return nil
+}
+
+func validatePolicy(name string) error {
+	for _, known := range policy.Names() {
+		if name == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("policy %q: %v", name, policy.ErrUnknownPolicy)
+}
+
+func validateVerify(verify, publicKey string) error {
+	switch verify {
+	case "", verifyNone, verifyHash:
+		return nil
+	case verifySignature:
+		if publicKey == "" {
+			return errNoPublicKey
+		}
+		return nil
+	default:
+		return fmt.Errorf("verify %q: must be %s, %s or %s", verify, verifyNone, verifyHash, verifySignature)
+	}
+}
+
+// logVerify returns the record verification of log, defaulting to the
+// one of config
+func (config *Config) logVerify(log LogConfig) (string, string) {
+	verify, publicKey := log.Verify, log.PublicKey
+	if verify == "" {
+		verify = config.Verify
+	}
+	if publicKey == "" {
+		publicKey = config.PublicKey
+	}
+	return verify, publicKey
+}
+
+// newVerifier returns the verifier of records received from peers for
+// verify, loading the public key at publicKey if needed. Returns nil if
+// records are not verified.
+func newVerifier(verify, publicKey string) (gdp.RecordVerifier, error) {
+	switch verify {
+	case verifyHash:
+		return &gdp.HashChainVerifier{HashOnly: true}, nil
+	case verifySignature:
+		key, err := readPublicKey(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("publicKey %s: %v", publicKey, err)
+		}
+		return gdp.NewHashChainVerifier(key), nil
+	default:
+		return nil, nil
+	}
+}
+
+// readPublicKey reads a PEM encoded ECDSA public key
+func readPublicKey(path string) (*ecdsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errNoPEM
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errNotECDSAKey
+	}
+	return ecdsaKey, nil
+}
+
+// GDPAddress returns the GDP address of this replica
+func (config *Config) GDPAddress() gdp.Hash {
+	addr, _ := gdp.ParseHash(config.Address)
+	return addr
+}
+
+// PeerAddrs maps the GDP addresses of peers to their network addresses
+func (config *Config) PeerAddrs() map[gdp.Hash]string {
+	peerAddrs := make(map[gdp.Hash]string)
+	for _, peer := range config.Peers {
+		addr, _ := gdp.ParseHash(peer.Address)
+		peerAddrs[addr] = peer.Listen
+	}
+	return peerAddrs
+}
+
+// NetworkOptions returns how the daemon exchanges messages with peers,
+// loading the TLS identity if configured
+func (config *Config) NetworkOptions() (daemon.NetworkOptions, error) {
+	opts := daemon.NetworkOptions{Pooled: config.Pooled}
+	if config.TLS != nil {
+		tlsConfig, err := peers.NewTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.CA)
+		if err != nil {
+			return opts, fmt.Errorf("tls: %v", err)
+		}
+		opts.TLS = tlsConfig
+	}
+	return opts, nil
+}
+
+// PolicyOptions returns the options of the policy shared by all logs,
+// see LogConfigs for the verification of each log
+func (config *Config) PolicyOptions() policy.Options {
+	return policy.Options{
+		BatchSize:           config.BatchSize,
+		ConversationTimeout: config.ConversationTimeout,
+		ExpectedDifference:  config.ExpectedDifference,
+	}
+}
+
+// LogConfigs returns the logs to host, loading the public keys of the
+// logs whose signatures are verified
+func (config *Config) LogConfigs() ([]daemon.LogConfig, error) {
+	logs := make([]daemon.LogConfig, 0, len(config.Logs)+1)
+	if config.Database != "" {
+		opts := config.PolicyOptions()
+		verifier, err := newVerifier(config.Verify, config.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		opts.Verifier = verifier
+
+		logs = append(logs, daemon.LogConfig{
+			Name:    gdp.NullHash,
+			SQLFile: config.Database,
+			Policy:  config.Policy,
+			Options: opts,
+		})
+	}
+
+	for i, log := range config.Logs {
+		addr, _ := gdp.ParseHash(log.Address)
+		logPolicy := log.Policy
+		if logPolicy == "" {
+			logPolicy = config.Policy
+		}
+
+		opts := config.PolicyOptions()
+		verifier, err := newVerifier(config.logVerify(log))
+		if err != nil {
+			return nil, fmt.Errorf("logs[%d]: %v", i, err)
+		}
+		opts.Verifier = verifier
+
+		logs = append(logs, daemon.LogConfig{
+			Name:    addr,
+			SQLFile: log.Database,
+			Policy:  logPolicy,
+			Options: opts,
+		})
+	}
+	return logs, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path
+}
+
+// writePublicKey writes the PEM encoded public key of a new log key
+func writePublicKey(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "log-pub.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	self := gdp.GenerateHash("self")
+	peer := gdp.GenerateHash("peer")
+
+	path := writeConfig(t, fmt.Sprintf(`
+listen: localhost:8000
+address: %x
+database: log.db
+policy: naive
+batchSize: 16
+conversationTimeout: 10s
+verify: hash
+pooled: true
+peers:
+  - address: %x
+    listen: localhost:8001
+`, self, peer))
+
+	config, err := LoadConfig(path)
+	assert.Nil(t, err)
+	assert.Equal(t, self, config.GDPAddress())
+	assert.Equal(t, map[gdp.Hash]string{peer: "localhost:8001"}, config.PeerAddrs())
+	assert.Equal(t, "naive", config.Policy)
+	assert.Equal(t, 16, config.PolicyOptions().BatchSize)
+	assert.Equal(t, 10*time.Second, config.PolicyOptions().ConversationTimeout)
+
+	// Defaults
+	assert.Equal(t, 1, config.Fanout)
+	assert.Equal(t, 500*time.Millisecond, config.Interval)
+
+	logs, err := config.LogConfigs()
+	assert.Nil(t, err)
+	assert.Len(t, logs, 1)
+	assert.Equal(t, gdp.NullHash, logs[0].Name)
+	assert.Equal(t, "log.db", logs[0].SQLFile)
+	assert.Equal(t, &gdp.HashChainVerifier{HashOnly: true}, logs[0].Options.Verifier)
+
+	// Plain TCP unless TLS is configured
+	network, err := config.NetworkOptions()
+	assert.Nil(t, err)
+	assert.Nil(t, network.TLS)
+	assert.True(t, network.Pooled)
+
+	config.TLS = &TLSConfig{Cert: "missing.pem", Key: "missing-key.pem", CA: "ca.pem"}
+	_, err = config.NetworkOptions()
+	assert.NotNil(t, err)
+}
+
+func TestLoadMultiLogConfig(t *testing.T) {
+	first := gdp.GenerateHash("first")
+	second := gdp.GenerateHash("second")
+	publicKey := writePublicKey(t)
+
+	path := writeConfig(t, fmt.Sprintf(`
+listen: localhost:8000
+address: %x
+policy: graph
+logs:
+  - address: %x
+    database: first.db
+  - address: %x
+    database: second.db
+    policy: merkle
+    verify: signature
+    publicKey: %s
+peers:
+  - address: %x
+    listen: localhost:8001
+`, gdp.GenerateHash("self"), first, second, publicKey, gdp.GenerateHash("peer")))
+
+	config, err := LoadConfig(path)
+	assert.Nil(t, err)
+
+	logs, err := config.LogConfigs()
+	assert.Nil(t, err)
+	assert.Len(t, logs, 2)
+	assert.Nil(t, logs[0].Options.Verifier)
+	assert.Equal(t, first, logs[0].Name)
+	assert.Equal(t, "graph", logs[0].Policy)
+	assert.Equal(t, second, logs[1].Name)
+	assert.Equal(t, "second.db", logs[1].SQLFile)
+	assert.Equal(t, "merkle", logs[1].Policy)
+	verifier, ok := logs[1].Options.Verifier.(*gdp.HashChainVerifier)
+	assert.True(t, ok)
+	assert.False(t, verifier.HashOnly)
+
+	// The public key is loaded with the logs
+	config.Logs[1].PublicKey = writeConfig(t, "not a key")
+	_, err = config.LogConfigs()
+	assert.NotNil(t, err)
+}
+
+func TestValidateConfig(t *testing.T) {
+	valid := func() *Config {
+		return &Config{
+			Listen:   "localhost:8000",
+			Address:  fmt.Sprintf("%x", gdp.GenerateHash("self")),
+			Database: "log.db",
+			Policy:   "graph",
+			Fanout:   1,
+			Interval: time.Second,
+			Peers: []PeerConfig{{
+				Address: fmt.Sprintf("%x", gdp.GenerateHash("peer")),
+				Listen:  "localhost:8001",
+			}},
+		}
+	}
+	assert.Nil(t, valid().Validate())
+
+	// The first replica of a cluster has no peers to start from
+	noPeers := valid()
+	noPeers.Peers = nil
+	assert.Nil(t, noPeers.Validate())
+
+	invalid := []func(*Config){
+		func(c *Config) { c.Listen = "" },
+		func(c *Config) { c.Address = "localhost:8000" },
+		func(c *Config) { c.Database = "" },
+		func(c *Config) { c.Logs = []LogConfig{{Address: "abcd", Database: "log.db"}} },
+		func(c *Config) { c.Logs = []LogConfig{{Address: c.Address}} },
+		func(c *Config) { c.Logs = []LogConfig{{Address: c.Address, Database: "log.db", Policy: "missing"}} },
+		func(c *Config) {
+			c.Logs = []LogConfig{{Address: c.Address, Database: "a.db"}, {Address: c.Address, Database: "b.db"}}
+		},
+		func(c *Config) { c.Policy = "missing" },
+		func(c *Config) { c.Fanout = 0 },
+		func(c *Config) { c.Interval = 0 },
+		func(c *Config) { c.FailTimeout = -time.Second },
+		func(c *Config) { c.Peers[0].Address = "abcd" },
+		func(c *Config) { c.Peers[0].Listen = "" },
+		func(c *Config) { c.TLS = &TLSConfig{Cert: "cert.pem", Key: "key.pem"} },
+		func(c *Config) { c.Verify = "always" },
+		func(c *Config) { c.Verify = "signature" },
+		func(c *Config) {
+			c.Logs = []LogConfig{{Address: c.Address, Database: "log.db", Verify: "signature"}}
+		},
+	}
+	for i, change := range invalid {
+		config := valid()
+		change(config)
+		assert.NotNil(t, config.Validate(), "case %d", i)
+	}
+
+	_, err := LoadConfig(writeConfig(t, "listen: [not a string"))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,97 @@
+// Command gdp-replicated runs a replication daemon for the logs, peers
+// and policy in a config file, see Config.
+//
+//	gdp-replicated -config /etc/gdp-replicated.yaml
+//
+// The daemon stops on SIGTERM or SIGINT, after completing the heart
+// beats in progress.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tonyyanga/gdp-replicate/daemon"
+	"github.com/tonyyanga/gdp-replicate/trace"
+	"go.uber.org/zap"
+)
+
+func main() {
+	configPath := flag.String("config", "gdp-replicated.yaml", "path to the config file")
+	flag.Parse()
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	daemon.InitLogger(config.GDPAddress())
+
+	err = run(config)
+	if err != nil {
+		zap.S().Fatalw(
+			"Daemon failed",
+			"error", err,
+		)
+	}
+}
+
+// run runs the daemon of config until it is closed. Failures are
+// returned rather than fatal, so deferred closes such as the tracer's
+// run before the process exits.
+func run(config *Config) error {
+	network, err := config.NetworkOptions()
+	if err != nil {
+		return fmt.Errorf("configuring network: %v", err)
+	}
+
+	d := daemon.NewMultiLogDaemonWithNetwork(
+		config.Listen,
+		config.GDPAddress(),
+		config.PeerAddrs(),
+		network,
+	)
+	d.SetHeartBeatInterval(config.Interval)
+	if config.FailTimeout > 0 {
+		d.SetFailTimeout(config.FailTimeout)
+	}
+	d.SetAdminAddr(config.Admin)
+
+	var tracer *trace.Tracer
+	if config.Trace != "" {
+		tracer, err = trace.Open(config.GDPAddress(), config.Trace)
+		if err != nil {
+			return fmt.Errorf("opening trace %s: %v", config.Trace, err)
+		}
+		defer tracer.Close()
+	}
+
+	logs, err := config.LogConfigs()
+	if err != nil {
+		return err
+	}
+	for _, log := range logs {
+		log.Options.Tracer = tracer
+		err = d.AddLog(log)
+		if err != nil {
+			return fmt.Errorf("adding log %s from %s: %v", log.Name.Readable(), log.SQLFile, err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		zap.S().Infow(
+			"Shutting down",
+			"signal", sig,
+		)
+		d.Close()
+	}()
+
+	return d.Start(config.Fanout)
+}
@@ -0,0 +1,88 @@
+// Command gdp-trace reports how records propagated through a cluster
+// from the traces of its replicas, see package trace.
+//
+//	gdp-trace [-replicas n] trace.jsonl...
+//
+// Traces are written by gdp-replicated when trace is set in its config.
+// Replicas that wrote no traced record are only counted if -replicas is
+// given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/trace"
+)
+
+// percentiles reported for delays and convergence
+var percentiles = []float64{50, 90, 99, 100}
+
+func main() {
+	replicas := flag.Int("replicas", 0, "number of replicas of the cluster, replicas seen in traces if 0")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-replicas n] trace...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	events := make([]trace.Event, 0)
+	for _, path := range flag.Args() {
+		traced, err := readTrace(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			os.Exit(1)
+		}
+		events = append(events, traced...)
+	}
+
+	printReport(os.Stdout, trace.Analyze(events, *replicas))
+}
+
+func readTrace(path string) ([]trace.Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return trace.Read(file)
+}
+
+func printReport(w io.Writer, report trace.Report) {
+	fmt.Fprintf(w, "records:     %d\n", report.Records)
+	fmt.Fprintf(w, "replicas:    %d\n", report.Replicas)
+	fmt.Fprintf(w, "writes:      %d\n", len(report.Delays))
+	fmt.Fprintf(w, "converged:   %d\n", len(report.Convergence))
+	fmt.Fprintf(w, "incomplete:  %d\n", report.Incomplete)
+
+	fmt.Fprintln(w)
+	printDurations(w, "propagation delay", report.Delays)
+	printDurations(w, "time to full convergence", report.Convergence)
+
+	hops := make([]int, 0, len(report.Hops))
+	for hop := range report.Hops {
+		hops = append(hops, hop)
+	}
+	sort.Ints(hops)
+
+	fmt.Fprintln(w, "writes by hops")
+	for _, hop := range hops {
+		fmt.Fprintf(w, "  %d: %d\n", hop, report.Hops[hop])
+	}
+}
+
+func printDurations(w io.Writer, name string, durations []time.Duration) {
+	fmt.Fprintln(w, name)
+	for _, p := range percentiles {
+		fmt.Fprintf(w, "  p%-3v %v\n", p, trace.Percentile(durations, p))
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,415 @@
+package codec
+
+import (
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/policy"
+)
+
+// binaryCodec encodes messages in the protobuf wire format following
+// gdp_replicate.proto. Unknown fields are skipped, so fields can be
+// added to messages without breaking older replicas.
+type binaryCodec struct{}
+
+func (binaryCodec) ID() byte {
+	return BinaryID
+}
+
+func (binaryCodec) Encode(msgType MsgType, msg interface{}) ([]byte, error) {
+	w := &protoWriter{}
+	switch msg := msg.(type) {
+	case *policy.NaiveMsgContent:
+		encodeNaive(w, msg)
+	case *policy.GraphMsgContent:
+		encodeGraph(w, msg)
+	case *policy.MerkleMsgContent:
+		encodeMerkle(w, msg)
+	case *policy.IBLTMsgContent:
+		encodeIBLT(w, msg)
+	default:
+		return nil, errUnknownMsgType
+	}
+	return w.buf, nil
+}
+
+func (binaryCodec) Decode(msgType MsgType, payload []byte) (interface{}, error) {
+	r := &protoReader{buf: payload}
+	switch msgType {
+	case TypeNaive:
+		return decodeNaive(r)
+	case TypeGraph:
+		return decodeGraph(r)
+	case TypeMerkle:
+		return decodeMerkle(r)
+	case TypeIBLT:
+		return decodeIBLT(r)
+	default:
+		return nil, errUnknownMsgType
+	}
+}
+
+func encodeRecords(w *protoWriter, field int, records []gdp.Record) {
+	for i := range records {
+		record := &records[i]
+		w.message(field, func(w *protoWriter) {
+			w.hash(1, record.Hash)
+			w.int(2, int64(record.RecNo))
+			w.int(3, record.Timestamp)
+			w.double(4, record.Accuracy)
+			w.hash(5, record.PrevHash)
+			w.bytes(6, record.Value)
+			w.bytes(7, record.Sig)
+		})
+	}
+}
+
+func decodeRecord(r *protoReader) (gdp.Record, error) {
+	var record gdp.Record
+	for !r.done() {
+		field, err := r.next()
+		if err != nil {
+			return record, err
+		}
+
+		switch field {
+		case 1:
+			record.Hash, err = r.hash()
+		case 2:
+			var recNo int64
+			recNo, err = r.int()
+			record.RecNo = int(recNo)
+		case 3:
+			record.Timestamp, err = r.int()
+		case 4:
+			record.Accuracy, err = r.double()
+		case 5:
+			record.PrevHash, err = r.hash()
+		case 6:
+			record.Value, err = r.bytes()
+		case 7:
+			record.Sig, err = r.bytes()
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return record, err
+		}
+	}
+	return record, nil
+}
+
+// appendRecord decodes an embedded record and appends it to records
+func appendRecord(r *protoReader, records []gdp.Record) ([]gdp.Record, error) {
+	sub, err := r.message()
+	if err != nil {
+		return records, err
+	}
+	record, err := decodeRecord(sub)
+	if err != nil {
+		return records, err
+	}
+	return append(records, record), nil
+}
+
+// appendHash decodes a hash and appends it to hashes
+func appendHash(r *protoReader, hashes []gdp.Hash) ([]gdp.Hash, error) {
+	hash, err := r.hash()
+	if err != nil {
+		return hashes, err
+	}
+	return append(hashes, hash), nil
+}
+
+func encodeNaive(w *protoWriter, msg *policy.NaiveMsgContent) {
+	w.int(1, int64(msg.MsgNum))
+	w.hashes(2, msg.HashesAll)
+	w.hashes(3, msg.HashesTheyWant)
+	w.hashes(4, msg.HashesWeWant)
+	encodeRecords(w, 5, msg.RecordsTheyWant)
+	encodeRecords(w, 6, msg.RecordsWeWant)
+	w.bool(7, msg.MoreRecords)
+}
+
+func decodeNaive(r *protoReader) (*policy.NaiveMsgContent, error) {
+	msg := &policy.NaiveMsgContent{}
+	for !r.done() {
+		field, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch field {
+		case 1:
+			var num int64
+			num, err = r.int()
+			msg.MsgNum = int(num)
+		case 2:
+			msg.HashesAll, err = appendHash(r, msg.HashesAll)
+		case 3:
+			msg.HashesTheyWant, err = appendHash(r, msg.HashesTheyWant)
+		case 4:
+			msg.HashesWeWant, err = appendHash(r, msg.HashesWeWant)
+		case 5:
+			msg.RecordsTheyWant, err = appendRecord(r, msg.RecordsTheyWant)
+		case 6:
+			msg.RecordsWeWant, err = appendRecord(r, msg.RecordsWeWant)
+		case 7:
+			msg.MoreRecords, err = r.bool()
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func encodeGraph(w *protoWriter, msg *policy.GraphMsgContent) {
+	w.int(1, int64(msg.Num))
+	w.hashes(2, msg.LogicalBegins)
+	w.hashes(3, msg.LogicalEnds)
+	encodeRecords(w, 4, msg.RecordsNotInRX)
+	w.hashes(5, msg.HashesTXWants)
+	w.bool(6, msg.MoreRecords)
+	w.uint(7, msg.Session)
+}
+
+func decodeGraph(r *protoReader) (*policy.GraphMsgContent, error) {
+	msg := &policy.GraphMsgContent{}
+	for !r.done() {
+		field, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch field {
+		case 1:
+			var num int64
+			num, err = r.int()
+			msg.Num = int(num)
+		case 2:
+			msg.LogicalBegins, err = appendHash(r, msg.LogicalBegins)
+		case 3:
+			msg.LogicalEnds, err = appendHash(r, msg.LogicalEnds)
+		case 4:
+			msg.RecordsNotInRX, err = appendRecord(r, msg.RecordsNotInRX)
+		case 5:
+			msg.HashesTXWants, err = appendHash(r, msg.HashesTXWants)
+		case 6:
+			msg.MoreRecords, err = r.bool()
+		case 7:
+			msg.Session, err = r.uint()
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func encodeMerkle(w *protoWriter, msg *policy.MerkleMsgContent) {
+	w.int(1, int64(msg.Num))
+	w.uint(2, msg.Session)
+	for i := range msg.Nodes {
+		node := &msg.Nodes[i]
+		w.message(3, func(w *protoWriter) {
+			w.bytes(1, node.Path)
+			w.hash(2, node.Digest)
+			w.int(3, int64(node.Count))
+		})
+	}
+	for i := range msg.Buckets {
+		bucket := &msg.Buckets[i]
+		w.message(4, func(w *protoWriter) {
+			w.bytes(1, bucket.Path)
+			w.hashes(2, bucket.Hashes)
+		})
+	}
+	w.hashes(5, msg.Wants)
+	encodeRecords(w, 6, msg.Records)
+	w.bool(7, msg.MoreRecords)
+}
+
+func decodeMerkleNode(r *protoReader) (policy.MerkleNodeDigest, error) {
+	node := policy.MerkleNodeDigest{Path: []byte{}}
+	for !r.done() {
+		field, err := r.next()
+		if err != nil {
+			return node, err
+		}
+
+		switch field {
+		case 1:
+			node.Path, err = r.bytes()
+		case 2:
+			node.Digest, err = r.hash()
+		case 3:
+			var count int64
+			count, err = r.int()
+			node.Count = int(count)
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return node, err
+		}
+	}
+	return node, nil
+}
+
+func decodeMerkleBucket(r *protoReader) (policy.MerkleBucket, error) {
+	bucket := policy.MerkleBucket{Path: []byte{}}
+	for !r.done() {
+		field, err := r.next()
+		if err != nil {
+			return bucket, err
+		}
+
+		switch field {
+		case 1:
+			bucket.Path, err = r.bytes()
+		case 2:
+			bucket.Hashes, err = appendHash(r, bucket.Hashes)
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return bucket, err
+		}
+	}
+	return bucket, nil
+}
+
+func decodeMerkle(r *protoReader) (*policy.MerkleMsgContent, error) {
+	msg := &policy.MerkleMsgContent{}
+	for !r.done() {
+		field, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch field {
+		case 1:
+			var num int64
+			num, err = r.int()
+			msg.Num = int(num)
+		case 2:
+			msg.Session, err = r.uint()
+		case 3:
+			var sub *protoReader
+			var node policy.MerkleNodeDigest
+			if sub, err = r.message(); err == nil {
+				node, err = decodeMerkleNode(sub)
+				msg.Nodes = append(msg.Nodes, node)
+			}
+		case 4:
+			var sub *protoReader
+			var bucket policy.MerkleBucket
+			if sub, err = r.message(); err == nil {
+				bucket, err = decodeMerkleBucket(sub)
+				msg.Buckets = append(msg.Buckets, bucket)
+			}
+		case 5:
+			msg.Wants, err = appendHash(r, msg.Wants)
+		case 6:
+			msg.Records, err = appendRecord(r, msg.Records)
+		case 7:
+			msg.MoreRecords, err = r.bool()
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+func encodeIBLT(w *protoWriter, msg *policy.IBLTMsgContent) {
+	w.int(1, int64(msg.Num))
+	for i := range msg.Cells {
+		cell := &msg.Cells[i]
+		w.message(2, func(w *protoWriter) {
+			w.int(1, int64(cell.Count))
+			w.hash(2, cell.KeySum)
+			w.uint(3, cell.HashSum)
+		})
+	}
+	w.int(3, int64(msg.Difference))
+	w.bool(4, msg.Fallback)
+	if msg.Reply != nil {
+		w.message(5, func(w *protoWriter) {
+			encodeNaive(w, msg.Reply)
+		})
+	}
+}
+
+func decodeIBLTCell(r *protoReader) (policy.IBLTCell, error) {
+	var cell policy.IBLTCell
+	for !r.done() {
+		field, err := r.next()
+		if err != nil {
+			return cell, err
+		}
+
+		switch field {
+		case 1:
+			var count int64
+			count, err = r.int()
+			cell.Count = int(count)
+		case 2:
+			cell.KeySum, err = r.hash()
+		case 3:
+			cell.HashSum, err = r.uint()
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return cell, err
+		}
+	}
+	return cell, nil
+}
+
+func decodeIBLT(r *protoReader) (*policy.IBLTMsgContent, error) {
+	msg := &policy.IBLTMsgContent{}
+	for !r.done() {
+		field, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+
+		switch field {
+		case 1:
+			var num int64
+			num, err = r.int()
+			msg.Num = int(num)
+		case 2:
+			var sub *protoReader
+			var cell policy.IBLTCell
+			if sub, err = r.message(); err == nil {
+				cell, err = decodeIBLTCell(sub)
+				msg.Cells = append(msg.Cells, cell)
+			}
+		case 3:
+			var difference int64
+			difference, err = r.int()
+			msg.Difference = int(difference)
+		case 4:
+			msg.Fallback, err = r.bool()
+		case 5:
+			var sub *protoReader
+			if sub, err = r.message(); err == nil {
+				msg.Reply, err = decodeNaive(sub)
+			}
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
@@ -0,0 +1,130 @@
+/*
+Package codec serializes policy messages exchanged between replicas.
+
+Every message travels in an envelope, see Header, that names the codec
+used for its payload and the type of the message. Receivers pick the
+codec from the envelope, so replicas configured with different codecs
+interoperate, and components written in other languages can implement
+the binary codec from gdp_replicate.proto.
+*/
+package codec
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/tonyyanga/gdp-replicate/policy"
+)
+
+// MsgType identifies the type of the message in an envelope
+type MsgType uint16
+
+// Message types
+const (
+	TypeNaive  MsgType = iota + 1 // *policy.NaiveMsgContent
+	TypeGraph                     // *policy.GraphMsgContent
+	TypeMerkle                    // *policy.MerkleMsgContent
+	TypeIBLT                      // *policy.IBLTMsgContent
+)
+
+// Message types reserved for transports. Their payload is not decoded
+// by codecs.
+const (
+	// The payload is the 32-byte address of the sender of all following
+	// messages on a stream
+	TypeHello MsgType = 0xff01
+
+	// The payload is a gob encoded interface value, for content of Go
+	// transports without a message type
+	TypeGoValue MsgType = 0xff02
+)
+
+// Codec IDs of the built-in codecs
+const (
+	GobID    byte = 1
+	BinaryID byte = 2
+)
+
+var (
+	errUnknownCodec   = errors.New("unknown codec")
+	errUnknownMsgType = errors.New("unknown message type")
+)
+
+// A Codec serializes the payload of a message
+type Codec interface {
+	// ID identifies the codec in envelopes
+	ID() byte
+
+	// Encode serializes a message of type msgType
+	Encode(msgType MsgType, msg interface{}) ([]byte, error)
+
+	// Decode deserializes a message of type msgType
+	Decode(msgType MsgType, payload []byte) (interface{}, error)
+}
+
+var (
+	// Gob serializes payloads with encoding/gob
+	Gob Codec = gobCodec{}
+
+	// Binary serializes payloads in the protobuf wire format
+	Binary Codec = binaryCodec{}
+)
+
+var (
+	codecsMutex = &sync.RWMutex{}
+	codecs      = map[byte]Codec{
+		GobID:    Gob,
+		BinaryID: Binary,
+	}
+)
+
+// Register makes a codec available to decode envelopes with its ID
+func Register(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+	codecs[codec.ID()] = codec
+}
+
+// ByID returns the codec registered with id
+func ByID(id byte) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	codec, ok := codecs[id]
+	if !ok {
+		return nil, errUnknownCodec
+	}
+	return codec, nil
+}
+
+// TypeOf returns the message type of msg
+func TypeOf(msg interface{}) (MsgType, error) {
+	switch msg.(type) {
+	case *policy.NaiveMsgContent:
+		return TypeNaive, nil
+	case *policy.GraphMsgContent:
+		return TypeGraph, nil
+	case *policy.MerkleMsgContent:
+		return TypeMerkle, nil
+	case *policy.IBLTMsgContent:
+		return TypeIBLT, nil
+	default:
+		return 0, errUnknownMsgType
+	}
+}
+
+// newMessage returns an empty message of type msgType to decode into
+func newMessage(msgType MsgType) (interface{}, error) {
+	switch msgType {
+	case TypeNaive:
+		return &policy.NaiveMsgContent{}, nil
+	case TypeGraph:
+		return &policy.GraphMsgContent{}, nil
+	case TypeMerkle:
+		return &policy.MerkleMsgContent{}, nil
+	case TypeIBLT:
+		return &policy.IBLTMsgContent{}, nil
+	default:
+		return nil, errUnknownMsgType
+	}
+}
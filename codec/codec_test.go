@@ -0,0 +1,207 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/policy"
+)
+
+func testRecords() []gdp.Record {
+	return []gdp.Record{
+		{
+			Metadatum: gdp.Metadatum{
+				Hash:      gdp.GenerateHash("first"),
+				RecNo:     1,
+				Timestamp: 1500000000,
+				Accuracy:  0.5,
+				Sig:       []byte{1, 2, 3},
+			},
+			Value: []byte("first value"),
+		},
+		{
+			Metadatum: gdp.Metadatum{
+				Hash:      gdp.GenerateHash("second"),
+				RecNo:     2,
+				Timestamp: -1,
+				PrevHash:  gdp.GenerateHash("first"),
+			},
+			Value: []byte("second value"),
+		},
+	}
+}
+
+func testMessages() []interface{} {
+	hashes := []gdp.Hash{gdp.GenerateHash("a"), gdp.NullHash, gdp.GenerateHash("b")}
+	naive := &policy.NaiveMsgContent{
+		MsgNum:         2,
+		HashesTheyWant: hashes,
+		RecordsWeWant:  testRecords(),
+		MoreRecords:    true,
+	}
+
+	return []interface{}{
+		naive,
+		&policy.GraphMsgContent{
+			Num:            1,
+			LogicalBegins:  hashes,
+			LogicalEnds:    hashes[:1],
+			RecordsNotInRX: testRecords(),
+			Session:        1 << 63,
+		},
+		&policy.MerkleMsgContent{
+			Session: 42,
+			Nodes: []policy.MerkleNodeDigest{
+				{Path: []byte{}, Digest: hashes[0], Count: 1000},
+				{Path: []byte{3, 15}, Count: 0},
+			},
+			Buckets: []policy.MerkleBucket{
+				{Path: []byte{7}, Hashes: hashes},
+			},
+			Wants:   hashes[2:],
+			Records: testRecords(),
+		},
+		&policy.IBLTMsgContent{
+			Num: 1,
+			Cells: []policy.IBLTCell{
+				{Count: -2, KeySum: hashes[0], HashSum: 1<<64 - 1},
+				{},
+			},
+			Difference: 7,
+			Reply:      naive,
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{Gob, Binary} {
+		for _, msg := range testMessages() {
+			data, err := Marshal(codec, msg)
+			assert.Nil(t, err)
+			assert.True(t, IsEnvelope(data))
+			assert.Equal(t, codec.ID(), data[5])
+
+			decoded, err := Unmarshal(data)
+			assert.Nil(t, err)
+			assertSameMessage(t, msg, decoded)
+		}
+	}
+}
+
+// assertSameMessage compares messages by their binary encoding, which
+// does not distinguish nil and empty slices
+func assertSameMessage(t *testing.T, expected, actual interface{}) {
+	expectedType, err := TypeOf(expected)
+	assert.Nil(t, err)
+	actualType, err := TypeOf(actual)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedType, actualType)
+
+	expectedPayload, err := Binary.Encode(expectedType, expected)
+	assert.Nil(t, err)
+	actualPayload, err := Binary.Encode(actualType, actual)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedPayload, actualPayload)
+}
+
+func TestBinarySkipsUnknownFields(t *testing.T) {
+	msg := &policy.GraphMsgContent{Num: 3, Session: 9}
+	payload, err := Binary.Encode(TypeGraph, msg)
+	assert.Nil(t, err)
+
+	// Fields a newer replica might add
+	w := &protoWriter{buf: payload}
+	w.uint(100, 5)
+	w.bytes(101, []byte("new"))
+	w.double(102, 1.5)
+
+	decoded, err := Binary.Decode(TypeGraph, w.buf)
+	assert.Nil(t, err)
+	assert.Equal(t, msg, decoded)
+}
+
+func TestBadEnvelopes(t *testing.T) {
+	data, err := Marshal(Binary, testMessages()[0])
+	assert.Nil(t, err)
+
+	_, err = Unmarshal(append([]byte("XXXX"), data[4:]...))
+	assert.Equal(t, errBadMagic, err)
+
+	_, err = Unmarshal(data[:len(data)-1])
+	assert.NotNil(t, err)
+
+	unknownCodec := append([]byte{}, data...)
+	unknownCodec[5] = 99
+	_, err = Unmarshal(unknownCodec)
+	assert.Equal(t, errUnknownCodec, err)
+
+	newerVersion := append([]byte{}, data...)
+	newerVersion[4] = Version + 1
+	_, err = Unmarshal(newerVersion)
+	assert.Equal(t, errBadVersion, err)
+
+	_, err = Marshal(Binary, "not a message")
+	assert.Equal(t, errUnknownMsgType, err)
+
+	// Frames of a stream are read one by one
+	stream := &bytes.Buffer{}
+	for _, msg := range testMessages() {
+		assert.Nil(t, WriteMessage(stream, Gob, msg))
+	}
+	for _, msg := range testMessages() {
+		decoded, err := ReadMessage(stream)
+		assert.Nil(t, err)
+		assertSameMessage(t, msg, decoded)
+	}
+}
+
+func TestLogEnvelopes(t *testing.T) {
+	log := gdp.GenerateHash("log")
+	msg := testMessages()[1]
+
+	stream := &bytes.Buffer{}
+	assert.Nil(t, WriteLogMessage(stream, Binary, log, msg))
+	assert.Nil(t, WriteMessage(stream, Binary, msg))
+	assert.Equal(t, Version, stream.Bytes()[4])
+
+	header, payload, err := ReadFrame(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, Version, header.Version)
+	assert.Equal(t, FlagLog, header.Flags)
+	assert.Equal(t, log, header.Log)
+	decoded, err := DecodePayload(header, payload)
+	assert.Nil(t, err)
+	assertSameMessage(t, msg, decoded)
+
+	// Messages without a log keep the version 1 layout
+	assert.Equal(t, byte(1), stream.Bytes()[4])
+	header, _, err = ReadFrame(stream)
+	assert.Nil(t, err)
+	assert.Equal(t, gdp.NullHash, header.Log)
+
+	data := &bytes.Buffer{}
+	assert.Nil(t, WriteLogMessage(data, Binary, log, msg))
+	_, err = Unmarshal(data.Bytes()[:HeaderSize+10])
+	assert.NotNil(t, err)
+
+	unknownFlags := append([]byte{}, data.Bytes()...)
+	unknownFlags[HeaderSize] |= 0x80
+	_, err = Unmarshal(unknownFlags)
+	assert.Equal(t, errBadFlags, err)
+}
+
+func TestLongPayload(t *testing.T) {
+	header := []byte(Magic + "\x01\x02\x00\x02\x00\x00\x00\x00")
+	binary.BigEndian.PutUint32(header[8:12], MaxPayloadSize+1)
+	_, err := Unmarshal(header)
+	assert.Equal(t, errPayloadTooLong, err)
+
+	// A peer announcing a long payload it does not send gets an error
+	binary.BigEndian.PutUint32(header[8:12], MaxPayloadSize)
+	_, _, err = ReadFrame(bytes.NewReader(append(header, 1, 2, 3)))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
@@ -0,0 +1,220 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+/*
+Envelope layout, all integers big endian:
+
+	magic    4 bytes  "GDPR"
+	version  1 byte   layout of the header, 1 or 2
+	codec    1 byte   ID of the codec of the payload
+	type     2 bytes  MsgType
+	length   4 bytes  length of the payload
+	flags    1 byte   version 2 only, see FlagLog
+	log      32 bytes address of the log of the message, if FlagLog is set
+	payload  length bytes
+
+Envelopes without flags are written in the version 1 layout, which
+replicas hosting a single log read as before.
+*/
+
+// Magic starts every envelope
+const Magic = "GDPR"
+
+// Version of the envelope layout
+const Version byte = 2
+
+// versionNoFlags is the version of the layout without flags
+const versionNoFlags byte = 1
+
+// HeaderSize is the size of a version 1 envelope without payload
+const HeaderSize = 12
+
+// Flags of version 2 envelopes
+const (
+	// The address of the log of the message follows the flags
+	FlagLog byte = 1 << iota
+)
+
+// knownFlags are the flags read by this version
+const knownFlags = FlagLog
+
+// logSize is the size of the log field
+const logSize = len(gdp.NullHash)
+
+// MaxPayloadSize bounds the payload of an envelope, a batch of
+// policy.DefaultBatchSize records of 16 KiB. Payloads are read as they
+// arrive, so peers cannot make a receiver allocate more than they send.
+const MaxPayloadSize = 1 << 24
+
+var (
+	errBadMagic       = errors.New("envelope does not start with magic")
+	errBadVersion     = errors.New("unsupported envelope version")
+	errBadFlags       = errors.New("unsupported envelope flags")
+	errPayloadTooLong = errors.New("envelope payload too long")
+)
+
+// Header describes the payload of an envelope
+type Header struct {
+	Version byte
+	Codec   byte
+	Type    MsgType
+	Length  uint32
+
+	// Flags of the envelope, 0 for version 1
+	Flags byte
+
+	// Log of the message, gdp.NullHash if none
+	Log gdp.Hash
+}
+
+// IsEnvelope checks if data starts like an envelope
+func IsEnvelope(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+// WriteFrame writes an envelope holding payload
+func WriteFrame(w io.Writer, codecID byte, msgType MsgType, payload []byte) error {
+	return WriteLogFrame(w, gdp.NullHash, codecID, msgType, payload)
+}
+
+// WriteLogFrame writes an envelope holding payload of a message of log
+func WriteLogFrame(w io.Writer, log gdp.Hash, codecID byte, msgType MsgType, payload []byte) error {
+	if len(payload) > MaxPayloadSize {
+		return errPayloadTooLong
+	}
+
+	var flags byte
+	if log != gdp.NullHash {
+		flags |= FlagLog
+	}
+
+	frame := make([]byte, HeaderSize, HeaderSize+1+logSize+len(payload))
+	copy(frame, Magic)
+	frame[4] = versionNoFlags
+	frame[5] = codecID
+	binary.BigEndian.PutUint16(frame[6:8], uint16(msgType))
+	binary.BigEndian.PutUint32(frame[8:12], uint32(len(payload)))
+	if flags != 0 {
+		frame[4] = Version
+		frame = append(frame, flags)
+	}
+	if flags&FlagLog != 0 {
+		frame = append(frame, log[:]...)
+	}
+	frame = append(frame, payload...)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads an envelope and returns its header and payload
+func ReadFrame(r io.Reader) (Header, []byte, error) {
+	raw := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, raw); err != nil {
+		return Header{}, nil, err
+	}
+	if !IsEnvelope(raw) {
+		return Header{}, nil, errBadMagic
+	}
+
+	header := Header{
+		Version: raw[4],
+		Codec:   raw[5],
+		Type:    MsgType(binary.BigEndian.Uint16(raw[6:8])),
+		Length:  binary.BigEndian.Uint32(raw[8:12]),
+	}
+	switch header.Version {
+	case versionNoFlags:
+	case Version:
+		var flags [1]byte
+		if _, err := io.ReadFull(r, flags[:]); err != nil {
+			return header, nil, err
+		}
+		header.Flags = flags[0]
+	default:
+		return header, nil, errBadVersion
+	}
+	if header.Flags&^knownFlags != 0 {
+		return header, nil, errBadFlags
+	}
+	if header.Flags&FlagLog != 0 {
+		if _, err := io.ReadFull(r, header.Log[:]); err != nil {
+			return header, nil, err
+		}
+	}
+	if header.Length > MaxPayloadSize {
+		return header, nil, errPayloadTooLong
+	}
+
+	// the buffer grows with the data received, not with header.Length
+	payload := &bytes.Buffer{}
+	_, err := io.CopyN(payload, r, int64(header.Length))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return header, nil, err
+	}
+	return header, payload.Bytes(), nil
+}
+
+// WriteMessage writes msg in an envelope using codec
+func WriteMessage(w io.Writer, codec Codec, msg interface{}) error {
+	return WriteLogMessage(w, codec, gdp.NullHash, msg)
+}
+
+// WriteLogMessage writes msg of log in an envelope using codec
+func WriteLogMessage(w io.Writer, codec Codec, log gdp.Hash, msg interface{}) error {
+	msgType, err := TypeOf(msg)
+	if err != nil {
+		return err
+	}
+
+	payload, err := codec.Encode(msgType, msg)
+	if err != nil {
+		return err
+	}
+	return WriteLogFrame(w, log, codec.ID(), msgType, payload)
+}
+
+// DecodePayload decodes the payload of an envelope with the codec named
+// by its header
+func DecodePayload(header Header, payload []byte) (interface{}, error) {
+	codec, err := ByID(header.Codec)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(header.Type, payload)
+}
+
+// ReadMessage reads a message in an envelope
+func ReadMessage(r io.Reader) (interface{}, error) {
+	header, payload, err := ReadFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePayload(header, payload)
+}
+
+// Marshal returns msg in an envelope using codec
+func Marshal(codec Codec, msg interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := WriteMessage(buf, codec, msg)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Unmarshal decodes a message in an envelope
+func Unmarshal(data []byte) (interface{}, error) {
+	return ReadMessage(bytes.NewReader(data))
+}
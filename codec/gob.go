@@ -0,0 +1,36 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// gobCodec encodes the concrete message type, so unlike a gob stream of
+// interface values it needs no gob.Register calls
+type gobCodec struct{}
+
+func (gobCodec) ID() byte {
+	return GobID
+}
+
+func (gobCodec) Encode(msgType MsgType, msg interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := gob.NewEncoder(buf).Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Decode(msgType MsgType, payload []byte) (interface{}, error) {
+	msg, err := newMessage(msgType)
+	if err != nil {
+		return nil, err
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(payload)).Decode(msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
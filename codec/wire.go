@@ -0,0 +1,229 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// Wire types of the protobuf encoding
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var (
+	errTruncated    = errors.New("truncated payload")
+	errBadWireType  = errors.New("unexpected wire type")
+	errBadHashField = errors.New("hash field is not 32 bytes")
+)
+
+// protoWriter appends fields in the protobuf wire format. Fields holding
+// the zero value are omitted, as in proto3.
+type protoWriter struct {
+	buf []byte
+}
+
+func (w *protoWriter) tag(field int, wireType int) {
+	w.buf = appendUvarint(w.buf, uint64(field)<<3|uint64(wireType))
+}
+
+func (w *protoWriter) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, wireVarint)
+	w.buf = appendUvarint(w.buf, v)
+}
+
+// int writes an int64 field, negative values take ten bytes
+func (w *protoWriter) int(field int, v int64) {
+	w.uint(field, uint64(v))
+}
+
+func (w *protoWriter) bool(field int, v bool) {
+	if v {
+		w.uint(field, 1)
+	}
+}
+
+func (w *protoWriter) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, wireFixed64)
+	w.buf = appendUint64(w.buf, math.Float64bits(v))
+}
+
+func (w *protoWriter) bytes(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	w.tag(field, wireBytes)
+	w.buf = appendUvarint(w.buf, uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *protoWriter) hash(field int, v gdp.Hash) {
+	if v == gdp.NullHash {
+		return
+	}
+	w.bytes(field, v[:])
+}
+
+// hashes writes a repeated bytes field, including null hashes
+func (w *protoWriter) hashes(field int, v []gdp.Hash) {
+	for i := range v {
+		w.tag(field, wireBytes)
+		w.buf = appendUvarint(w.buf, uint64(len(v[i])))
+		w.buf = append(w.buf, v[i][:]...)
+	}
+}
+
+// message writes an embedded message, including empty ones
+func (w *protoWriter) message(field int, encode func(w *protoWriter)) {
+	sub := &protoWriter{}
+	encode(sub)
+	w.tag(field, wireBytes)
+	w.buf = appendUvarint(w.buf, uint64(len(sub.buf)))
+	w.buf = append(w.buf, sub.buf...)
+}
+
+// protoReader reads fields in the protobuf wire format
+type protoReader struct {
+	buf []byte
+
+	// wire type of the last field read
+	wireType int
+}
+
+func (r *protoReader) done() bool {
+	return len(r.buf) == 0
+}
+
+// next reads the tag of the next field and returns its number
+func (r *protoReader) next() (int, error) {
+	tag, err := r.varint()
+	if err != nil {
+		return 0, err
+	}
+	r.wireType = int(tag & 7)
+	return int(tag >> 3), nil
+}
+
+func (r *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, errTruncated
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *protoReader) uint() (uint64, error) {
+	if r.wireType != wireVarint {
+		return 0, errBadWireType
+	}
+	return r.varint()
+}
+
+func (r *protoReader) int() (int64, error) {
+	v, err := r.uint()
+	return int64(v), err
+}
+
+func (r *protoReader) bool() (bool, error) {
+	v, err := r.uint()
+	return v != 0, err
+}
+
+func (r *protoReader) double() (float64, error) {
+	if r.wireType != wireFixed64 {
+		return 0, errBadWireType
+	}
+	if len(r.buf) < 8 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint64(r.buf)
+	r.buf = r.buf[8:]
+	return math.Float64frombits(v), nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	if r.wireType != wireBytes {
+		return nil, errBadWireType
+	}
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(r.buf)) < n {
+		return nil, errTruncated
+	}
+	v := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *protoReader) hash() (gdp.Hash, error) {
+	var hash gdp.Hash
+	v, err := r.bytes()
+	if err != nil {
+		return hash, err
+	}
+	if len(v) != len(hash) {
+		return hash, errBadHashField
+	}
+	copy(hash[:], v)
+	return hash, nil
+}
+
+// message returns a reader over an embedded message
+func (r *protoReader) message() (*protoReader, error) {
+	v, err := r.bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &protoReader{buf: v}, nil
+}
+
+// skip skips the value of a field unknown to the reader
+func (r *protoReader) skip() error {
+	switch r.wireType {
+	case wireVarint:
+		_, err := r.varint()
+		return err
+	case wireFixed64:
+		if len(r.buf) < 8 {
+			return errTruncated
+		}
+		r.buf = r.buf[8:]
+	case wireBytes:
+		_, err := r.bytes()
+		return err
+	case wireFixed32:
+		if len(r.buf) < 4 {
+			return errTruncated
+		}
+		r.buf = r.buf[4:]
+	default:
+		return errBadWireType
+	}
+	return nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], v)
+	return append(buf, tmp[:]...)
+}
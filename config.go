@@ -0,0 +1,133 @@
+package main
+
+/* This file creates handles configured by the host,
+   see CreateLogSyncHandleWithConfig */
+
+// #include "gdp_types.h"
+import "C"
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/codec"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/policy"
+	"go.uber.org/zap"
+)
+
+// defaultPolicy is the policy of handles created without a config
+const defaultPolicy = policy.ExternalGraphDiffPolicyName
+
+// handlePolicies are the policies a host may configure. They read the
+// log database in every conversation, so records gdplogd appends to the
+// database are replicated. The other policies load the log once when
+// created and are only used by the daemon.
+var handlePolicies = map[string]bool{
+	policy.ExternalGraphDiffPolicyName: true,
+	policy.MerklePolicyName:            true,
+}
+
+var (
+	errBadVerify    = errors.New("unknown record verification")
+	errNoPublicKey  = errors.New("signature verification requires a public key")
+	errNotECDSAKey  = errors.New("public key is not an ECDSA key")
+	errBadBatchSize = errors.New("batch size must be positive or -1")
+	errBadCodec     = errors.New("unknown message codec")
+	errBadPolicy    = errors.New("policy not available to handles, see LogSyncConfig")
+)
+
+/* CreateLogSyncHandleWithConfig creates the context for a log in the
+   log server like CreateLogSyncHandle, with the policy and options
+   in config. A NULL config keeps all defaults.
+
+   Return code is LOG_SYNC_OK or an error code, see LogSyncError.
+   On failure, the returned handle is only valid for GetLastError.
+
+   Memory convention:
+   Memory pointed to by config is managed by the caller.
+*/
+//export CreateLogSyncHandleWithConfig
+func CreateLogSyncHandleWithConfig(sqlFile string, config *C.LogSyncConfig) (handle C.LogSyncHandle, code C.int) {
+	defer recoverPanic(nullTicket, &code)
+
+	policyName, opts, msgCodec, err := toGoConfig(config)
+	if err != nil {
+		return C.LogSyncHandle{handleTicket: 0}, fail(nullTicket, C.LOG_SYNC_ERR_INVALID_ARGUMENT, err)
+	}
+
+	ticket, err := newLogSyncCtx(sqlFile, policyName, opts, msgCodec)
+	if err != nil {
+		return C.LogSyncHandle{handleTicket: 0}, fail(nullTicket, createFailure(err), err)
+	}
+
+	zap.S().Infow(
+		"Created new log sync handle",
+		"sql-file", sqlFile,
+		"policy", policyName,
+		"ticket", ticket,
+	)
+
+	return C.LogSyncHandle{handleTicket: C.uint32_t(ticket)}, C.LOG_SYNC_OK
+}
+
+// toGoConfig converts config to the name and options of a policy, and
+// the codec of outgoing messages
+func toGoConfig(config *C.LogSyncConfig) (string, policy.Options, codec.Codec, error) {
+	opts := policy.Options{}
+	if config == nil {
+		return defaultPolicy, opts, nil, nil
+	}
+
+	policyName := defaultPolicy
+	if config.policy != nil {
+		policyName = C.GoString(config.policy)
+	}
+	if !handlePolicies[policyName] {
+		return "", opts, nil, errBadPolicy
+	}
+
+	if config.batchSize < -1 {
+		return "", opts, nil, errBadBatchSize
+	}
+	opts.BatchSize = int(config.batchSize)
+	opts.ConversationTimeout = time.Duration(config.conversationTimeoutMs) * time.Millisecond
+	opts.ExpectedDifference = int(config.expectedDifference)
+
+	switch config.verify {
+	case C.LOG_SYNC_VERIFY_NONE:
+	case C.LOG_SYNC_VERIFY_HASH:
+		opts.Verifier = &gdp.HashChainVerifier{HashOnly: true}
+	case C.LOG_SYNC_VERIFY_SIGNATURE:
+		if config.publicKey == nil || config.publicKeyLength == 0 {
+			return "", opts, nil, errNoPublicKey
+		}
+		der := C.GoBytes(config.publicKey, C.int(config.publicKeyLength))
+		key, err := x509.ParsePKIXPublicKey(der)
+		if err != nil {
+			return "", opts, nil, err
+		}
+		ecdsaKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return "", opts, nil, errNotECDSAKey
+		}
+		opts.Verifier = gdp.NewHashChainVerifier(ecdsaKey)
+	default:
+		return "", opts, nil, errBadVerify
+	}
+
+	var msgCodec codec.Codec
+	switch config.codec {
+	case C.LOG_SYNC_CODEC_LEGACY:
+	case C.LOG_SYNC_CODEC_GOB:
+		msgCodec = codec.Gob
+	case C.LOG_SYNC_CODEC_BINARY:
+		msgCodec = codec.Binary
+	default:
+		return "", opts, nil, errBadCodec
+	}
+
+	return policyName, opts, msgCodec, nil
+}
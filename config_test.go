@@ -0,0 +1,64 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/policy"
+)
+
+func TestPolicyConfig(t *testing.T) {
+	handle, code := CreateLogSyncHandleWithConfig(newTestLog(t, "default", 3), nil)
+	assert.Equal(t, 0, int(code))
+	ctx, err := getLogSyncCtx(uint32(handle.handleTicket))
+	assert.Nil(t, err)
+	assert.IsType(t, &policy.ExternalGraphDiffPolicy{}, ctx.Policy)
+	ReleaseLogSyncHandle(handle)
+
+	ticket, err := newLogSyncCtx(newTestLog(t, "naive", 3), "naive", policy.Options{BatchSize: 1}, nil)
+	assert.Nil(t, err)
+	ctx, err = getLogSyncCtx(ticket)
+	assert.Nil(t, err)
+	assert.IsType(t, &policy.NaivePolicy{}, ctx.Policy)
+	releaseLogSyncCtx(ticket)
+
+	_, err = newLogSyncCtx(newTestLog(t, "missing", 3), "missing", policy.Options{}, nil)
+	assert.Equal(t, policy.ErrUnknownPolicy, err)
+
+	// Hosts only get policies that read appends to the log database
+	assert.True(t, handlePolicies[policy.MerklePolicyName])
+	for _, name := range []string{"naive", "graph", "iblt", "missing"} {
+		assert.False(t, handlePolicies[name], name)
+	}
+}
+
+func TestCreateFailures(t *testing.T) {
+	// The log database cannot be opened
+	handle, code := CreateLogSyncHandle(t.TempDir())
+	assert.Equal(t, 3, int(code))
+	assert.NotNil(t, GetLastError(handle))
+
+	// The log database was written by a newer version
+	newer := newTestLog(t, "newer", 1)
+	db, err := sql.Open("sqlite3", newer)
+	assert.Nil(t, err)
+	_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", logserver.SchemaVersion+1))
+	assert.Nil(t, err)
+	db.Close()
+	_, code = CreateLogSyncHandle(newer)
+	assert.Equal(t, 8, int(code))
+
+	// The policy fails to start on the log
+	policy.Register("failing", func(logserver.SnapshotLogServer, policy.Options) (policy.Policy, error) {
+		return nil, errors.New("cannot start")
+	})
+	_, err = newLogSyncCtx(newTestLog(t, "failing", 1), "failing", policy.Options{}, nil)
+	assert.Equal(t, 6, int(createFailure(err)))
+
+	_, err = newLogSyncCtx(newTestLog(t, "unknown", 1), "unknown", policy.Options{}, nil)
+	assert.Equal(t, 7, int(createFailure(err)))
+}
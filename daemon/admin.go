@@ -0,0 +1,309 @@
+package daemon
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/metrics"
+	"github.com/tonyyanga/gdp-replicate/policy"
+	"github.com/tonyyanga/gdp-replicate/scheduler"
+	"go.uber.org/zap"
+)
+
+/*
+The admin API is served over HTTP, see SetAdminAddr. Responses are
+JSON, and GDP addresses are written as 64 hex digits.
+
+	GET  /peers                    known peers, their conversations and last syncs
+	GET  /logs                     hosted logs and their graph
+	POST /sync?peer=<addr>[&log=<addr>]
+	                               start a conversation with a peer now
+	POST /pause                    stop sending heart beats
+	POST /resume                   send heart beats again
+	GET  /metrics                  metrics in the Prometheus text format, see package metrics
+
+The log of /sync defaults to the log without address.
+*/
+
+// peerStatus is a peer in the response of /peers
+type peerStatus struct {
+	Addr   string `json:"addr"`
+	Listen string `json:"listen"`
+	State  string `json:"state"`
+
+	// Time of the last conversation finished, by log
+	LastSync map[string]time.Time `json:"lastSync"`
+
+	Conversations []conversationStatus `json:"conversations"`
+}
+
+// conversationStatus is a conversation in progress with a peer
+type conversationStatus struct {
+	Log        string    `json:"log"`
+	Session    uint64    `json:"session"`
+	LastActive time.Time `json:"lastActive"`
+}
+
+// logStatus is a log in the response of /logs
+type logStatus struct {
+	Name          string   `json:"name"`
+	Policy        string   `json:"policy"`
+	Nodes         int      `json:"nodes"`
+	LogicalBegins []string `json:"logicalBegins"`
+	LogicalEnds   []string `json:"logicalEnds"`
+	Peers         []string `json:"peers"`
+	Paused        bool     `json:"paused"`
+}
+
+// SetAdminAddr makes Start serve the admin API at addr, or not at all
+// if addr is empty. Must be called before Start.
+func (daemon *Daemon) SetAdminAddr(addr string) {
+	daemon.adminAddr = addr
+	if addr == "" {
+		daemon.admin = nil
+		return
+	}
+	daemon.admin = &http.Server{
+		Addr:    addr,
+		Handler: daemon.AdminHandler(),
+	}
+}
+
+// AdminHandler returns the handler of the admin API
+func (daemon *Daemon) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/peers", daemon.handlePeers)
+	mux.HandleFunc("/logs", daemon.handleLogs)
+	mux.HandleFunc("/sync", daemon.handleSync)
+	mux.HandleFunc("/pause", daemon.handlePause)
+	mux.HandleFunc("/resume", daemon.handleResume)
+	mux.Handle("/metrics", metrics.Handler())
+	return mux
+}
+
+func (daemon *Daemon) serveAdmin() {
+	zap.S().Infow(
+		"Serving admin API",
+		"address", daemon.adminAddr,
+	)
+	err := daemon.admin.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		zap.S().Errorw(
+			"Admin API failed",
+			"error", err,
+		)
+	}
+}
+
+// Pause stops sending heart beats until Resume is called. Messages
+// from peers are still answered.
+func (daemon *Daemon) Pause() {
+	daemon.logsMutex.Lock()
+	defer daemon.logsMutex.Unlock()
+
+	daemon.paused = true
+	for _, hosted := range daemon.logs {
+		hosted.scheduler.Stop()
+	}
+}
+
+// Resume sends heart beats again after Pause
+func (daemon *Daemon) Resume() error {
+	daemon.logsMutex.Lock()
+	defer daemon.logsMutex.Unlock()
+
+	if !daemon.paused {
+		return nil
+	}
+	daemon.paused = false
+	if !daemon.running {
+		return nil
+	}
+
+	for _, hosted := range daemon.logs {
+		err := hosted.scheduler.Start(daemon.heartBeatInterval, daemon.fanout, scheduler.FanOut)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncNow starts a conversation about a log with peer without waiting
+// for the next heart beat
+func (daemon *Daemon) SyncNow(name, peer gdp.Hash) error {
+	hosted, ok := daemon.getLog(name)
+	if !ok {
+		return ErrUnknownLog
+	}
+	return hosted.sendHeartBeat(peer)
+}
+
+func (daemon *Daemon) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	statuses := make(map[gdp.Hash]*peerStatus)
+	for _, member := range daemon.members.Members() {
+		statuses[member.Addr] = &peerStatus{
+			Addr:          hashString(member.Addr),
+			Listen:        member.Listen,
+			State:         member.State.String(),
+			LastSync:      make(map[string]time.Time),
+			Conversations: []conversationStatus{},
+		}
+	}
+
+	for _, hosted := range daemon.hostedLogs() {
+		for peer, lastSync := range hosted.lastSyncs() {
+			if status, ok := statuses[peer]; ok {
+				status.LastSync[hashString(hosted.name)] = lastSync
+			}
+		}
+
+		inspector, ok := hosted.policy.(policy.ConversationInspector)
+		if !ok {
+			continue
+		}
+		for _, conversation := range inspector.Conversations() {
+			if status, ok := statuses[conversation.Peer]; ok {
+				status.Conversations = append(status.Conversations, conversationStatus{
+					Log:        hashString(hosted.name),
+					Session:    conversation.Session,
+					LastActive: conversation.LastActive,
+				})
+			}
+		}
+	}
+
+	response := make([]*peerStatus, 0, len(statuses))
+	for _, status := range statuses {
+		response = append(response, status)
+	}
+	writeJSON(w, response)
+}
+
+func (daemon *Daemon) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	daemon.logsMutex.RLock()
+	paused := daemon.paused
+	daemon.logsMutex.RUnlock()
+
+	response := make([]logStatus, 0)
+	for _, hosted := range daemon.hostedLogs() {
+		graph, err := loggraph.NewSimpleGraph(hosted.logServer)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		response = append(response, logStatus{
+			Name:          hashString(hosted.name),
+			Policy:        hosted.policyName,
+			Nodes:         len(graph.GetNodeMap()),
+			LogicalBegins: hashStrings(graph.GetLogicalBegins()),
+			LogicalEnds:   hashStrings(graph.GetLogicalEnds()),
+			Peers:         hashStrings(hosted.scheduler.Peers()),
+			Paused:        paused,
+		})
+	}
+	writeJSON(w, response)
+}
+
+func (daemon *Daemon) handleSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	peer, err := gdp.ParseHash(r.FormValue("peer"))
+	if err != nil {
+		http.Error(w, "peer: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := gdp.NullHash
+	if r.FormValue("log") != "" {
+		name, err = gdp.ParseHash(r.FormValue("log"))
+		if err != nil {
+			http.Error(w, "log: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = daemon.SyncNow(name, peer)
+	if err == ErrUnknownLog {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (daemon *Daemon) handlePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	daemon.Pause()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (daemon *Daemon) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := daemon.Resume()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hostedLogs returns all hosted logs
+func (daemon *Daemon) hostedLogs() []*hostedLog {
+	daemon.logsMutex.RLock()
+	defer daemon.logsMutex.RUnlock()
+
+	logs := make([]*hostedLog, 0, len(daemon.logs))
+	for _, hosted := range daemon.logs {
+		logs = append(logs, hosted)
+	}
+	return logs
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		zap.S().Errorw(
+			"Failed to write admin response",
+			"error", err,
+		)
+	}
+}
+
+func hashString(hash gdp.Hash) string {
+	return hex.EncodeToString(hash[:])
+}
+
+func hashStrings(hashes []gdp.Hash) []string {
+	strings := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		strings = append(strings, hashString(hash))
+	}
+	return strings
+}
@@ -1,29 +1,63 @@
 package daemon
 
 import (
-	"database/sql"
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/tonyyanga/gdp-replicate/gdp"
-	"github.com/tonyyanga/gdp-replicate/loggraph"
-	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/membership"
 	"github.com/tonyyanga/gdp-replicate/peers"
 	"github.com/tonyyanga/gdp-replicate/policy"
+	"github.com/tonyyanga/gdp-replicate/scheduler"
 	"go.uber.org/zap"
 )
 
+// Daemon replicates the logs it hosts with its peers. Each log has its
+// own policy and heart beats, and messages are routed to the policy of
+// the log named in their envelope, see peers.LogMessage.
+//
+// Peers are discovered through gossip, see package membership, starting
+// from the peers the daemon is created with.
 type Daemon struct {
 	httpAddr string
 	myAddr   gdp.Hash
 	network  peers.ReplicationServer
-	policy   policy.Policy
 
-	// Controls the randomness of sending heart beats to peers
-	heartBeatState int
-	peerList       []gdp.Hash
+	// Known peers, and gossip with them
+	members *membership.Membership
+	gossip  *scheduler.Scheduler
+
+	// Time between two rounds of heart beats
+	heartBeatInterval time.Duration
+
+	// Hosted logs by address, guarded by logsMutex
+	logsMutex *sync.RWMutex
+	logs      map[gdp.Hash]*hostedLog
+
+	// Fanout of heart beats once started, guarded by logsMutex
+	running bool
+	fanout  int
+
+	// Heart beats are paused, see Pause. Guarded by logsMutex.
+	paused bool
+
+	// Serves the admin API if adminAddr is set, see SetAdminAddr
+	adminAddr string
+	admin     *http.Server
+
+	// closed by Close
+	done chan struct{}
 }
 
-// NewDaemon initializes Daemon for a log
+// DefaultHeartBeatInterval is the default time between two rounds of
+// heart beats
+const DefaultHeartBeatInterval = 500 * time.Millisecond
+
+// NewDaemon initializes Daemon for a log with the default options of
+// policyType
 func NewDaemon(
 	httpAddr,
 	sqlFile string,
@@ -31,74 +65,252 @@ func NewDaemon(
 	peerAddrMap map[gdp.Hash]string,
 	policyType string,
 ) (*Daemon, error) {
+	return NewDaemonWithOptions(httpAddr, sqlFile, myHashAddr, peerAddrMap, policyType, policy.Options{})
+}
+
+// NewDaemonWithOptions initializes Daemon for a log with the policy
+// registered as policyType, see policy.New. The graph diff policy is
+// used if policyType is empty.
+//
+// The log is hosted without an address, so messages are exchanged
+// like with replicas hosting a single log.
+func NewDaemonWithOptions(
+	httpAddr,
+	sqlFile string,
+	myHashAddr gdp.Hash,
+	peerAddrMap map[gdp.Hash]string,
+	policyType string,
+	opts policy.Options,
+) (*Daemon, error) {
+	daemon := NewMultiLogDaemon(httpAddr, myHashAddr, peerAddrMap)
+	err := daemon.AddLog(LogConfig{
+		Name:    gdp.NullHash,
+		SQLFile: sqlFile,
+		Policy:  policyType,
+		Options: opts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return daemon, nil
+}
+
+// NetworkOptions chooses how a Daemon exchanges messages with peers.
+// The zero value opens a plain TCP connection for every message.
+type NetworkOptions struct {
+	// Mutually authenticated TLS if not nil, see peers.NewTLSConfig
+	TLS *tls.Config
+
+	// Keep one long-lived connection to each peer, see
+	// peers.PooledGobServer
+	Pooled bool
+}
+
+// newServer creates the replication server of a daemon at addr
+func (opts NetworkOptions) newServer(
+	addr gdp.Hash,
+	peerAddrs map[gdp.Hash]string,
+) peers.ReplicationServer {
+	switch {
+	case opts.Pooled && opts.TLS != nil:
+		return peers.NewTLSPooledGobServer(addr, peerAddrs, opts.TLS)
+	case opts.Pooled:
+		return peers.NewPooledGobServer(addr, peerAddrs)
+	case opts.TLS != nil:
+		return peers.NewTLSGobServer(addr, peerAddrs, opts.TLS)
+	default:
+		return peers.NewGobServer(addr, peerAddrs)
+	}
+}
+
+// NewMultiLogDaemon initializes a Daemon hosting no logs, see AddLog
+func NewMultiLogDaemon(
+	httpAddr string,
+	myHashAddr gdp.Hash,
+	peerAddrMap map[gdp.Hash]string,
+) *Daemon {
+	return NewMultiLogDaemonWithNetwork(httpAddr, myHashAddr, peerAddrMap, NetworkOptions{})
+}
+
+// NewMultiLogDaemonWithNetwork initializes a Daemon hosting no logs
+// that exchanges messages with peers as chosen by network
+func NewMultiLogDaemonWithNetwork(
+	httpAddr string,
+	myHashAddr gdp.Hash,
+	peerAddrMap map[gdp.Hash]string,
+	network NetworkOptions,
+) *Daemon {
 	zap.S().Infow(
-		"Initializing new naive daemon",
+		"Initializing new daemon",
 		"httpAddr", httpAddr,
-		"sqlFile", sqlFile,
 		"gdpAddr", myHashAddr.Readable(),
 		"numPeers", len(peerAddrMap),
+		"tls", network.TLS != nil,
+		"pooled", network.Pooled,
 	)
-	db, err := sql.Open("sqlite3", sqlFile)
+
+	daemon := &Daemon{
+		httpAddr: httpAddr,
+		myAddr:   myHashAddr,
+		network:  network.newServer(myHashAddr, peerAddrMap),
+		members:  membership.New(myHashAddr, httpAddr),
+
+		heartBeatInterval: DefaultHeartBeatInterval,
+		logsMutex:         &sync.RWMutex{},
+		logs:              make(map[gdp.Hash]*hostedLog),
+		done:              make(chan struct{}),
+	}
+	daemon.gossip = scheduler.NewScheduler(daemon.sendGossip)
+	daemon.members.OnChange(daemon.memberChanged)
+	daemon.members.Join(peerAddrMap)
+
+	return daemon
+}
+
+// SetHeartBeatInterval sets the time between two rounds of heart
+// beats, which is also the time between two rounds of gossip. Must be
+// called before Start.
+func (daemon *Daemon) SetHeartBeatInterval(interval time.Duration) {
+	daemon.heartBeatInterval = interval
+}
+
+// SetFailTimeout sets the time after which a peer that stopped
+// gossiping is considered failed, see membership.DefaultFailTimeout
+func (daemon *Daemon) SetFailTimeout(timeout time.Duration) {
+	daemon.members.SetFailTimeout(timeout)
+}
+
+// Start begins listening for and sending heartbeats. Blocks until
+// Close is called, which makes Start return nil.
+func (daemon *Daemon) Start(fanoutDegree int) error {
+	zap.S().Info("starting daemon")
+
+	err := daemon.gossip.Start(daemon.heartBeatInterval, fanoutDegree, scheduler.FanOut)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	daemon.logsMutex.Lock()
+	daemon.running = true
+	daemon.fanout = fanoutDegree
+	for _, hosted := range daemon.logs {
+		err := daemon.startLog(hosted)
+		if err != nil {
+			daemon.logsMutex.Unlock()
+			daemon.stopLogs()
+			return err
+		}
+	}
+	daemon.logsMutex.Unlock()
+
+	if daemon.adminAddr != "" {
+		go daemon.serveAdmin()
+	}
+
+	err = daemon.network.ListenAndServe(daemon.httpAddr, daemon.handleMsg)
+	daemon.stopLogs()
+	if err == peers.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// handleMsg passes a message from src to the policy of its log
+func (daemon *Daemon) handleMsg(src gdp.Hash, msg interface{}) {
+	if gossip, ok := msg.(*membership.Gossip); ok {
+		daemon.members.Merge(gossip)
+		return
+	}
+
+	name := gdp.NullHash
+	if logMsg, ok := msg.(*peers.LogMessage); ok {
+		name, msg = logMsg.Log, logMsg.Content
 	}
 
-	logServer := logserver.NewSqliteServer(db)
-	logGraph, err := loggraph.NewSimpleGraph(logServer)
+	hosted, ok := daemon.getLog(name)
+	if !ok {
+		zap.S().Warnw(
+			"dropping msg for unknown log",
+			"src", src.Readable(),
+			"log", name.Readable(),
+		)
+		return
+	}
+
+	returnMsg, err := hosted.policy.ProcessMessage(src, msg)
+	if err == policy.ErrConversationFinished {
+		hosted.synced(src)
+		zap.S().Infow(
+			"heartbeat finished",
+			"log", name.Readable(),
+		)
+		return
+	}
 	if err != nil {
-		return nil, err
+		zap.S().Errorw(
+			"failed to process msg",
+			"log", name.Readable(),
+			"msg", msg,
+			"error", err,
+		)
+		return
+	}
+
+	// The last message of a conversation is sent once no conversation
+	// with src remains
+	if !hosted.inConversation(src) {
+		hosted.synced(src)
 	}
-	var chosenPolicy policy.Policy
-	switch policyType {
-	case "naive":
-		chosenPolicy = policy.NewNaivePolicy(logGraph)
+
+	// Daemon will always send content over the network,
+	// even if returnMsg is nil
+	hosted.send(src, returnMsg)
+}
+
+// Close stops sending heartbeats and listening for messages, making
+// Start return. Heart beats in progress complete first. Peers are told
+// that the daemon leaves.
+func (daemon *Daemon) Close() error {
+	zap.S().Info("stopping daemon")
+	select {
+	case <-daemon.done:
+		return nil
 	default:
-		chosenPolicy = policy.NewGraphDiffPolicy(logGraph)
+		close(daemon.done)
 	}
 
-	// Create list of peers
-	peerList := make([]gdp.Hash, 0)
-	for peer := range peerAddrMap {
-		peerList = append(peerList, peer)
+	daemon.stopLogs()
+	if daemon.admin != nil {
+		daemon.admin.Close()
 	}
 
-	return &Daemon{
-		httpAddr:       httpAddr,
-		myAddr:         myHashAddr,
-		network:        peers.NewGobServer(myHashAddr, peerAddrMap),
-		policy:         chosenPolicy,
-		heartBeatState: 0,
-		peerList:       peerList,
-	}, nil
+	daemon.members.Leave()
+	gossip := daemon.members.Gossip()
+	for _, peer := range daemon.members.Alive() {
+		daemon.network.Send(peer, gossip)
+	}
+
+	return daemon.network.Close()
 }
 
-// Start begins listening for and sending heartbeats.
-func (daemon Daemon) Start(fanoutDegree int) error {
-	zap.S().Info("starting daemon")
-	go daemon.scheduleHeartBeat(500, daemon.fanOutHeartBeat(fanoutDegree))
-
-	handler := func(src gdp.Hash, msg interface{}) {
-		returnMsg, err := daemon.policy.ProcessMessage(src, msg)
-		if err == policy.ErrConversationFinished {
-			zap.S().Infow(
-				"heartbeat finished",
-			)
-			return
-		}
-		if err != nil {
-			zap.S().Errorw(
-				"failed to process msg",
-				"msg", msg,
-				"error", err,
-			)
-			return
-		}
+// stopLogs stops the heart beats of all logs and gossip
+func (daemon *Daemon) stopLogs() {
+	daemon.gossip.Stop()
 
-		// Daemon will always send content over the network,
-		// even if returnMsg is nil
-		daemon.network.Send(src, returnMsg)
+	daemon.logsMutex.Lock()
+	defer daemon.logsMutex.Unlock()
+
+	daemon.running = false
+	for _, hosted := range daemon.logs {
+		hosted.stop()
 	}
+}
 
-	err := daemon.network.ListenAndServe(daemon.httpAddr, handler)
-	return err
+// logAbortedConversation is an abort handler that logs the conversation
+func logAbortedConversation(peer gdp.Hash, err error) {
+	zap.S().Warnw(
+		"conversation aborted",
+		"peer", peer.Readable(),
+		"error", err,
+	)
 }
@@ -2,14 +2,21 @@ package daemon
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
 	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/peers"
+	"github.com/tonyyanga/gdp-replicate/policy"
 	"go.uber.org/zap"
 )
 
@@ -85,7 +92,11 @@ func TestDaemon(t *testing.T) {
 	for _, name := range dbNames {
 		db, err := sql.Open("sqlite3", fmt.Sprintf(dbDir, name))
 		assert.Nil(t, err)
-		logServers = append(logServers, logserver.NewSqliteServer(db))
+		logServer, err := logserver.NewSqliteServer(db)
+		if !assert.Nil(t, err) {
+			return
+		}
+		logServers = append(logServers, logServer)
 	}
 
 	allRecords, err := logServers[0].ReadAllRecords()
@@ -98,3 +109,271 @@ func TestDaemon(t *testing.T) {
 		assert.Equal(t, numRecords, len(records))
 	}
 }
+
+// newTestLog creates a log database in a temporary directory holding
+// the first n records of a chain
+func newTestLog(t *testing.T, name string, n int) string {
+	dbFile := filepath.Join(t.TempDir(), name+".db")
+	db, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err)
+	defer db.Close()
+	server, err := logserver.NewSqliteServer(db)
+	assert.Nil(t, err)
+
+	_, err = server.WriteRecords(gdptest.Chain(name, n))
+	assert.Nil(t, err)
+	return dbFile
+}
+
+func countRecords(t *testing.T, dbFile string) int {
+	db, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	server, err := logserver.NewSqliteServer(db)
+	assert.Nil(t, err)
+	records, err := server.ReadAllMetadata()
+	assert.Nil(t, err)
+	return len(records)
+}
+
+func TestDaemonClose(t *testing.T) {
+	dbFile := newTestLog(t, "log", 0)
+
+	peer := gdp.GenerateHash("peer")
+	daemon, err := NewDaemonWithOptions(
+		"localhost:8010",
+		dbFile,
+		gdp.GenerateHash("self"),
+		map[gdp.Hash]string{peer: "localhost:8011"},
+		"naive",
+		policy.Options{ConversationTimeout: time.Second},
+	)
+	assert.Nil(t, err)
+	daemon.SetHeartBeatInterval(10 * time.Millisecond)
+
+	started := make(chan error)
+	go func() {
+		started <- daemon.Start(1)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Nil(t, daemon.Close())
+	select {
+	case err := <-started:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after Close")
+	}
+
+	// Closing again is harmless
+	assert.Nil(t, daemon.Close())
+
+	_, err = NewDaemon("localhost:8010", dbFile, gdp.NullHash, nil, "missing")
+	assert.Equal(t, policy.ErrUnknownPolicy, err)
+}
+
+func TestMultiLogDaemon(t *testing.T) {
+	addrs := []string{"localhost:8012", "localhost:8013"}
+	hashes := []gdp.Hash{gdp.GenerateHash(addrs[0]), gdp.GenerateHash(addrs[1])}
+	logs := []gdp.Hash{gdp.GenerateHash("first"), gdp.GenerateHash("second")}
+
+	// Each daemon holds a different part of each log
+	files := [][]string{
+		{newTestLog(t, "first", 10), newTestLog(t, "second", 2)},
+		{newTestLog(t, "first", 3), newTestLog(t, "second", 8)},
+	}
+
+	daemons := make([]*Daemon, 0, 2)
+	for i := range addrs {
+		peer := 1 - i
+		daemon := NewMultiLogDaemon(addrs[i], hashes[i], map[gdp.Hash]string{hashes[peer]: addrs[peer]})
+		daemon.SetHeartBeatInterval(20 * time.Millisecond)
+		assert.Nil(t, daemon.AddLog(LogConfig{Name: logs[0], SQLFile: files[i][0], Policy: "naive"}))
+		assert.Equal(t, ErrLogExists, daemon.AddLog(LogConfig{Name: logs[0], SQLFile: files[i][0]}))
+		daemons = append(daemons, daemon)
+		go daemon.Start(1)
+		defer daemon.Close()
+	}
+
+	// Logs added at runtime start right away
+	time.Sleep(50 * time.Millisecond)
+	for i, daemon := range daemons {
+		assert.Nil(t, daemon.AddLog(LogConfig{Name: logs[1], SQLFile: files[i][1], Policy: "graph"}))
+		assert.Len(t, daemon.Logs(), 2)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if countRecords(t, files[1][0]) == 10 && countRecords(t, files[0][1]) == 8 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, 10, countRecords(t, files[1][0]))
+	assert.Equal(t, 8, countRecords(t, files[0][1]))
+
+	// Records of one log never leak into another
+	assert.Equal(t, 10, countRecords(t, files[0][0]))
+	assert.Equal(t, 8, countRecords(t, files[1][1]))
+
+	assert.Nil(t, daemons[0].RemoveLog(logs[1]))
+	assert.Equal(t, ErrUnknownLog, daemons[0].RemoveLog(logs[1]))
+	assert.Equal(t, []gdp.Hash{logs[0]}, daemons[0].Logs())
+}
+
+func TestDaemonMembership(t *testing.T) {
+	addrs := []string{"localhost:8014", "localhost:8015", "localhost:8016"}
+	hashes := make([]gdp.Hash, 0, len(addrs))
+	for _, addr := range addrs {
+		hashes = append(hashes, gdp.GenerateHash(addr))
+	}
+
+	// Only the second daemon is known to the others, and only the
+	// third holds records
+	files := []string{newTestLog(t, "a", 0), newTestLog(t, "b", 0), newTestLog(t, "c", 8)}
+	daemons := make([]*Daemon, 0, len(addrs))
+	for i := range addrs {
+		seeds := map[gdp.Hash]string{}
+		if i != 1 {
+			seeds[hashes[1]] = addrs[1]
+		}
+		daemon := NewMultiLogDaemon(addrs[i], hashes[i], seeds)
+		daemon.SetHeartBeatInterval(10 * time.Millisecond)
+		assert.Nil(t, daemon.AddLog(LogConfig{Name: gdp.NullHash, SQLFile: files[i], Policy: "naive"}))
+		daemons = append(daemons, daemon)
+		go daemon.Start(2)
+	}
+	defer daemons[0].Close()
+	defer daemons[1].Close()
+
+	knows := func(daemon *Daemon, peer gdp.Hash) bool {
+		for _, alive := range daemon.members.Alive() {
+			if alive == peer {
+				return true
+			}
+		}
+		return false
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !(knows(daemons[0], hashes[2]) && knows(daemons[2], hashes[0])) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, knows(daemons[0], hashes[2]))
+	assert.True(t, knows(daemons[2], hashes[0]))
+
+	// Discovered peers take part in replication
+	hosted, ok := daemons[0].getLog(gdp.NullHash)
+	assert.True(t, ok)
+	assert.Contains(t, hosted.scheduler.Peers(), hashes[2])
+	for countRecords(t, files[0]) < 8 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 8, countRecords(t, files[0]))
+
+	// A daemon that leaves is removed from the others
+	assert.Nil(t, daemons[2].Close())
+	deadline = time.Now().Add(5 * time.Second)
+	for knows(daemons[0], hashes[2]) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, knows(daemons[0], hashes[2]))
+	assert.True(t, knows(daemons[0], hashes[1]))
+}
+
+func TestAdminAPI(t *testing.T) {
+	addrs := []string{"localhost:8017", "localhost:8018"}
+	hashes := []gdp.Hash{gdp.GenerateHash(addrs[0]), gdp.GenerateHash(addrs[1])}
+	files := []string{newTestLog(t, "log", 5), newTestLog(t, "log", 2)}
+
+	daemons := make([]*Daemon, 0, 2)
+	for i := range addrs {
+		peer := 1 - i
+		daemon, err := NewDaemon(addrs[i], files[i], hashes[i], map[gdp.Hash]string{hashes[peer]: addrs[peer]}, "naive")
+		assert.Nil(t, err)
+		daemon.SetHeartBeatInterval(time.Hour)
+		daemons = append(daemons, daemon)
+		go daemon.Start(1)
+		defer daemon.Close()
+	}
+	admin := daemons[1].AdminHandler()
+
+	request := func(method, url string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, httptest.NewRequest(method, url, nil))
+		return recorder
+	}
+
+	var logs []logStatus
+	response := request("GET", "/logs")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Nil(t, json.NewDecoder(response.Body).Decode(&logs))
+	assert.Len(t, logs, 1)
+	assert.Equal(t, "naive", logs[0].Policy)
+	assert.Equal(t, 2, logs[0].Nodes)
+	assert.Len(t, logs[0].LogicalEnds, 1)
+	assert.Equal(t, []string{hashString(hashes[0])}, logs[0].Peers)
+
+	assert.Equal(t, http.StatusNoContent, request("POST", "/pause").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, request("GET", "/pause").Code)
+	assert.Equal(t, http.StatusBadRequest, request("POST", "/sync?peer=abcd").Code)
+	assert.Equal(t, http.StatusNotFound, request("POST", "/sync?peer="+hashString(hashes[0])+"&log="+hashString(hashes[0])).Code)
+
+	// Wait for the listener of the peer, then sync right away
+	deadline := time.Now().Add(5 * time.Second)
+	for request("POST", "/sync?peer="+hashString(hashes[0])).Code != http.StatusNoContent && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	var peers []peerStatus
+	for time.Now().Before(deadline) {
+		response = request("GET", "/peers")
+		assert.Equal(t, http.StatusOK, response.Code)
+		assert.Nil(t, json.NewDecoder(response.Body).Decode(&peers))
+		if len(peers) == 1 && len(peers[0].LastSync) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 5, countRecords(t, files[1]))
+
+	assert.Len(t, peers, 1)
+	assert.Equal(t, hashString(hashes[0]), peers[0].Addr)
+	assert.Equal(t, "alive", peers[0].State)
+	assert.Contains(t, peers[0].LastSync, hashString(gdp.NullHash))
+
+	response = request("GET", "/metrics")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), "gdp_replicate_conversations_finished_total")
+	assert.Contains(t, response.Body.String(), "gdp_replicate_bytes_sent_total")
+
+	assert.Equal(t, http.StatusNoContent, request("POST", "/resume").Code)
+}
+
+func TestPooledDaemon(t *testing.T) {
+	addrs := []string{"localhost:8019", "localhost:8020"}
+	hashes := []gdp.Hash{gdp.GenerateHash(addrs[0]), gdp.GenerateHash(addrs[1])}
+	files := []string{newTestLog(t, "log", 10), newTestLog(t, "log", 3)}
+
+	for i := range addrs {
+		peer := 1 - i
+		daemon := NewMultiLogDaemonWithNetwork(
+			addrs[i],
+			hashes[i],
+			map[gdp.Hash]string{hashes[peer]: addrs[peer]},
+			NetworkOptions{Pooled: true},
+		)
+		_, ok := daemon.network.(*peers.PooledGobServer)
+		assert.True(t, ok)
+		daemon.SetHeartBeatInterval(10 * time.Millisecond)
+		assert.Nil(t, daemon.AddLog(LogConfig{Name: gdp.NullHash, SQLFile: files[i], Policy: "graph"}))
+		go daemon.Start(1)
+		defer daemon.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for countRecords(t, files[1]) < 10 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, 10, countRecords(t, files[1]))
+}
@@ -0,0 +1,42 @@
+package daemon
+
+import (
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/membership"
+)
+
+// Sends what the daemon knows of its peers to PEER
+func (daemon *Daemon) sendGossip(peer gdp.Hash) error {
+	daemon.members.Expire()
+	return daemon.network.Send(peer, daemon.members.Gossip())
+}
+
+// memberChanged updates the address book and the peers heart beats
+// are sent to after a change of member
+func (daemon *Daemon) memberChanged(member membership.Member) {
+	if member.State == membership.Left {
+		daemon.network.RemovePeer(member.Addr)
+	} else {
+		daemon.network.SetPeerAddr(member.Addr, member.Listen)
+	}
+
+	alive := daemon.members.Alive()
+
+	// Failed peers still receive gossip, so they are found again once
+	// they recover
+	gossipPeers := make([]gdp.Hash, 0)
+	for _, peer := range daemon.members.Members() {
+		if peer.State != membership.Left {
+			gossipPeers = append(gossipPeers, peer.Addr)
+		}
+	}
+	daemon.gossip.SetPeers(gossipPeers)
+
+	daemon.logsMutex.RLock()
+	defer daemon.logsMutex.RUnlock()
+	for _, hosted := range daemon.logs {
+		if hosted.allPeers {
+			hosted.scheduler.SetPeers(alive)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package daemon
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/peers"
+	"github.com/tonyyanga/gdp-replicate/policy"
+	"github.com/tonyyanga/gdp-replicate/scheduler"
+	"go.uber.org/zap"
+)
+
+var (
+	ErrLogExists  = errors.New("log is already hosted")
+	ErrUnknownLog = errors.New("log is not hosted")
+)
+
+// LogConfig describes a log hosted by a Daemon
+type LogConfig struct {
+	// Address of the log, which names the log in messages.
+	// gdp.NullHash for a log exchanged like with single log replicas.
+	Name gdp.Hash
+
+	// Path to the SQLite database of the log
+	SQLFile string
+
+	// Name of the policy, see policy.New. Defaults to the graph diff
+	// policy.
+	Policy  string
+	Options policy.Options
+
+	// Peers replicating the log, all alive peers of the daemon if nil
+	Peers []gdp.Hash
+}
+
+// hostedLog is the state of a log hosted by a Daemon
+type hostedLog struct {
+	name       gdp.Hash
+	db         *sql.DB
+	logServer  logserver.LogServer
+	policyName string
+	policy     policy.Policy
+	network    peers.ReplicationServer
+
+	// Sends heart beats to peers, all alive peers of the daemon if
+	// allPeers is set
+	scheduler *scheduler.Scheduler
+	allPeers  bool
+
+	// Time between checks for idle conversations
+	reapInterval time.Duration
+
+	// Stops checking for idle conversations, nil if not started
+	done chan struct{}
+
+	// Time of the last conversation finished with each peer
+	syncMutex sync.Mutex
+	lastSync  map[gdp.Hash]time.Time
+}
+
+// AddLog starts hosting a log. Heart beats of the log start right
+// away if the daemon is started.
+func (daemon *Daemon) AddLog(config LogConfig) error {
+	zap.S().Infow(
+		"Adding log",
+		"log", config.Name.Readable(),
+		"sqlFile", config.SQLFile,
+		"policy", config.Policy,
+	)
+
+	daemon.logsMutex.Lock()
+	defer daemon.logsMutex.Unlock()
+	if _, ok := daemon.logs[config.Name]; ok {
+		return ErrLogExists
+	}
+
+	hosted, err := newHostedLog(config, daemon.network)
+	if err != nil {
+		return err
+	}
+
+	if config.Peers == nil {
+		hosted.allPeers = true
+		hosted.scheduler.SetPeers(daemon.members.Alive())
+	} else {
+		hosted.scheduler.SetPeers(config.Peers)
+	}
+
+	if daemon.running {
+		err = daemon.startLog(hosted)
+		if err != nil {
+			hosted.db.Close()
+			return err
+		}
+	}
+
+	daemon.logs[config.Name] = hosted
+	return nil
+}
+
+// RemoveLog stops hosting a log, after the heart beats of the log in
+// progress complete. Conversations of the log in progress are aborted.
+func (daemon *Daemon) RemoveLog(name gdp.Hash) error {
+	daemon.logsMutex.Lock()
+	hosted, ok := daemon.logs[name]
+	delete(daemon.logs, name)
+	daemon.logsMutex.Unlock()
+
+	if !ok {
+		return ErrUnknownLog
+	}
+
+	zap.S().Infow(
+		"Removing log",
+		"log", name.Readable(),
+	)
+	hosted.stop()
+
+	// conversations hold snapshots, which are transactions of the db
+	if reaper, ok := hosted.policy.(policy.ConversationReaper); ok {
+		reaper.AbortConversations()
+	}
+	return hosted.db.Close()
+}
+
+// Logs returns the addresses of the hosted logs
+func (daemon *Daemon) Logs() []gdp.Hash {
+	daemon.logsMutex.RLock()
+	defer daemon.logsMutex.RUnlock()
+
+	names := make([]gdp.Hash, 0, len(daemon.logs))
+	for name := range daemon.logs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// startLog starts the heart beats of a log, unless paused
+// Assumes logsMutex is held by caller
+func (daemon *Daemon) startLog(hosted *hostedLog) error {
+	err := hosted.start(daemon.heartBeatInterval, daemon.fanout)
+	if err != nil {
+		return err
+	}
+	if daemon.paused {
+		hosted.scheduler.Stop()
+	}
+	return nil
+}
+
+func (daemon *Daemon) getLog(name gdp.Hash) (*hostedLog, bool) {
+	daemon.logsMutex.RLock()
+	defer daemon.logsMutex.RUnlock()
+
+	hosted, ok := daemon.logs[name]
+	return hosted, ok
+}
+
+func newHostedLog(config LogConfig, network peers.ReplicationServer) (*hostedLog, error) {
+	db, err := sql.Open("sqlite3", config.SQLFile)
+	if err != nil {
+		return nil, err
+	}
+
+	policyType := config.Policy
+	if policyType == "" {
+		policyType = policy.GraphDiffPolicyName
+	}
+	logServer, err := logserver.NewSqliteServer(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	chosenPolicy, err := policy.New(policyType, logServer, config.Options)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	hosted := &hostedLog{
+		name:         config.Name,
+		db:           db,
+		logServer:    logServer,
+		policyName:   policyType,
+		policy:       chosenPolicy,
+		network:      network,
+		reapInterval: policy.ReapInterval(config.Options.ConversationTimeout),
+		lastSync:     make(map[gdp.Hash]time.Time),
+	}
+	hosted.scheduler = scheduler.NewScheduler(hosted.sendHeartBeat)
+	return hosted, nil
+}
+
+// start begins sending heart beats and aborting idle conversations
+func (hosted *hostedLog) start(interval time.Duration, fanout int) error {
+	err := hosted.scheduler.Start(interval, fanout, scheduler.FanOut)
+	if err != nil {
+		return err
+	}
+
+	if reaper, ok := hosted.policy.(policy.ConversationReaper); ok && hosted.done == nil {
+		hosted.done = make(chan struct{})
+		reaper.SetAbortHandler(logAbortedConversation)
+		go policy.ReapConversations(reaper, hosted.reapInterval, hosted.done)
+	}
+	return nil
+}
+
+// stop undoes start, waiting for the heart beat in progress
+func (hosted *hostedLog) stop() {
+	hosted.scheduler.Stop()
+	if hosted.done != nil {
+		close(hosted.done)
+		hosted.done = nil
+	}
+}
+
+// synced records a conversation finished with peer
+func (hosted *hostedLog) synced(peer gdp.Hash) {
+	hosted.syncMutex.Lock()
+	defer hosted.syncMutex.Unlock()
+	hosted.lastSync[peer] = time.Now()
+}
+
+// inConversation checks if a conversation with peer is in progress.
+// Always true if the policy does not report its conversations.
+func (hosted *hostedLog) inConversation(peer gdp.Hash) bool {
+	inspector, ok := hosted.policy.(policy.ConversationInspector)
+	if !ok {
+		return true
+	}
+	for _, conversation := range inspector.Conversations() {
+		if conversation.Peer == peer {
+			return true
+		}
+	}
+	return false
+}
+
+// lastSyncs returns the time of the last conversation finished with
+// each peer
+func (hosted *hostedLog) lastSyncs() map[gdp.Hash]time.Time {
+	hosted.syncMutex.Lock()
+	defer hosted.syncMutex.Unlock()
+
+	lastSync := make(map[gdp.Hash]time.Time, len(hosted.lastSync))
+	for peer, t := range hosted.lastSync {
+		lastSync[peer] = t
+	}
+	return lastSync
+}
+
+// send sends a message of the log to peer
+func (hosted *hostedLog) send(peer gdp.Hash, msg interface{}) error {
+	if hosted.name == gdp.NullHash {
+		return hosted.network.Send(peer, msg)
+	}
+	return hosted.network.Send(peer, &peers.LogMessage{
+		Log:     hosted.name,
+		Content: msg,
+	})
+}
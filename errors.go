@@ -0,0 +1,98 @@
+package main
+
+/* This file keeps the errors reported through the C API */
+
+// #include <stdlib.h>
+// #include "gdp_types.h"
+import "C"
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/policy"
+	"go.uber.org/zap"
+)
+
+// Last error of each handle, failures without a valid handle are kept
+// under nullTicket
+var (
+	lastErrorsMutex = &sync.Mutex{}
+	lastErrors      = make(map[HandleTicket]error)
+)
+
+// fail records err as the last error of the handle with ticket and
+// returns code
+func fail(ticket HandleTicket, code C.int, err error) C.int {
+	if _, err := getLogSyncCtx(ticket); err != nil {
+		ticket = nullTicket
+	}
+
+	zap.S().Errorw(
+		"Log sync call failed",
+		"ticket", ticket,
+		"code", int(code),
+		"error", err,
+	)
+
+	lastErrorsMutex.Lock()
+	defer lastErrorsMutex.Unlock()
+	lastErrors[ticket] = err
+	return code
+}
+
+// createFailure returns the code of a failure of newLogSyncCtx
+func createFailure(err error) C.int {
+	if _, ok := err.(*policyError); ok {
+		return C.LOG_SYNC_ERR_POLICY
+	}
+
+	switch err {
+	case policy.ErrUnknownPolicy:
+		return C.LOG_SYNC_ERR_INVALID_ARGUMENT
+	case logserver.ErrSchemaTooNew:
+		return C.LOG_SYNC_ERR_SCHEMA
+	default:
+		return C.LOG_SYNC_ERR_DATABASE
+	}
+}
+
+// clearLastError drops the last error of a released handle
+func clearLastError(ticket HandleTicket) {
+	lastErrorsMutex.Lock()
+	defer lastErrorsMutex.Unlock()
+	delete(lastErrors, ticket)
+}
+
+// recoverPanic turns a panic in an exported function into
+// LOG_SYNC_ERR_INTERNAL. Must be deferred by the exported function.
+func recoverPanic(ticket HandleTicket, code *C.int) {
+	if r := recover(); r != nil {
+		*code = fail(ticket, C.LOG_SYNC_ERR_INTERNAL, fmt.Errorf("panic: %v", r))
+	}
+}
+
+/* GetLastError describes the last failure of a call with handle.
+   Failures of calls with an unknown handle, including
+   CreateLogSyncHandle, are described by GetLastError of the handle
+   returned by CreateLogSyncHandle on failure.
+
+   Returns NULL if no call with handle failed.
+
+   Memory convention:
+   The returned string should be freed by the caller.
+*/
+//export GetLastError
+func GetLastError(handle C.LogSyncHandle) *C.char {
+	ticket := uint32(handle.handleTicket)
+
+	lastErrorsMutex.Lock()
+	defer lastErrorsMutex.Unlock()
+
+	err, ok := lastErrors[ticket]
+	if !ok {
+		return nil
+	}
+	return C.CString(err.Error())
+}
@@ -2,7 +2,9 @@ package gdp
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 )
 
@@ -22,6 +24,22 @@ func GenerateHash(seed string) Hash {
 	return sha256.Sum256([]byte(seed))
 }
 
+var errBadHashLength = errors.New("hash must be 64 hex digits")
+
+// ParseHash parses a hash written as 64 hex digits
+func ParseHash(s string) (Hash, error) {
+	var hash Hash
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return hash, err
+	}
+	if len(decoded) != len(hash) {
+		return hash, errBadHashLength
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
 // InitSet converts a HashAddr slice to a set
 func InitSet(hashes []Hash) map[Hash]bool {
 	set := make(map[Hash]bool)
@@ -1,6 +1,7 @@
 package gdp
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -27,3 +28,15 @@ func TestRecordSerialization(t *testing.T) {
 	assert.Equal(t, record.RecNo, newRecord.RecNo)
 	assert.Equal(t, record.Timestamp, newRecord.Timestamp)
 }
+
+func TestParseHash(t *testing.T) {
+	hash := GenerateHash("some identifier")
+	parsed, err := ParseHash(fmt.Sprintf("%x", hash))
+	assert.Nil(t, err)
+	assert.Equal(t, hash, parsed)
+
+	_, err = ParseHash("abcd")
+	assert.NotNil(t, err)
+	_, err = ParseHash("not hex")
+	assert.NotNil(t, err)
+}
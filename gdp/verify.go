@@ -0,0 +1,129 @@
+package gdp
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	ErrHashMismatch  = errors.New("record hash does not match its contents")
+	ErrMissingSig    = errors.New("record is not signed")
+	ErrBadSignature  = errors.New("record signature verification failed")
+	ErrNilPublicKey  = errors.New("no public key to verify signature")
+	errNotVerifiable = errors.New("record cannot be verified")
+)
+
+// A RecordVerifier checks records received from a peer before they
+// are persisted. Implementations return a non-nil error if the record
+// should be rejected.
+type RecordVerifier interface {
+	VerifyRecord(record *Record) error
+}
+
+// A RecordHasher computes the hash of a record from its contents. The
+// layout of the hash is chosen by the writers of a log, so verifiers
+// must use the hasher of the writers.
+type RecordHasher func(record *Record) Hash
+
+// ChainHash is the RecordHasher of records written with SignRecord:
+//
+//	SHA-256(RecNo || Timestamp || Accuracy || PrevHash || SHA-256(Value))
+//
+// where RecNo and Timestamp are 64 bit big endian integers and Accuracy
+// is a big endian IEEE 754 double. Records are chained through
+// PrevHash. This is not the layout of the hashes of gdplogd, logs
+// written by gdplogd need a verifier with their own Hasher.
+func ChainHash(record *Record) Hash {
+	var buf [8]byte
+	h := sha256.New()
+
+	binary.BigEndian.PutUint64(buf[:], uint64(record.RecNo))
+	h.Write(buf[:])
+	binary.BigEndian.PutUint64(buf[:], uint64(record.Timestamp))
+	h.Write(buf[:])
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(record.Accuracy))
+	h.Write(buf[:])
+	h.Write(record.PrevHash[:])
+
+	valueHash := sha256.Sum256(record.Value)
+	h.Write(valueHash[:])
+
+	var hash Hash
+	copy(hash[:], h.Sum(nil))
+	return hash
+}
+
+// ComputeHash recomputes the hash of a record from its contents with
+// ChainHash
+func (record *Record) ComputeHash() Hash {
+	return ChainHash(record)
+}
+
+// HashChainVerifier verifies that a record's Hash matches its contents
+// and PrevHash, and that Sig is an ASN.1 ECDSA signature of Hash made
+// with the log's key.
+type HashChainVerifier struct {
+	PublicKey *ecdsa.PublicKey
+
+	// Computes the hash of records, ChainHash if nil
+	Hasher RecordHasher
+
+	// Skip the signature check, only verify hashes
+	HashOnly bool
+}
+
+// NewHashChainVerifier creates a verifier for a log with publicKey
+func NewHashChainVerifier(publicKey *ecdsa.PublicKey) *HashChainVerifier {
+	return &HashChainVerifier{
+		PublicKey: publicKey,
+	}
+}
+
+func (verifier *HashChainVerifier) VerifyRecord(record *Record) error {
+	if record == nil {
+		return errNotVerifiable
+	}
+
+	hasher := verifier.Hasher
+	if hasher == nil {
+		hasher = ChainHash
+	}
+	if hasher(record) != record.Hash {
+		return ErrHashMismatch
+	}
+
+	if verifier.HashOnly {
+		return nil
+	}
+
+	if verifier.PublicKey == nil {
+		return ErrNilPublicKey
+	}
+
+	if len(record.Sig) == 0 {
+		return ErrMissingSig
+	}
+
+	if !ecdsa.VerifyASN1(verifier.PublicKey, record.Hash[:], record.Sig) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
+
+// SignRecord sets the Hash of record from its contents and signs it
+// with key. Used by writers of a log.
+func SignRecord(record *Record, key *ecdsa.PrivateKey) error {
+	record.Hash = record.ComputeHash()
+
+	sig, err := ecdsa.SignASN1(rand.Reader, key, record.Hash[:])
+	if err != nil {
+		return err
+	}
+	record.Sig = sig
+	return nil
+}
@@ -23,9 +23,65 @@ typedef struct {
     void* data;
 } Msg;
 
+/* LogSyncError lists the return codes of the exported functions.
+ * Call GetLastError for a description of the last failure of a handle. */
+typedef enum {
+    LOG_SYNC_NO_MSG = -1,              // success, no message to send
+    LOG_SYNC_OK = 0,                   // success
+    LOG_SYNC_ERR_INTERNAL = 1,         // unexpected failure in the library
+    LOG_SYNC_ERR_INVALID_HANDLE = 2,   // handle unknown or released
+    LOG_SYNC_ERR_DATABASE = 3,         // log database could not be opened
+    LOG_SYNC_ERR_DECODE = 4,           // malformed incoming message
+    LOG_SYNC_ERR_ENCODE = 5,           // outgoing message could not be encoded
+    LOG_SYNC_ERR_POLICY = 6,           // sync policy failed, see GetLastError
+    LOG_SYNC_ERR_INVALID_ARGUMENT = 7, // argument out of range or missing
+    LOG_SYNC_ERR_SCHEMA = 8,           // log database written by a newer version
+} LogSyncError;
+
+/* SyncStrategy chooses the peers of each round of StartAutoSync */
+typedef enum {
+    LOG_SYNC_FANOUT = 0,               // fanout distinct peers at random
+    LOG_SYNC_CYCLE = 1,                // the next fanout peers in turn
+    LOG_SYNC_RANDOM = 2,               // fanout peers at random, with repetition
+} SyncStrategy;
+
+/* LogSyncVerify chooses how records received from peers are checked */
+typedef enum {
+    LOG_SYNC_VERIFY_NONE = 0,          // accept all records
+    LOG_SYNC_VERIFY_HASH = 1,          // hash must match the record, as
+                                       // laid out by gdp.ChainHash
+    LOG_SYNC_VERIFY_SIGNATURE = 2,     // hash and signature, needs publicKey
+} LogSyncVerify;
+
+/* LogSyncCodec chooses how outgoing messages are serialized. Incoming
+ * messages are decoded whatever their codec. */
+typedef enum {
+    LOG_SYNC_CODEC_LEGACY = 0,         // graph messages in bare gob, read by
+                                       // older replicas, others as GOB
+    LOG_SYNC_CODEC_GOB = 1,            // gob in a codec envelope
+    LOG_SYNC_CODEC_BINARY = 2,         // protobuf wire format in a codec
+                                       // envelope, for peers not in Go
+} LogSyncCodec;
+
+/* LogSyncConfig configures a handle, see CreateLogSyncHandleWithConfig.
+ * Fields left zero keep the defaults of the policy. */
+typedef struct {
+    const char* policy;                // "external" or "merkle", NULL for
+                                       // "external". Other policies of the
+                                       // daemon load the log once and miss
+                                       // later appends, so are rejected.
+    int32_t batchSize;                 // max records per message, -1 for no limit
+    uint32_t conversationTimeoutMs;    // idle time before a conversation is aborted
+    int32_t verify;                    // a LogSyncVerify
+    const void* publicKey;             // DER encoded public key of the log
+    uint32_t publicKeyLength;
+    int32_t expectedDifference;        // difference IBLT tables are sized for
+    int32_t codec;                     // a LogSyncCodec
+} LogSyncConfig;
+
 /* MsgCallbackFunc should be implemented by the user of the
  * library to handle an outgoing replication message
- * Its implementation needs to release Msg. */
+ * Its implementation needs to release Msg. See RegisterMsgCallback. */
 typedef void (*MsgCallbackFunc) (PeerAddr, Msg);
 
 #endif
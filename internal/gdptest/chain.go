@@ -0,0 +1,32 @@
+// Package gdptest provides fixtures for the tests of gdp-replicate. It
+// is internal so that fixtures are not part of the API of the library.
+package gdptest
+
+import (
+	"fmt"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// Chain returns a chain of n unsigned records, each pointing to the
+// record before it, with values "<name> <recno>". Logs of different
+// names hold different records.
+func Chain(name string, n int) []gdp.Record {
+	records := make([]gdp.Record, 0, n)
+	prev := gdp.NullHash
+	for i := 0; i < n; i++ {
+		record := gdp.Record{
+			Metadatum: gdp.Metadatum{
+				RecNo:     i,
+				Timestamp: int64(i),
+				PrevHash:  prev,
+				Sig:       []byte{},
+			},
+			Value: []byte(fmt.Sprintf("%s %d", name, i)),
+		}
+		record.Hash = record.ComputeHash()
+		prev = record.Hash
+		records = append(records, record)
+	}
+	return records
+}
@@ -2,16 +2,17 @@ package main
 
 /* This file maintains package level context for log syncing */
 
-// #include "gdp_types.h"
-import "C"
-
 import (
 	"database/sql"
 	"errors"
 	"math/rand"
+	"sync"
 
+	"github.com/tonyyanga/gdp-replicate/codec"
+	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/logserver"
 	"github.com/tonyyanga/gdp-replicate/policy"
+	"github.com/tonyyanga/gdp-replicate/scheduler"
 	"go.uber.org/zap"
 )
 
@@ -20,12 +21,58 @@ type HandleTicket = uint32
 type LogSyncCtx struct {
 	Policy    policy.Policy
 	logServer logserver.LogServer
+
+	// database of logServer, closed with the handle
+	db *sql.DB
+
+	// codec of outgoing messages, see toCMsg
+	codec codec.Codec
+
+	// sends outgoing messages in callback mode, nil otherwise
+	callbackMutex sync.RWMutex
+	callback      msgCallback
+
+	// runs rounds of InitSync, see StartAutoSync
+	scheduler *scheduler.Scheduler
+
+	// stops aborting idle conversations, nil if the policy does not
+	// abort them
+	done chan struct{}
 }
 
-// Global map from handleTicket in LogSyncHandle to Go context
-var logCtxMap = make(map[HandleTicket]LogSyncCtx)
+// Global map from handleTicket in LogSyncHandle to Go context.
+// The host calls the library from many threads, so the map is guarded
+// by logCtxMutex.
+var (
+	logCtxMutex = &sync.RWMutex{}
+	logCtxMap   = make(map[HandleTicket]*LogSyncCtx)
+)
+
+// nullTicket is the ticket of the handle returned on failures, it is
+// never assigned to a context
+const nullTicket HandleTicket = 0
+
+var errUndefinedHandle = errors.New("Undefined log sync handle")
 
-func newLogSyncCtx(sqlFile string) (HandleTicket, error) {
+// policyError is the failure of a known policy to start on a log
+type policyError struct {
+	err error
+}
+
+func (e *policyError) Error() string {
+	return e.err.Error()
+}
+
+// newLogSyncCtx creates the context of a log with the policy registered
+// as policyName, see policy.New. Outgoing messages are serialized with
+// msgCodec, see toCMsg. Failures of the policy are *policyError, see
+// createFailure.
+func newLogSyncCtx(
+	sqlFile,
+	policyName string,
+	opts policy.Options,
+	msgCodec codec.Codec,
+) (HandleTicket, error) {
 	db, err := sql.Open("sqlite3", sqlFile)
 	if err != nil {
 		zap.S().Errorw(
@@ -35,38 +82,108 @@ func newLogSyncCtx(sqlFile string) (HandleTicket, error) {
 		)
 		return 0, err
 	}
-	logServer := logserver.NewSqliteServer(db)
+	logServer, err := logserver.NewSqliteServer(db)
+	if err != nil {
+		db.Close()
+		zap.S().Errorw(
+			"Failed to open log database",
+			"sqlite-file", sqlFile,
+			"error", err,
+		)
+		return 0, err
+	}
 
-	// TODO: support alternate policies
-	policy := policy.NewExternalGraphDiffPolicy(logServer)
+	chosenPolicy, err := policy.New(policyName, logServer, opts)
+	if err != nil {
+		db.Close()
+		zap.S().Errorw(
+			"Failed to create policy",
+			"policy", policyName,
+			"error", err,
+		)
+		if err != policy.ErrUnknownPolicy {
+			err = &policyError{err}
+		}
+		return 0, err
+	}
 
-	ticket := generateHandleTicket()
+	logCtxMutex.Lock()
+	defer logCtxMutex.Unlock()
 
-	logCtxMap[ticket] = LogSyncCtx{
+	ticket := generateHandleTicket()
+	ctx := &LogSyncCtx{
 		logServer: logServer,
-		Policy:    policy,
+		db:        db,
+		Policy:    chosenPolicy,
+		codec:     msgCodec,
 	}
+	ctx.scheduler = scheduler.NewScheduler(func(peer gdp.Hash) error {
+		return ctx.autoSync(ticket, peer)
+	})
+	if reaper, ok := chosenPolicy.(policy.ConversationReaper); ok {
+		ctx.done = make(chan struct{})
+		go policy.ReapConversations(
+			reaper,
+			policy.ReapInterval(opts.ConversationTimeout),
+			ctx.done,
+		)
+	}
+	logCtxMap[ticket] = ctx
 
 	return ticket, nil
 }
 
+// releaseLogSyncCtx drops the context of a handle, aborts its
+// conversations and closes its database. Calls already using the
+// context fail once the database is closed.
+func releaseLogSyncCtx(ticket HandleTicket) {
+	logCtxMutex.Lock()
+	ctx, ok := logCtxMap[ticket]
+	delete(logCtxMap, ticket)
+	logCtxMutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	ctx.scheduler.Stop()
+	if ctx.done != nil {
+		close(ctx.done)
+	}
+
+	// conversations hold snapshots, which are transactions of the db
+	if reaper, ok := ctx.Policy.(policy.ConversationReaper); ok {
+		reaper.AbortConversations()
+	}
+	err := ctx.db.Close()
+	if err != nil {
+		zap.S().Errorw(
+			"Failed to close log database",
+			"ticket", ticket,
+			"error", err,
+		)
+	}
+}
+
 // Helper func to get log sync ctx from map
-func getLogSyncCtx(handle C.LogSyncHandle) (*LogSyncCtx, error) {
-	ticket := uint32(handle.handleTicket)
+func getLogSyncCtx(ticket HandleTicket) (*LogSyncCtx, error) {
+	logCtxMutex.RLock()
+	defer logCtxMutex.RUnlock()
 
 	result, ok := logCtxMap[ticket]
 	if !ok {
-		return nil, errors.New("Undefined log sync handle")
+		return nil, errUndefinedHandle
 	} else {
-		return &result, nil
+		return result, nil
 	}
 }
 
 // Generate random ticket not in the map
+// Assumes logCtxMutex is held by caller
 func generateHandleTicket() HandleTicket {
 	for {
 		ticket := rand.Uint32()
-		if _, ok := logCtxMap[ticket]; !ok {
+		if _, ok := logCtxMap[ticket]; !ok && ticket != nullTicket {
 			return ticket
 		}
 	}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/policy"
+)
+
+// newTestLog creates a log database holding the first n records of a
+// chain and returns its path
+func newTestLog(t *testing.T, name string, n int) string {
+	path := filepath.Join(t.TempDir(), name+".db")
+	db, err := sql.Open("sqlite3", path)
+	assert.Nil(t, err)
+	defer db.Close()
+	server, err := logserver.NewSqliteServer(db)
+	assert.Nil(t, err)
+
+	_, err = server.WriteRecords(gdptest.Chain("record", n))
+	assert.Nil(t, err)
+	return path
+}
+
+// runSync runs a conversation initiated by the handle with ticket
+// initiator with the handle with ticket responder
+func runSync(t *testing.T, initiator, responder HandleTicket, addrs map[HandleTicket]gdp.Hash) {
+	msg, code := initSync(initiator, addrs[responder])
+	assert.Equal(t, 0, int(code))
+
+	sender, receiver := initiator, responder
+	for int(code) == 0 {
+		resp, respCode := handleMsg(receiver, addrs[sender], msg)
+		freeMsg(msg)
+		msg, code = resp, respCode
+		sender, receiver = receiver, sender
+	}
+	assert.Equal(t, -1, int(code))
+}
+
+// TestConcurrentHandles drives conversations between many handles from
+// many goroutines, as gdplogd does from many threads. Run with -race.
+func TestConcurrentHandles(t *testing.T) {
+	const numLogs = 4
+	const rounds = 3
+
+	addrs := make(map[HandleTicket]gdp.Hash)
+	for i := 0; i < numLogs; i++ {
+		handle, code := CreateLogSyncHandle(newTestLog(t, fmt.Sprint(i), 10*(i+1)))
+		assert.Equal(t, 0, int(code))
+		defer ReleaseLogSyncHandle(handle)
+
+		addrs[uint32(handle.handleTicket)] = gdp.GenerateHash(fmt.Sprint(i))
+	}
+
+	wg := &sync.WaitGroup{}
+	for initiator := range addrs {
+		for responder := range addrs {
+			if initiator == responder {
+				continue
+			}
+
+			wg.Add(1)
+			go func(initiator, responder HandleTicket) {
+				defer wg.Done()
+				for i := 0; i < rounds; i++ {
+					runSync(t, initiator, responder, addrs)
+				}
+			}(initiator, responder)
+		}
+	}
+
+	// Handles come and go while others are in use
+	churnLog := newTestLog(t, "churn", 5)
+	for i := 0; i < numLogs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				handle, code := CreateLogSyncHandle(churnLog)
+				assert.Equal(t, 0, int(code))
+				ReleaseLogSyncHandle(handle)
+
+				_, code = initSync(uint32(handle.handleTicket), gdp.NullHash)
+				assert.Equal(t, 2, int(code))
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// TestAbandonedConversation checks that the snapshot of a conversation
+// the peer never answers is released once the conversation times out,
+// so it does not keep the WAL from being checkpointed
+func TestAbandonedConversation(t *testing.T) {
+	path := newTestLog(t, "abandoned", 10)
+	ticket, err := newLogSyncCtx(
+		path,
+		policy.ExternalGraphDiffPolicyName,
+		policy.Options{ConversationTimeout: 500 * time.Millisecond},
+		nil,
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer releaseLogSyncCtx(ticket)
+
+	msg, code := initSync(ticket, gdp.GenerateHash("peer"))
+	assert.Equal(t, 0, int(code))
+	freeMsg(msg)
+
+	// another connection that does not wait for readers
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=0")
+	assert.Nil(t, err)
+	defer db.Close()
+	server, err := logserver.NewSqliteServer(db)
+	assert.Nil(t, err)
+
+	record := gdp.Record{
+		Metadatum: gdp.Metadatum{PrevHash: gdp.NullHash, Sig: []byte{}},
+		Value:     []byte("written after the snapshot"),
+	}
+	record.Hash = record.ComputeHash()
+	_, err = server.WriteRecords([]gdp.Record{record})
+	assert.Nil(t, err)
+
+	checkpointBusy := func() bool {
+		var busy, walFrames, checkpointed int
+		err := db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &walFrames, &checkpointed)
+		assert.Nil(t, err)
+		return busy != 0
+	}
+
+	// the snapshot of the conversation holds a read transaction
+	assert.True(t, checkpointBusy())
+
+	assert.Eventually(t, func() bool {
+		return !checkpointBusy()
+	}, 5*time.Second, 50*time.Millisecond)
+
+	ctx, err := getLogSyncCtx(ticket)
+	assert.Nil(t, err)
+	assert.Empty(t, ctx.Policy.(policy.ConversationInspector).Conversations())
+
+	// Releasing a handle mid-conversation ends its snapshot at once
+	ticket, err = newLogSyncCtx(path, policy.ExternalGraphDiffPolicyName, policy.Options{}, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	ctx, err = getLogSyncCtx(ticket)
+	assert.Nil(t, err)
+
+	msg, code = initSync(ticket, gdp.GenerateHash("peer"))
+	assert.Equal(t, 0, int(code))
+	freeMsg(msg)
+
+	record.Value = []byte("written before the release")
+	record.Hash = record.ComputeHash()
+	_, err = server.WriteRecords([]gdp.Record{record})
+	assert.Nil(t, err)
+	assert.True(t, checkpointBusy())
+
+	releaseLogSyncCtx(ticket)
+	assert.False(t, checkpointBusy())
+	assert.Empty(t, ctx.Policy.(policy.ConversationInspector).Conversations())
+	assert.NotNil(t, ctx.db.Ping())
+}
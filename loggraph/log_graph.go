@@ -2,6 +2,7 @@ package loggraph
 
 import (
 	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/logserver"
 )
 
 // LogGraph provides an abstracted view of records in the database.
@@ -26,8 +27,9 @@ type LogGraph interface {
 	// E.g. [X] <- D but there is no entry for X in the actual map; D has a dangling entry
 	GetLogicalBegins() []gdp.Hash
 
-	// WriteRecords writes new records to the log server
-	WriteRecords(records []gdp.Record) error
+	// WriteRecords writes new records to the log server, see
+	// logserver.LogServer
+	WriteRecords(records []gdp.Record) ([]logserver.WriteResult, error)
 
 	// ReadRecords returns records with hashes
 	ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error)
@@ -16,7 +16,10 @@ func TestSimpleGraph(t *testing.T) {
 	db, err := sql.Open("sqlite3", dbFile)
 	assert.Nil(t, err)
 
-	logServer := logserver.NewSqliteServer(db)
+	logServer, err := logserver.NewSqliteServer(db)
+	if !assert.Nil(t, err) {
+		return
+	}
 	graph, err := NewSimpleGraph(logServer)
 	assert.Nil(t, err)
 
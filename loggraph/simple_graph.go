@@ -1,14 +1,24 @@
 package loggraph
 
 import (
+	"sync"
+
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/logserver"
 
 	"github.com/jinzhu/copier"
 )
 
+// SimpleGraph is a LogGraph holding all metadata in memory.
+// Records may be written while clones are created concurrently; the
+// maps returned by GetNodeMap, GetActualPtrMap and GetLogicalPtrMap
+// must not be used concurrently with WriteRecords.
 type SimpleGraph struct {
 	logServer logserver.LogServer
+
+	// guards all fields below
+	mutex sync.RWMutex
+
 	// All log entries in the database as of last refresh
 	forwardEdges  map[gdp.Hash][]gdp.Hash
 	backwardEdges map[gdp.Hash]gdp.Hash
@@ -39,6 +49,7 @@ func NewSimpleGraph(logServer logserver.LogServer) (*SimpleGraph, error) {
 }
 
 // addMetadata updates all SimpleGraph fields to reflect new Metadata
+// Assumes the mutex of graph is held by caller, unless graph is new
 func (graph *SimpleGraph) addMetadata(metadata []gdp.Metadatum) {
 	for _, metadatum := range metadata {
 		graph.nodeMap[metadatum.Hash] = true
@@ -93,6 +104,13 @@ func (graph *SimpleGraph) GetLogicalPtrMap() map[gdp.Hash][]gdp.Hash {
 }
 
 func (graph *SimpleGraph) GetLogicalEnds() []gdp.Hash {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+	return graph.logicalEndsLocked()
+}
+
+// Assumes the mutex of graph is held by caller
+func (graph *SimpleGraph) logicalEndsLocked() []gdp.Hash {
 	ends := make([]gdp.Hash, 0, len(graph.logicalEnds))
 	for hash, _ := range graph.logicalEnds {
 		ends = append(ends, hash)
@@ -101,6 +119,13 @@ func (graph *SimpleGraph) GetLogicalEnds() []gdp.Hash {
 }
 
 func (graph *SimpleGraph) GetLogicalBegins() []gdp.Hash {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+	return graph.logicalBeginsLocked()
+}
+
+// Assumes the mutex of graph is held by caller
+func (graph *SimpleGraph) logicalBeginsLocked() []gdp.Hash {
 	starts := make([]gdp.Hash, 0, len(graph.logicalStarts))
 	for _, hashes := range graph.logicalStarts {
 		for _, hash := range hashes {
@@ -111,19 +136,23 @@ func (graph *SimpleGraph) GetLogicalBegins() []gdp.Hash {
 }
 
 // WriteRecords writes records to the graph's log server and
-// updates the graph with those records
-func (graph *SimpleGraph) WriteRecords(records []gdp.Record) error {
-	err := graph.logServer.WriteRecords(records)
+// updates the graph with the records inserted
+func (graph *SimpleGraph) WriteRecords(records []gdp.Record) ([]logserver.WriteResult, error) {
+	results, err := graph.logServer.WriteRecords(records)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	metadata := make([]gdp.Metadatum, 0, len(records))
-	for _, record := range records {
+	inserted := logserver.InsertedRecords(records, results)
+	metadata := make([]gdp.Metadatum, 0, len(inserted))
+	for _, record := range inserted {
 		metadata = append(metadata, record.Metadatum)
 	}
+
+	graph.mutex.Lock()
+	defer graph.mutex.Unlock()
 	graph.addMetadata(metadata)
-	return nil
+	return results, nil
 }
 
 func (graph *SimpleGraph) ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error) {
@@ -132,6 +161,9 @@ func (graph *SimpleGraph) ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error) {
 
 // CreateClone uses encoding to clone the SimpleGraph.
 func (graph *SimpleGraph) CreateClone() (*SimpleGraphClone, error) {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+
 	forwardEdges := make(map[gdp.Hash][]gdp.Hash)
 	backwardEdges := make(map[gdp.Hash]gdp.Hash)
 	nodeMap := make(map[gdp.Hash]bool)
@@ -152,8 +184,8 @@ func (graph *SimpleGraph) CreateClone() (*SimpleGraphClone, error) {
 	return &SimpleGraphClone{
 		forwardEdges:  forwardEdges,
 		backwardEdges: backwardEdges,
-		logicalEnds:   graph.GetLogicalEnds(),
-		logicalStarts: graph.GetLogicalBegins(),
+		logicalEnds:   graph.logicalEndsLocked(),
+		logicalStarts: graph.logicalBeginsLocked(),
 		nodeMap:       nodeMap,
 	}, nil
 }
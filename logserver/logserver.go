@@ -15,7 +15,12 @@ type LogServer interface {
 	ReadAllMetadata() ([]gdp.Metadatum, error)
 	ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error)
 	ReadAllRecords() ([]gdp.Record, error)
-	WriteRecords(records []gdp.Record) error
+
+	// WriteRecords writes records not held yet and returns the outcome
+	// for each record, in order. Records already held are skipped, so
+	// writes can be retried. An error means none of the records were
+	// written.
+	WriteRecords(records []gdp.Record) ([]WriteResult, error)
 }
 
 type SearchableLogServer interface {
@@ -24,3 +29,54 @@ type SearchableLogServer interface {
 	// This function searches for records that have PrevHash = id
 	FindNextRecords(id gdp.Hash) ([]gdp.Metadatum, error)
 }
+
+// WriteStatus is the outcome of writing one record, see WriteResult
+type WriteStatus int
+
+const (
+	// The record was not held and is now persisted
+	Inserted WriteStatus = iota
+
+	// The same record is already held, nothing was written
+	Duplicate
+
+	// A different record with the same hash is already held, it is kept
+	Conflict
+
+	// The record was refused by the database, e.g. by a constraint
+	Rejected
+)
+
+var writeStatusNames = [...]string{
+	Inserted:  "inserted",
+	Duplicate: "duplicate",
+	Conflict:  "conflict",
+	Rejected:  "rejected",
+}
+
+func (status WriteStatus) String() string {
+	if status < 0 || int(status) >= len(writeStatusNames) {
+		return fmt.Sprintf("WriteStatus(%d)", int(status))
+	}
+	return writeStatusNames[status]
+}
+
+// WriteResult is the outcome of writing a record. Err is the reason a
+// record was rejected, nil otherwise.
+type WriteResult struct {
+	Hash   gdp.Hash
+	Status WriteStatus
+	Err    error
+}
+
+// InsertedRecords returns the records, in order, whose result is
+// Inserted. results are those of WriteRecords for records.
+func InsertedRecords(records []gdp.Record, results []WriteResult) []gdp.Record {
+	inserted := make([]gdp.Record, 0, len(records))
+	for i, result := range results {
+		if result.Status == Inserted {
+			inserted = append(inserted, records[i])
+		}
+	}
+	return inserted
+}
@@ -0,0 +1,213 @@
+package logserver
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// maxChunk is the largest number of hashes bound to one statement, well
+// below the limit of host parameters of SQLite
+const maxChunk = 512
+
+// stmtCache prepares each query once for a database, or for a
+// transaction, see inTx
+type stmtCache struct {
+	db *sql.DB
+
+	// tx and the cache of db it comes from, nil for the cache of db
+	tx     *sql.Tx
+	parent *stmtCache
+
+	// guards stmts
+	mutex sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache(db *sql.DB) *stmtCache {
+	return &stmtCache{
+		db:    db,
+		stmts: make(map[string]*sql.Stmt),
+	}
+}
+
+// inTx returns a cache of the statements of cache in tx. Its statements
+// are bound to tx once and closed with tx, so a snapshot, which queries
+// its transaction many times, does not bind them on every query.
+func (cache *stmtCache) inTx(tx *sql.Tx) *stmtCache {
+	return &stmtCache{
+		db:     cache.db,
+		tx:     tx,
+		parent: cache,
+		stmts:  make(map[string]*sql.Stmt),
+	}
+}
+
+// get returns the statement of query, prepared if needed
+func (cache *stmtCache) get(query string) (*sql.Stmt, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if stmt, ok := cache.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	var stmt *sql.Stmt
+	var err error
+	if cache.parent != nil {
+		stmt, err = cache.parent.get(query)
+		if err == nil {
+			stmt = cache.tx.Stmt(stmt)
+		}
+	} else {
+		stmt, err = cache.db.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cache.stmts[query] = stmt
+	return stmt, nil
+}
+
+// query runs the statement of query with args and parses its rows with
+// parse
+func (cache *stmtCache) query(
+	query string,
+	args []interface{},
+	parse func(*sql.Rows) error,
+) error {
+	stmt, err := cache.get(query)
+	if err != nil {
+		return err
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	return parse(rows)
+}
+
+// queryHashes runs query, whose %s stands for a list of parameters, for
+// all hashes and parses the rows of each chunk with parse. Chunks are
+// padded to a power of two with their last hash, so few statements
+// are prepared.
+func (cache *stmtCache) queryHashes(
+	query string,
+	hashes []gdp.Hash,
+	parse func(*sql.Rows) error,
+) error {
+	hashes = uniqueHashes(hashes)
+
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > maxChunk {
+			n = maxChunk
+		}
+		chunk := hashes[:n]
+		hashes = hashes[n:]
+
+		size := chunkSize(n)
+		args := make([]interface{}, size)
+		for i := range args {
+			if i < n {
+				args[i] = chunk[i][:]
+			} else {
+				args[i] = chunk[n-1][:]
+			}
+		}
+
+		err := cache.query(fmt.Sprintf(query, parameters(size)), args, parse)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkSize returns the number of parameters bound for n hashes, the
+// next power of two
+func chunkSize(n int) int {
+	size := 1
+	for size < n {
+		size *= 2
+	}
+	return size
+}
+
+// parameters returns a list of n parameters
+func parameters(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// uniqueHashes drops repeated hashes, keeping the order of hashes
+func uniqueHashes(hashes []gdp.Hash) []gdp.Hash {
+	seen := make(map[gdp.Hash]bool, len(hashes))
+	unique := make([]gdp.Hash, 0, len(hashes))
+	for _, hash := range hashes {
+		if !seen[hash] {
+			seen[hash] = true
+			unique = append(unique, hash)
+		}
+	}
+	return unique
+}
+
+// readMetadata reads the metadata of records with hashes
+func readMetadata(cache *stmtCache, hashes []gdp.Hash) ([]gdp.Metadatum, error) {
+	var metadata []gdp.Metadatum
+	err := cache.queryHashes(
+		"SELECT hash, recno, timestamp, accuracy, prevhash, sig FROM log_entry WHERE hash IN (%s)",
+		hashes,
+		func(rows *sql.Rows) error {
+			parsed, err := parseMetadataRows(rows)
+			metadata = append(metadata, parsed...)
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// readRecords reads the records with hashes
+func readRecords(cache *stmtCache, hashes []gdp.Hash) ([]gdp.Record, error) {
+	var records []gdp.Record
+	err := cache.queryHashes(
+		"SELECT hash, recno, timestamp, accuracy, prevhash, value, sig FROM log_entry WHERE hash IN (%s)",
+		hashes,
+		func(rows *sql.Rows) error {
+			parsed, err := parseRecordRows(rows)
+			records = append(records, parsed...)
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// findNextRecords reads the metadata of records with PrevHash = id
+func findNextRecords(cache *stmtCache, id gdp.Hash) ([]gdp.Metadatum, error) {
+	var metadata []gdp.Metadatum
+	err := cache.query(
+		"SELECT hash, recno, timestamp, accuracy, prevhash, sig FROM log_entry WHERE prevhash = ?",
+		[]interface{}{id[:]},
+		func(rows *sql.Rows) error {
+			var err error
+			metadata, err = parseMetadataRows(rows)
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
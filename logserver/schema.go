@@ -0,0 +1,259 @@
+package logserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"go.uber.org/zap"
+)
+
+/*
+The schema of a log database is created and migrated by Migrate, which
+NewSqliteServer runs on every database it opens. Its version is kept in
+the user_version of the database, 0 for databases never migrated.
+
+A change of the schema is a new migration appended to migrations, which
+moves the schema from the version before it to the next one. Migrations
+must be idempotent, as they run on databases created by other tools and
+may run concurrently on a database shared by replicas.
+*/
+
+// A migration moves the schema of a database to the next version
+type migration func(tx *schemaTx) error
+
+// migrations[i] moves the schema from version i to version i+1
+var migrations = [...]migration{
+	createLogEntry,
+	indexHashes,
+	createDigest,
+}
+
+// SchemaVersion is the version of the schema of the databases migrated
+// by Migrate
+const SchemaVersion = len(migrations)
+
+var ErrSchemaTooNew = errors.New("database schema is newer than supported")
+
+// Migrate creates the schema of a log database, or migrates it to
+// SchemaVersion
+func Migrate(db *sql.DB) error {
+	for {
+		done, err := migrateOnce(db)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// schemaTx is a transaction holding the write lock of a database from
+// its beginning. The deferred transactions of sql.DB take it at their
+// first write, which fails with SQLITE_BUSY if another connection read
+// the database in between, as when replicas open a new database at
+// once.
+type schemaTx struct {
+	ctx  context.Context
+	conn *sql.Conn
+	done bool
+}
+
+// beginSchemaTx begins a schemaTx on a connection of db, which is
+// returned to the pool by Commit or Rollback
+func beginSchemaTx(db *sql.DB) (*schemaTx, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.ExecContext(ctx, "BEGIN IMMEDIATE")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &schemaTx{ctx: ctx, conn: conn}, nil
+}
+
+func (tx *schemaTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.conn.ExecContext(tx.ctx, query, args...)
+}
+
+func (tx *schemaTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.conn.QueryRowContext(tx.ctx, query, args...)
+}
+
+// end ends the transaction with stmt, unless it already ended
+func (tx *schemaTx) end(stmt string) error {
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+	defer tx.conn.Close()
+
+	_, err := tx.conn.ExecContext(tx.ctx, stmt)
+	return err
+}
+
+func (tx *schemaTx) Commit() error {
+	return tx.end("COMMIT")
+}
+
+func (tx *schemaTx) Rollback() error {
+	return tx.end("ROLLBACK")
+}
+
+// migrateOnce runs the next migration of db, in a transaction. Returns
+// true if db is already at SchemaVersion.
+func migrateOnce(db *sql.DB) (bool, error) {
+	tx, err := beginSchemaTx(db)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return false, err
+	}
+	if version > SchemaVersion {
+		return false, ErrSchemaTooNew
+	}
+	if version == SchemaVersion {
+		return true, nil
+	}
+
+	err = migrations[version](tx)
+	if err != nil {
+		return false, fmt.Errorf("migrating schema to version %d: %v", version+1, err)
+	}
+
+	// PRAGMA does not accept parameters
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	zap.S().Infow(
+		"Migrated database schema",
+		"version", version+1,
+	)
+	return version+1 == SchemaVersion, nil
+}
+
+// createLogEntry creates the table of records, as created by the
+// benchmark tools
+func createLogEntry(tx *schemaTx) error {
+	_, err := tx.Exec(`
+    CREATE TABLE IF NOT EXISTS log_entry (
+        hash BLOB(32) PRIMARY KEY ON CONFLICT IGNORE,
+        recno INTEGER,
+        timestamp INTEGER,
+        accuracy FLOAT,
+        prevhash BLOB(32),
+        value BLOB,
+        sig BLOB)`)
+	return err
+}
+
+// indexHashes indexes the hashes records are looked up and joined by.
+// Tables with hash as primary key already index it.
+func indexHashes(tx *schemaTx) error {
+	indexed, err := isIndexed(tx, "log_entry", "hash")
+	if err != nil {
+		return err
+	}
+	if !indexed {
+		_, err = tx.Exec("CREATE INDEX IF NOT EXISTS log_entry_hash ON log_entry (hash)")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("CREATE INDEX IF NOT EXISTS log_entry_prevhash ON log_entry (prevhash)")
+	return err
+}
+
+// isIndexed checks if an index of table starts with column
+func isIndexed(tx *schemaTx, table, column string) (bool, error) {
+	var count int
+	err := tx.QueryRow(`
+    SELECT count(*)
+    FROM pragma_index_list(?) AS list, pragma_index_info(list.name) AS info
+    WHERE info.seqno = 0 AND info.name = ?`,
+		table, column,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// createDigest creates the digest of the log, the logical begins and
+// ends of SimpleGraph. Triggers keep it up to date for all writes,
+// including those of gdplogd. Records are never updated in place.
+//
+// log_begin holds records whose previous record is not held, log_end
+// records no held record points to.
+func createDigest(tx *schemaTx) error {
+	for _, stmt := range []string{`
+    CREATE TABLE IF NOT EXISTS log_begin (
+        hash BLOB(32) PRIMARY KEY,
+        prevhash BLOB(32))`, `
+    CREATE INDEX IF NOT EXISTS log_begin_prevhash ON log_begin (prevhash)`, `
+    CREATE TABLE IF NOT EXISTS log_end (
+        hash BLOB(32) PRIMARY KEY)`,
+
+		// Rebuilt from scratch, as the tables may be left by another
+		// replica migrating the database concurrently
+		"DELETE FROM log_begin",
+		"DELETE FROM log_end", `
+    INSERT OR IGNORE INTO log_begin (hash, prevhash)
+    SELECT hash, prevhash
+    FROM log_entry entry
+    WHERE NOT EXISTS (SELECT 1 FROM log_entry prev WHERE prev.hash = entry.prevhash)`, `
+    INSERT OR IGNORE INTO log_end (hash)
+    SELECT hash
+    FROM log_entry entry
+    WHERE NOT EXISTS (SELECT 1 FROM log_entry next WHERE next.prevhash = entry.hash)`, `
+    CREATE TRIGGER IF NOT EXISTS log_entry_digest_insert
+    AFTER INSERT ON log_entry
+    BEGIN
+        INSERT OR IGNORE INTO log_begin (hash, prevhash)
+        SELECT NEW.hash, NEW.prevhash
+        WHERE NOT EXISTS (SELECT 1 FROM log_entry WHERE hash = NEW.prevhash);
+
+        DELETE FROM log_begin WHERE prevhash = NEW.hash;
+
+        INSERT OR IGNORE INTO log_end (hash)
+        SELECT NEW.hash
+        WHERE NOT EXISTS (SELECT 1 FROM log_entry WHERE prevhash = NEW.hash);
+
+        DELETE FROM log_end WHERE hash = NEW.prevhash;
+    END`, `
+    CREATE TRIGGER IF NOT EXISTS log_entry_digest_delete
+    AFTER DELETE ON log_entry
+    WHEN NOT EXISTS (SELECT 1 FROM log_entry WHERE hash = OLD.hash)
+    BEGIN
+        DELETE FROM log_begin WHERE hash = OLD.hash;
+        DELETE FROM log_end WHERE hash = OLD.hash;
+
+        INSERT OR IGNORE INTO log_begin (hash, prevhash)
+        SELECT hash, prevhash FROM log_entry WHERE prevhash = OLD.hash;
+
+        INSERT OR IGNORE INTO log_end (hash)
+        SELECT hash FROM log_entry
+        WHERE hash = OLD.prevhash
+            AND NOT EXISTS (SELECT 1 FROM log_entry WHERE prevhash = OLD.prevhash);
+    END`,
+	} {
+		_, err := tx.Exec(stmt)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package logserver
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "log.db"))
+	assert.Nil(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	var version int
+	assert.Nil(t, db.QueryRow("PRAGMA user_version").Scan(&version))
+	return version
+}
+
+func indexes(t *testing.T, db *sql.DB) []string {
+	rows, err := db.Query("SELECT name FROM pragma_index_list('log_entry') WHERE origin = 'c'")
+	assert.Nil(t, err)
+	defer rows.Close()
+
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		assert.Nil(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestCreateSchema(t *testing.T) {
+	db := openTestDB(t)
+
+	server, err := NewSqliteServer(db)
+	assert.Nil(t, err)
+	assert.Equal(t, SchemaVersion, schemaVersion(t, db))
+
+	// hash is indexed as the primary key
+	assert.Equal(t, []string{"log_entry_prevhash"}, indexes(t, db))
+
+	record := gdp.Record{Metadatum: gdp.Metadatum{Hash: gdp.GenerateHash("record"), Sig: []byte{}}}
+	_, err = server.WriteRecords([]gdp.Record{record})
+	assert.Nil(t, err)
+
+	// Opening again keeps the schema and the records
+	server, err = NewSqliteServer(db)
+	assert.Nil(t, err)
+	records, err := server.ReadAllMetadata()
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+}
+
+func TestMigrateSchema(t *testing.T) {
+	db := openTestDB(t)
+
+	// A table created by another tool, without primary key
+	_, err := db.Exec(`CREATE TABLE log_entry (
+		hash BLOB(32), recno INTEGER, timestamp INTEGER, accuracy FLOAT,
+		prevhash BLOB(32), value BLOB, sig BLOB)`)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		hash := gdp.GenerateHash(fmt.Sprint(i))
+		_, err = db.Exec("INSERT INTO log_entry VALUES (?, 0, 0, 0, ?, ?, ?)",
+			hash[:], gdp.NullHash[:], []byte{}, []byte{})
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, Migrate(db))
+	assert.Equal(t, SchemaVersion, schemaVersion(t, db))
+	assert.ElementsMatch(t, []string{"log_entry_hash", "log_entry_prevhash"}, indexes(t, db))
+
+	server, err := NewSqliteServer(db)
+	assert.Nil(t, err)
+	records, err := server.ReadAllMetadata()
+	assert.Nil(t, err)
+	assert.Len(t, records, 3)
+
+	// Schemas of newer versions are not opened
+	_, err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", SchemaVersion+1))
+	assert.Nil(t, err)
+	_, err = NewSqliteServer(db)
+	assert.Equal(t, ErrSchemaTooNew, err)
+}
+
+func TestConcurrentMigrate(t *testing.T) {
+	// Replicas opening a new database at once, each with its own pool
+	path := filepath.Join(t.TempDir(), "log.db?_busy_timeout=5000")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db, err := sql.Open("sqlite3", path)
+			if err == nil {
+				err = Migrate(db)
+				db.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+}
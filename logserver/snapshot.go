@@ -2,6 +2,7 @@ package logserver
 
 import (
 	"github.com/tonyyanga/gdp-replicate/gdp"
+	"go.uber.org/zap"
 )
 
 // A SnapshotLogServer is a LogServer with snapshot capabilities
@@ -9,50 +10,110 @@ type SnapshotLogServer interface {
 	SearchableLogServer
 
 	CreateSnapshot() (*Snapshot, error)
+
+	// DestroySnapshot releases the view of a snapshot, which must not
+	// be used afterwards
 	DestroySnapshot(*Snapshot)
+}
+
+// A SnapshotView is a read only view of a log as of the creation of a
+// snapshot. Records written or deleted later are not seen.
+type SnapshotView interface {
+	ReadMetadata(hashes []gdp.Hash) ([]gdp.Metadatum, error)
 
-	// Filter records by "time"
-	// Implementations of this interface should determine how to
-	// interpret "time" in snapshot and here
-	CheckRecordExistence(time int64, id gdp.Hash) (bool, error)
+	// This function searches for records that have PrevHash = id
+	FindNextRecords(id gdp.Hash) ([]gdp.Metadatum, error)
+
+	// Close releases the view
+	Close() error
 }
 
 type Snapshot struct {
-	time      int64 // Time of snapshot creation
-	logServer SnapshotLogServer
+	view SnapshotView
+
+	// newRecords are records that are considered in the snapshot
+	// although they are added to the db after its creation, see
+	// RegisterNewRecord. Maps from Hash to PrevHash.
+	newRecords map[gdp.Hash]gdp.Hash
 
-	// newRecords are a map of hashes that are considered in the snapshot
-	// although they are added to the db after its creation
-	newRecords map[gdp.Hash]bool
+	// newNext maps from the PrevHash of newRecords to their Hash
+	newNext map[gdp.Hash][]gdp.Hash
 
 	// logical starts and ends form the digest of the snapshot
 	// see SimpleGraph for more details
-	// logical starts map from PrevHash to their Hash TODO: better ideas?
-	logicalStarts map[gdp.Hash][]gdp.Hash // value is PrevHash
+	// logical starts map from a record's PrevHash to their Hash
+	logicalStarts map[gdp.Hash][]gdp.Hash
 	logicalEnds   map[gdp.Hash]bool
+
+	// first error returned by the view, see Err
+	err error
 }
 
 // MT: all methods of a Snapshot instance are not safe for multithreading
 // The expectation is that at any time a snapshot is used by only one
 // thread.
 
+// newSnapshot creates a snapshot of view with its digest
+func newSnapshot(
+	view SnapshotView,
+	logicalStarts map[gdp.Hash][]gdp.Hash,
+	logicalEnds map[gdp.Hash]bool,
+) *Snapshot {
+	return &Snapshot{
+		view:          view,
+		newRecords:    make(map[gdp.Hash]gdp.Hash),
+		newNext:       make(map[gdp.Hash][]gdp.Hash),
+		logicalStarts: logicalStarts,
+		logicalEnds:   logicalEnds,
+	}
+}
+
+// release closes the view of the snapshot
+func (s *Snapshot) release() {
+	err := s.view.Close()
+	if err != nil {
+		zap.S().Errorw(
+			"Failed to release snapshot",
+			"error", err,
+		)
+	}
+}
+
+// Err returns the first error the view returned to the snapshot.
+// Once it is set, queries of the snapshot return incomplete results and
+// its digest may be stale, so the snapshot should be discarded.
+func (s *Snapshot) Err() error {
+	return s.err
+}
+
+// fail records err as the error of the snapshot
+func (s *Snapshot) fail(err error) {
+	if s.err == nil {
+		s.err = err
+	}
+}
+
 // save a record's hash in the snapshot to mark its existence and update
-// the snapshot digest
+// the snapshot digest. Records already in the snapshot are ignored.
 func (s *Snapshot) RegisterNewRecord(id gdp.Hash, prev gdp.Hash) {
-	s.newRecords[id] = true
+	if s.ExistRecord(id) {
+		return
+	}
+	s.newRecords[id] = prev
+	s.newNext[prev] = append(s.newNext[prev], id)
 
 	// If prev is not in the map, this record is a new logical start
 	if !s.ExistRecord(prev) {
-		s.logicalStarts[prev] = append(s.logicalStarts[id], prev)
+		s.logicalStarts[prev] = append(s.logicalStarts[prev], id)
 	}
 
-	// If no record has prevHash as id, this record is a new logical end
-	metadata, err := s.logServer.FindNextRecords(id)
-	if err != nil {
-		panic(err) // TODO
-	}
+	// Records following this one are no longer logical starts, and
+	// the record before it no longer a logical end
+	delete(s.logicalStarts, id)
+	delete(s.logicalEnds, prev)
 
-	if metadata == nil || len(metadata) == 0 {
+	// If no record has prevHash as id, this record is a new logical end
+	if len(s.nextRecords(id)) == 0 && s.err == nil {
 		s.logicalEnds[id] = true
 	}
 }
@@ -82,39 +143,58 @@ func (snapshot *Snapshot) GetLogicalBegins() []gdp.Hash {
 }
 
 // check the existence of a record hash in the snapshot
+// returns false on errors, see Err
 func (s *Snapshot) ExistRecord(id gdp.Hash) bool {
-	exist, err := s.logServer.CheckRecordExistence(s.time, id)
+	_, exist := s.prevRecord(id)
+	return exist
+}
+
+// prevRecord returns the PrevHash of a record in the snapshot, and
+// false if the record is not in the snapshot or on errors
+func (s *Snapshot) prevRecord(id gdp.Hash) (gdp.Hash, bool) {
+	if prev, ok := s.newRecords[id]; ok {
+		return prev, true
+	}
+
+	metadata, err := s.view.ReadMetadata([]gdp.Hash{id})
 	if err != nil {
-		panic(err) // TODO
+		s.fail(err)
+		return gdp.NullHash, false
 	}
+	if len(metadata) == 0 {
+		return gdp.NullHash, false
+	}
+	return metadata[0].PrevHash, true
+}
 
-	if exist {
-		return true
-	} else {
-		_, ok := s.newRecords[id]
-		return ok
+// nextRecords returns the records in the snapshot that have
+// PrevHash = id
+func (s *Snapshot) nextRecords(id gdp.Hash) []gdp.Hash {
+	metadata, err := s.view.FindNextRecords(id)
+	if err != nil {
+		s.fail(err)
+		return nil
+	}
+
+	next := make([]gdp.Hash, 0, len(metadata)+len(s.newNext[id]))
+	for _, m := range metadata {
+		next = append(next, m.Hash)
 	}
+	return append(next, s.newNext[id]...)
 }
 
 // search ahead & search after like utils in graph diff policy utils
 // Return:
 //   a list of hash addresses visited, not including start or terminals
 //   a list of begins / ends in local graph reached
+// The search stops at the first error, see Err
 func (s *Snapshot) SearchAhead(start gdp.Hash, terminals []gdp.Hash) ([]gdp.Hash, []gdp.Hash) {
 	terminalMap := gdp.InitSet(terminals)
 
+	// as in SimpleGraph, records starting a log point to no record
 	queryer := func(id gdp.Hash) (gdp.Hash, bool) {
-		metadata, err := s.logServer.ReadMetadata([]gdp.Hash{id})
-		if err != nil {
-			panic(err) // TODO
-		}
-
-		if metadata == nil || len(metadata) == 0 ||
-			s.ExistRecord(metadata[0].Hash) {
-			return gdp.NullHash, false
-		} else {
-			return metadata[0].PrevHash, true
-		}
+		prev, ok := s.prevRecord(id)
+		return prev, ok && prev != gdp.NullHash
 	}
 
 	return gdp.SearchAhead(start, terminalMap, queryer)
@@ -124,23 +204,8 @@ func (s *Snapshot) SearchAfter(start gdp.Hash, terminals []gdp.Hash) ([]gdp.Hash
 	terminalMap := gdp.InitSet(terminals)
 
 	queryer := func(id gdp.Hash) ([]gdp.Hash, bool) {
-		metadata, err := s.logServer.FindNextRecords(id)
-		if err != nil {
-			panic(err) // TODO
-		}
-
-		if metadata == nil || len(metadata) == 0 {
-			return nil, false
-		} else {
-			var result []gdp.Hash
-			for _, m := range metadata {
-				if s.ExistRecord(m.Hash) {
-					result = append(result, m.Hash)
-				}
-			}
-
-			return result, true
-		}
+		next := s.nextRecords(id)
+		return next, len(next) > 0
 	}
 
 	return gdp.SearchAfter(start, terminalMap, queryer)
@@ -0,0 +1,193 @@
+package logserver
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+var errBrokenDB = errors.New("database is broken")
+
+// brokenView fails all queries used by snapshots
+type brokenView struct{}
+
+func (brokenView) ReadMetadata([]gdp.Hash) ([]gdp.Metadatum, error) {
+	return nil, errBrokenDB
+}
+
+func (brokenView) FindNextRecords(gdp.Hash) ([]gdp.Metadatum, error) {
+	return nil, errBrokenDB
+}
+
+func (brokenView) Close() error {
+	return nil
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	snapshot := newSnapshot(
+		brokenView{},
+		make(map[gdp.Hash][]gdp.Hash),
+		make(map[gdp.Hash]bool),
+	)
+	hash := gdp.GenerateHash("record")
+
+	assert.False(t, snapshot.ExistRecord(hash))
+	assert.Equal(t, errBrokenDB, snapshot.Err())
+
+	snapshot.RegisterNewRecord(hash, gdp.NullHash)
+	visited, _ := snapshot.SearchAhead(hash, nil)
+	assert.Empty(t, visited)
+	visited, _ = snapshot.SearchAfter(hash, nil)
+	assert.Empty(t, visited)
+	assert.Equal(t, errBrokenDB, snapshot.Err())
+}
+
+// chainRecord returns a record named name following the record named
+// prev, or starting a chain if prev is empty
+func chainRecord(name, prev string) gdp.Record {
+	record := testRecord(name)
+	if prev != "" {
+		record.PrevHash = gdp.GenerateHash(prev)
+	}
+	return record
+}
+
+func hashes(names ...string) []gdp.Hash {
+	result := make([]gdp.Hash, 0, len(names))
+	for _, name := range names {
+		result = append(result, gdp.GenerateHash(name))
+	}
+	return result
+}
+
+func assertDigest(t *testing.T, server *SqliteServer, begins, ends []gdp.Hash) {
+	snapshot, err := server.CreateSnapshot()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer server.DestroySnapshot(snapshot)
+	assert.ElementsMatch(t, begins, snapshot.GetLogicalBegins())
+	assert.ElementsMatch(t, ends, snapshot.GetLogicalEnds())
+}
+
+func TestSnapshotDigest(t *testing.T) {
+	db := openTestDB(t)
+
+	// Digest of records held before the migration
+	_, err := db.Exec(`CREATE TABLE log_entry (
+		hash BLOB(32), recno INTEGER, timestamp INTEGER, accuracy FLOAT,
+		prevhash BLOB(32), value BLOB, sig BLOB)`)
+	assert.Nil(t, err)
+	a0 := chainRecord("a0", "")
+	_, err = db.Exec("INSERT INTO log_entry VALUES (?, 0, 0, 0, ?, ?, ?)",
+		a0.Hash[:], a0.PrevHash[:], a0.Value, a0.Sig)
+	assert.Nil(t, err)
+
+	server, err := NewSqliteServer(db)
+	assert.Nil(t, err)
+	assertDigest(t, server, hashes("a0"), hashes("a0"))
+
+	// a0 <- a1 <- a2, a1 <- a3 and b1 whose previous record is missing
+	_, err = server.WriteRecords([]gdp.Record{
+		chainRecord("a2", "a1"),
+		chainRecord("a1", "a0"),
+		chainRecord("a3", "a1"),
+		chainRecord("b1", "b0"),
+	})
+	assert.Nil(t, err)
+	assertDigest(t, server, hashes("a0", "b1"), hashes("a2", "a3", "b1"))
+
+	_, err = server.WriteRecords([]gdp.Record{chainRecord("b0", "")})
+	assert.Nil(t, err)
+	assertDigest(t, server, hashes("a0", "b0"), hashes("a2", "a3", "b1"))
+
+	// Deletes, e.g. by the benchmark tools
+	b0 := gdp.GenerateHash("b0")
+	_, err = db.Exec("DELETE FROM log_entry WHERE hash = ?", b0[:])
+	assert.Nil(t, err)
+	assertDigest(t, server, hashes("a0", "b1"), hashes("a2", "a3", "b1"))
+
+	a3 := gdp.GenerateHash("a3")
+	_, err = db.Exec("DELETE FROM log_entry WHERE hash = ?", a3[:])
+	assert.Nil(t, err)
+	assertDigest(t, server, hashes("a0", "b1"), hashes("a2", "b1"))
+
+	_, err = db.Exec("DELETE FROM log_entry")
+	assert.Nil(t, err)
+	_, err = server.WriteRecords([]gdp.Record{chainRecord("c0", "")})
+	assert.Nil(t, err)
+	assertDigest(t, server, hashes("c0"), hashes("c0"))
+}
+
+func TestSnapshotRegisterNewRecords(t *testing.T) {
+	server, err := NewSqliteServer(openTestDB(t))
+	assert.Nil(t, err)
+	_, err = server.WriteRecords([]gdp.Record{chainRecord("a0", ""), chainRecord("a2", "a1")})
+	assert.Nil(t, err)
+
+	snapshot, err := server.CreateSnapshot()
+	assert.Nil(t, err)
+	defer server.DestroySnapshot(snapshot)
+
+	// Records written after the snapshot are registered by the policy
+	records := []gdp.Record{chainRecord("a1", "a0"), chainRecord("b0", "")}
+	_, err = server.WriteRecords(records)
+	assert.Nil(t, err)
+	snapshot.RegisterNewRecords(records)
+
+	assert.Nil(t, snapshot.Err())
+	assert.ElementsMatch(t, hashes("a0", "b0"), snapshot.GetLogicalBegins())
+	assert.ElementsMatch(t, hashes("a2", "b0"), snapshot.GetLogicalEnds())
+}
+
+func TestSnapshotIsolation(t *testing.T) {
+	db := openTestDB(t)
+	server, err := NewSqliteServer(db)
+	assert.Nil(t, err)
+	_, err = server.WriteRecords([]gdp.Record{
+		chainRecord("a0", ""),
+		chainRecord("a1", "a0"),
+		chainRecord("a2", "a1"),
+	})
+	assert.Nil(t, err)
+
+	snapshot, err := server.CreateSnapshot()
+	assert.Nil(t, err)
+	defer server.DestroySnapshot(snapshot)
+
+	// Writes and deletes after the snapshot are not seen, even if rowids
+	// are reused
+	a1 := gdp.GenerateHash("a1")
+	_, err = db.Exec("DELETE FROM log_entry WHERE hash = ?", a1[:])
+	assert.Nil(t, err)
+	_, err = server.WriteRecords([]gdp.Record{chainRecord("a3", "a2"), chainRecord("b0", "")})
+	assert.Nil(t, err)
+
+	assert.True(t, snapshot.ExistRecord(a1))
+	assert.False(t, snapshot.ExistRecord(gdp.GenerateHash("a3")))
+
+	visited, begins := snapshot.SearchAhead(gdp.GenerateHash("a2"), nil)
+	assert.Equal(t, hashes("a1"), visited)
+	assert.Equal(t, hashes("a0"), begins)
+
+	visited, ends := snapshot.SearchAfter(gdp.GenerateHash("a0"), nil)
+	assert.Equal(t, hashes("a1", "a2"), visited)
+	assert.Equal(t, hashes("a2"), ends)
+
+	// Records registered by the policy are seen
+	snapshot.RegisterNewRecord(gdp.GenerateHash("a3"), gdp.GenerateHash("a2"))
+	visited, ends = snapshot.SearchAfter(gdp.GenerateHash("a0"), nil)
+	assert.Equal(t, hashes("a1", "a2", "a3"), visited)
+	assert.Equal(t, hashes("a3"), ends)
+	assert.ElementsMatch(t, hashes("a3"), snapshot.GetLogicalEnds())
+	assert.Nil(t, snapshot.Err())
+
+	// A new snapshot sees the log as of now
+	current, err := server.CreateSnapshot()
+	assert.Nil(t, err)
+	defer server.DestroySnapshot(current)
+	assert.False(t, current.ExistRecord(a1))
+	assert.ElementsMatch(t, hashes("a0", "a2", "b0"), current.GetLogicalBegins())
+}
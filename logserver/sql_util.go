@@ -1,32 +1,11 @@
 package logserver
 
 import (
-	"fmt"
-
 	"database/sql"
 
 	"github.com/tonyyanga/gdp-replicate/gdp"
 )
 
-func hash2hex(id gdp.Hash) string {
-	return fmt.Sprintf("x'%X'", id)
-}
-
-func parseIntRows(rows *sql.Rows) ([]int64, error) {
-	var results []int64
-
-	for rows.Next() {
-		var row int64
-		err := rows.Scan(&row)
-		if err != nil {
-			return nil, err
-		}
-		results = append(results, row)
-	}
-
-	return results, nil
-}
-
 // parseRecordRows parses sql rows into Records.
 func parseRecordRows(rows *sql.Rows) ([]gdp.Record, error) {
 	var hashHolder []byte
@@ -93,3 +72,45 @@ func parseMetadataRows(rows *sql.Rows) ([]gdp.Metadatum, error) {
 	}
 	return metadata, nil
 }
+
+// parseHashRows parses sql rows of hashes
+func parseHashRows(rows *sql.Rows) ([]gdp.Hash, error) {
+	var hashHolder []byte
+	var hashes []gdp.Hash
+
+	for rows.Next() {
+		err := rows.Scan(&hashHolder)
+		if err != nil {
+			return nil, err
+		}
+
+		var hash gdp.Hash
+		copy(hash[:], hashHolder)
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// parseBeginRows parses sql rows of hash and prevhash into logical
+// starts, mapping from PrevHash to the hashes of records
+func parseBeginRows(rows *sql.Rows) (map[gdp.Hash][]gdp.Hash, error) {
+	var hashHolder []byte
+	var prevHashHolder []byte
+	starts := make(map[gdp.Hash][]gdp.Hash)
+
+	for rows.Next() {
+		err := rows.Scan(&hashHolder, &prevHashHolder)
+		if err != nil {
+			return nil, err
+		}
+
+		var hash, prevHash gdp.Hash
+		copy(hash[:], hashHolder)
+
+		// Previous hashes may not be populated
+		copy(prevHash[:], prevHashHolder)
+
+		starts[prevHash] = append(starts[prevHash], hash)
+	}
+	return starts, nil
+}
@@ -1,225 +1,136 @@
 package logserver
 
 import (
+	"bytes"
 	"database/sql"
-	"fmt"
-	"strings"
+	"errors"
+	"time"
 
+	"github.com/mattn/go-sqlite3"
 	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/metrics"
 	"go.uber.org/zap"
 )
 
+var errUnexpectedQueryResult = errors.New("unexpected query result")
+
 // SqliteServer implements SnapshotLogServer interface
-// time is represented as rowid, a builtin column of sqlite
-// snapshot time is inclusive of exact record at time
+// snapshots are read transactions of sqlite, see CreateSnapshot
 type SqliteServer struct {
-	db          *sql.DB
-	getMetadata *sql.Stmt // Prepared stmt for single item query
+	db    *sql.DB
+	stmts *stmtCache
 }
 
-func NewSqliteServer(db *sql.DB) *SqliteServer {
-	getMetadata, err := db.Prepare("SELECT hash, recno, timestamp, accuracy, prevhash, sig FROM log_entry WHERE hash = ?")
+// NewSqliteServer creates a SqliteServer for the log in db, creating or
+// migrating its schema first, see Migrate. db is switched to WAL mode.
+func NewSqliteServer(db *sql.DB) (*SqliteServer, error) {
+	// Readers do not block writers in WAL mode, so snapshots can hold
+	// their read transaction open, see CreateSnapshot
+	_, err := db.Exec("PRAGMA journal_mode = WAL")
 	if err != nil {
-		panic(err)
-	}
-	return &SqliteServer{
-		db:          db,
-		getMetadata: getMetadata,
+		return nil, err
 	}
-}
 
-func (s *SqliteServer) CreateSnapshot() (*Snapshot, error) {
-	// Use a readonly transaction to get logicalStarts and logicalEnds
-	tx, err := s.db.Begin()
+	err = Migrate(db)
 	if err != nil {
 		return nil, err
 	}
 
-	// We don't write to the db, so we rollback as always
-	defer func() { tx.Rollback() }()
+	return &SqliteServer{
+		db:    db,
+		stmts: newStmtCache(db),
+	}, nil
+}
 
-	queryString := "SELECT max(rowid) from log_entry"
-	rows, err := tx.Query(queryString)
+// CreateSnapshot creates a snapshot of the log as of now. Its view is a
+// read transaction held open until DestroySnapshot, which sees the
+// database as of its first read regardless of later writes and deletes.
+func (s *SqliteServer) CreateSnapshot() (*Snapshot, error) {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return nil, err
 	}
 
-	rowids, err := parseIntRows(rows)
+	snapshot, err := s.createSnapshot(tx)
 	if err != nil {
+		tx.Rollback()
 		return nil, err
 	}
+	return snapshot, nil
+}
 
-	if len(rowids) != 1 {
-		panic("Unexpected max row id from query")
-	}
-
-	maxRowId := rowids[0]
-
-	// Logical starts
-	queryString = `
-    SELECT hash, recno, timestamp, accuracy, prevhash, sig
-    FROM log_entry
-    WHERE NOT hash IN
-        (SELECT log1.hash as hash
-         FROM log_entry log1
-         JOIN log_entry log2
-         ON log1.prevhash = log2.hash
-        )`
-
-	rows, err = tx.Query(queryString)
+// createSnapshot reads the digest of the log in tx, which starts the
+// read transaction of the snapshot
+func (s *SqliteServer) createSnapshot(tx *sql.Tx) (*Snapshot, error) {
+	// The digest is maintained by triggers, see createDigest
+	rows, err := tx.Query("SELECT hash, prevhash FROM log_begin")
 	if err != nil {
 		return nil, err
 	}
 
-	startsMetadata, err := parseMetadataRows(rows)
+	starts, err := parseBeginRows(rows)
 	if err != nil {
 		return nil, err
 	}
 
-	starts := make(map[gdp.Hash][]gdp.Hash)
-	for _, meta := range startsMetadata {
-		starts[meta.Hash] = []gdp.Hash{meta.PrevHash}
-	}
-
-	queryString = `
-    SELECT hash, recno, timestamp, accuracy, prevhash, sig
-    FROM log_entry
-    WHERE NOT hash IN
-        (SELECT log2.hash as hash
-         FROM log_entry log1
-         JOIN log_entry log2
-         ON log1.prevhash = log2.hash
-        )`
-
-	rows, err = tx.Query(queryString)
+	rows, err = tx.Query("SELECT hash FROM log_end")
 	if err != nil {
 		return nil, err
 	}
 
-	endsMetadata, err := parseMetadataRows(rows)
+	endHashes, err := parseHashRows(rows)
 	if err != nil {
 		return nil, err
 	}
 
 	ends := make(map[gdp.Hash]bool)
-	for _, meta := range endsMetadata {
-		ends[meta.Hash] = true
+	for _, hash := range endHashes {
+		ends[hash] = true
 	}
 
-	return &Snapshot{
-		time:          maxRowId,
-		logServer:     s,
-		newRecords:    make(map[gdp.Hash]bool),
-		logicalStarts: starts,
-		logicalEnds:   ends,
-	}, nil
+	return newSnapshot(&sqliteView{tx: tx, stmts: s.stmts.inTx(tx)}, starts, ends), nil
 }
 
-func (s *SqliteServer) DestroySnapshot(*Snapshot) {}
+func (s *SqliteServer) DestroySnapshot(snapshot *Snapshot) {
+	snapshot.release()
+}
 
-func (s *SqliteServer) CheckRecordExistence(time int64, id gdp.Hash) (bool, error) {
-	hexHash := hash2hex(id)
+// sqliteView is the view of a snapshot of SqliteServer
+type sqliteView struct {
+	tx *sql.Tx
 
-	queryString := fmt.Sprintf(
-		"SELECT count(*) FROM log_entry WHERE hash = %s and rowid <= %d",
-		hexHash,
-		time,
-	)
-	rows, err := s.db.Query(queryString)
-	if err != nil {
-		return false, err
-	}
+	// the statements of tx
+	stmts *stmtCache
+}
 
-	cnt, err := parseIntRows(rows)
-	if err != nil {
-		return false, err
-	}
-	if len(cnt) != 1 {
-		panic("Unexpected count from query")
-	}
+func (view *sqliteView) ReadMetadata(hashes []gdp.Hash) ([]gdp.Metadatum, error) {
+	return readMetadata(view.stmts, hashes)
+}
 
-	return cnt[0] > 0, nil
+func (view *sqliteView) FindNextRecords(id gdp.Hash) ([]gdp.Metadatum, error) {
+	return findNextRecords(view.stmts, id)
+}
+
+// Close ends the read transaction, nothing was written
+func (view *sqliteView) Close() error {
+	return view.tx.Rollback()
 }
 
 // ReadRecords will retrieive the metadat of records with specified
 // hashes from the database.
 func (s *SqliteServer) ReadMetadata(hashes []gdp.Hash) ([]gdp.Metadatum, error) {
-	if len(hashes) == 0 {
-		return nil, nil
-	}
-
-	hexHashes := make([]string, 0, len(hashes))
-	for _, hash := range hashes {
-		hexHashes = append(hexHashes, hash2hex(hash))
-	}
-
-	var rows *sql.Rows
-	var err error
-	if len(hexHashes) != 1 {
-		queryString := fmt.Sprintf(
-			"SELECT hash, recno, timestamp, accuracy, prevhash, sig FROM log_entry WHERE hash IN (%s)",
-			strings.Join(hexHashes, ","),
-		)
-		rows, err = s.db.Query(queryString)
-	} else {
-		// Use prepared statement
-		rows, err = s.getMetadata.Query(hexHashes[0])
-	}
-	if err != nil {
-		return nil, err
-	}
-
-	return parseMetadataRows(rows)
+	return readMetadata(s.stmts, hashes)
 }
 
 // ReadRecords will retrieive the records with specified hashes from
 // the database.
 func (s *SqliteServer) ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error) {
-	if len(hashes) == 0 {
-		return nil, nil
-	}
-
-	hexHashes := make([]string, 0, len(hashes))
-	for _, hash := range hashes {
-		hexHashes = append(hexHashes, hash2hex(hash))
-	}
-
-	queryString := fmt.Sprintf(
-		"SELECT hash, recno, timestamp, accuracy, prevhash, value, sig FROM log_entry WHERE hash IN (%s)",
-		strings.Join(hexHashes, ","),
-	)
-	rows, err := s.db.Query(queryString)
-	if err != nil {
-		return nil, err
-	}
-
-	records, err := parseRecordRows(rows)
-	if err != nil {
-		return nil, err
-	}
-
-	return records, nil
+	return readRecords(s.stmts, hashes)
 }
 
 // SearchableLogServer interface
 func (s *SqliteServer) FindNextRecords(id gdp.Hash) ([]gdp.Metadatum, error) {
-	hexHash := hash2hex(id)
-
-	queryString := fmt.Sprintf(
-		"SELECT hash, recno, timestamp, accuracy, prevhash, sig FROM log_entry WHERE prevhash = %s",
-		hexHash,
-	)
-	rows, err := s.db.Query(queryString)
-	if err != nil {
-		return nil, err
-	}
-
-	metadata, err := parseMetadataRows(rows)
-	if err != nil {
-		return nil, err
-	}
-
-	return metadata, nil
+	return findNextRecords(s.stmts, id)
 }
 
 // ReadAllRecords will retrieve all records from the database.
@@ -256,48 +167,135 @@ func (s *SqliteServer) ReadAllRecords() ([]gdp.Record, error) {
 	return records, nil
 }
 
-// WriteRecords will write all records to the database.
-func (s *SqliteServer) WriteRecords(records []gdp.Record) error {
+// WriteRecords writes the records not held yet to the database, in one
+// transaction. Records are compared to the record held with the same
+// hash, if any, so resent records do not fail the batch.
+func (s *SqliteServer) WriteRecords(records []gdp.Record) ([]WriteResult, error) {
 	if len(records) == 0 {
-		return nil
+		return nil, nil
 	}
+	start := time.Now()
 
 	tx, err := s.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback()
 
-	stmt, err := tx.Prepare("INSERT INTO log_entry (hash, recno, timestamp, accuracy, prevhash, value, sig) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	// Inserting first takes the write lock of the database at once, as
+	// a transaction upgrading from a read lock fails with SQLITE_BUSY
+	// when another one is writing
+	insert, err := s.stmts.get(`
+    INSERT INTO log_entry (hash, recno, timestamp, accuracy, prevhash, value, sig)
+    SELECT ?1, ?2, ?3, ?4, ?5, ?6, ?7
+    WHERE NOT EXISTS (SELECT 1 FROM log_entry WHERE hash = ?1)`)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	insert = tx.Stmt(insert)
+	defer insert.Close()
+
+	lookup, err := s.stmts.get("SELECT hash, recno, timestamp, accuracy, prevhash, value, sig FROM log_entry WHERE hash = ?")
+	if err != nil {
+		return nil, err
 	}
-	defer stmt.Close()
-	for _, record := range records {
-		_, err = stmt.Exec(
-			record.Hash[:],
-			record.RecNo,
-			record.Timestamp,
-			record.Accuracy,
-			record.PrevHash[:],
-			record.Value,
-			record.Sig,
-		)
+	lookup = tx.Stmt(lookup)
+	defer lookup.Close()
+
+	results := make([]WriteResult, 0, len(records))
+	for i := range records {
+		result, err := writeRecord(insert, lookup, &records[i])
 		if err != nil {
-			return err
+			return nil, err
 		}
-
+		results = append(results, result)
 	}
 
 	err = tx.Commit()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	metrics.WriteDuration.Observe(metrics.Since(start))
+
+	counts := make(map[WriteStatus]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	for status, count := range counts {
+		metrics.RecordsWritten.WithLabelValues(status.String()).Add(float64(count))
 	}
 
 	zap.S().Infow(
 		"Wrote records",
 		"numRecords", len(records),
+		"inserted", counts[Inserted],
+		"duplicate", counts[Duplicate],
+		"conflict", counts[Conflict],
+		"rejected", counts[Rejected],
 	)
 
-	return nil
+	return results, nil
+}
+
+// writeRecord inserts record unless a record with its hash is held.
+// Returns an error only if the transaction can not go on.
+func writeRecord(insert, lookup *sql.Stmt, record *gdp.Record) (WriteResult, error) {
+	result := WriteResult{Hash: record.Hash}
+
+	inserted, err := insert.Exec(
+		record.Hash[:],
+		record.RecNo,
+		record.Timestamp,
+		record.Accuracy,
+		record.PrevHash[:],
+		record.Value,
+		record.Sig,
+	)
+	if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.Code == sqlite3.ErrConstraint {
+		// a failed statement is undone without aborting the transaction
+		result.Status = Rejected
+		result.Err = err
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	count, err := inserted.RowsAffected()
+	if err != nil {
+		return result, err
+	}
+	if count > 0 {
+		result.Status = Inserted
+		return result, nil
+	}
+
+	rows, err := lookup.Query(record.Hash[:])
+	if err != nil {
+		return result, err
+	}
+	held, err := parseRecordRows(rows)
+	if err != nil {
+		return result, err
+	}
+	if len(held) == 0 {
+		return result, errUnexpectedQueryResult
+	}
+
+	if sameRecord(&held[0], record) {
+		result.Status = Duplicate
+	} else {
+		result.Status = Conflict
+	}
+	return result, nil
+}
+
+// sameRecord compares the contents of records with the same hash
+func sameRecord(a, b *gdp.Record) bool {
+	return a.RecNo == b.RecNo &&
+		a.Timestamp == b.Timestamp &&
+		a.Accuracy == b.Accuracy &&
+		a.PrevHash == b.PrevHash &&
+		bytes.Equal(a.Value, b.Value) &&
+		bytes.Equal(a.Sig, b.Sig)
 }
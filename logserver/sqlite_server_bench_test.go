@@ -0,0 +1,192 @@
+package logserver
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
+)
+
+// benchRecords is the size of the logs benchmarked
+const benchRecords = 100000
+
+// benchLog creates a log of benchRecords chained records and returns
+// its server and the hashes of its records
+func benchLog(b *testing.B) (*SqliteServer, []gdp.Hash) {
+	db, err := sql.Open("sqlite3", filepath.Join(b.TempDir(), "log.db"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	server, err := NewSqliteServer(db)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	records := gdptest.Chain("record", benchRecords)
+	hashes := make([]gdp.Hash, 0, benchRecords)
+	for _, record := range records {
+		hashes = append(hashes, record.Hash)
+	}
+
+	_, err = server.WriteRecords(records)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return server, hashes
+}
+
+// spread returns n hashes spread over hashes
+func spread(hashes []gdp.Hash, n int) []gdp.Hash {
+	step := len(hashes) / n
+	result := make([]gdp.Hash, 0, n)
+	for i := 0; i < n; i++ {
+		result = append(result, hashes[i*step])
+	}
+	return result
+}
+
+// hexReadMetadata is ReadMetadata before queries were parameterized,
+// with hashes as hex literals in one IN list
+func hexReadMetadata(db *sql.DB, hashes []gdp.Hash) ([]gdp.Metadatum, error) {
+	hexHashes := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		hexHashes = append(hexHashes, fmt.Sprintf("x'%X'", hash))
+	}
+
+	rows, err := db.Query(fmt.Sprintf(
+		"SELECT hash, recno, timestamp, accuracy, prevhash, sig FROM log_entry WHERE hash IN (%s)",
+		strings.Join(hexHashes, ","),
+	))
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadataRows(rows)
+}
+
+// hexFindNextRecords is FindNextRecords before queries were
+// parameterized
+func hexFindNextRecords(db *sql.DB, id gdp.Hash) ([]gdp.Metadatum, error) {
+	rows, err := db.Query(fmt.Sprintf(
+		"SELECT hash, recno, timestamp, accuracy, prevhash, sig FROM log_entry WHERE prevhash = x'%X'",
+		id,
+	))
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadataRows(rows)
+}
+
+func BenchmarkReadMetadata(b *testing.B) {
+	server, hashes := benchLog(b)
+
+	for _, n := range []int{1, 100, 10000} {
+		wanted := spread(hashes, n)
+
+		b.Run(fmt.Sprintf("hex/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				metadata, err := hexReadMetadata(server.db, wanted)
+				if err != nil || len(metadata) != n {
+					b.Fatal(len(metadata), err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("params/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				metadata, err := server.ReadMetadata(wanted)
+				if err != nil || len(metadata) != n {
+					b.Fatal(len(metadata), err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkFindNextRecords(b *testing.B) {
+	server, hashes := benchLog(b)
+	starts := spread(hashes[:len(hashes)-1], 1000)
+
+	b.Run("hex", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := hexFindNextRecords(server.db, starts[i%len(starts)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("params", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := server.FindNextRecords(starts[i%len(starts)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// rebindFindNextRecords is FindNextRecords of a snapshot before
+// statements were cached per transaction, binding the statement to tx
+// on every query
+func rebindFindNextRecords(server *SqliteServer, tx *sql.Tx, id gdp.Hash) ([]gdp.Metadatum, error) {
+	stmt, err := server.stmts.get("SELECT hash, recno, timestamp, accuracy, prevhash, sig FROM log_entry WHERE prevhash = ?")
+	if err != nil {
+		return nil, err
+	}
+	stmt = tx.Stmt(stmt)
+	defer stmt.Close()
+
+	rows, err := stmt.Query(id[:])
+	if err != nil {
+		return nil, err
+	}
+	return parseMetadataRows(rows)
+}
+
+func BenchmarkSnapshot(b *testing.B) {
+	server, hashes := benchLog(b)
+	starts := spread(hashes[:len(hashes)-1], 1000)
+
+	snapshot, err := server.CreateSnapshot()
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer server.DestroySnapshot(snapshot)
+	view := snapshot.view.(*sqliteView)
+
+	b.Run("rebind", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := rebindFindNextRecords(server, view.tx, starts[i%len(starts)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			_, err := view.FindNextRecords(starts[i%len(starts)])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// SearchAfter queries the view once per record, here 100 records
+	// per search
+	b.Run("search", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			start := (i * 100) % (len(hashes) - 100)
+			snapshot.SearchAfter(hashes[start], []gdp.Hash{hashes[start+100]})
+			if snapshot.Err() != nil {
+				b.Fatal(snapshot.Err())
+			}
+		}
+	})
+}
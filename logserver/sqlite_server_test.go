@@ -16,7 +16,10 @@ func TestSqliteReadRecords(t *testing.T) {
 	db, err := sql.Open("sqlite3", dbFile)
 	assert.Nil(t, err)
 
-	s := NewSqliteServer(db)
+	s, err := NewSqliteServer(db)
+	if !assert.Nil(t, err) {
+		return
+	}
 	logServerTest(t, s)
 
 }
@@ -88,9 +91,102 @@ func testWriting(t *testing.T, logServer LogServer) {
 		},
 	}
 
-	assert.Nil(t, logServer.WriteRecords(records))
+	_, err = logServer.WriteRecords(records)
+	assert.Nil(t, err)
 
 	metadata, err = logServer.ReadAllMetadata()
 	assert.Nil(t, err)
 	assert.Equal(t, numRecords+2, len(metadata))
 }
+
+func testRecord(name string) gdp.Record {
+	return gdp.Record{
+		Metadatum: gdp.Metadatum{
+			Hash: gdp.GenerateHash(name),
+			Sig:  []byte{},
+		},
+		Value: []byte(name),
+	}
+}
+
+func writeStatuses(results []WriteResult) []WriteStatus {
+	statuses := make([]WriteStatus, 0, len(results))
+	for _, result := range results {
+		statuses = append(statuses, result.Status)
+	}
+	return statuses
+}
+
+func TestWriteRecords(t *testing.T) {
+	db := openTestDB(t)
+
+	// A table created by another tool, refusing negative record numbers
+	_, err := db.Exec(`CREATE TABLE log_entry (
+		hash BLOB(32), recno INTEGER CHECK (recno >= 0), timestamp INTEGER,
+		accuracy FLOAT, prevhash BLOB(32), value BLOB, sig BLOB)`)
+	assert.Nil(t, err)
+	server, err := NewSqliteServer(db)
+	assert.Nil(t, err)
+
+	a, b, c := testRecord("a"), testRecord("b"), testRecord("c")
+	results, err := server.WriteRecords([]gdp.Record{a, b, a})
+	assert.Nil(t, err)
+	assert.Equal(t, []WriteStatus{Inserted, Inserted, Duplicate}, writeStatuses(results))
+
+	// Resent records do not fail the batch
+	conflicting := testRecord("a")
+	conflicting.Value = []byte("forged")
+	invalid := testRecord("invalid")
+	invalid.RecNo = -1
+	records := []gdp.Record{b, conflicting, invalid, c}
+
+	results, err = server.WriteRecords(records)
+	assert.Nil(t, err)
+	assert.Equal(t, []WriteStatus{Duplicate, Conflict, Rejected, Inserted}, writeStatuses(results))
+	assert.Equal(t, invalid.Hash, results[2].Hash)
+	assert.NotNil(t, results[2].Err)
+	assert.Equal(t, []gdp.Record{c}, InsertedRecords(records, results))
+
+	// Conflicting records keep the record held
+	held, err := server.ReadAllRecords()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []gdp.Record{a, b, c}, held)
+}
+
+func TestReadManyRecords(t *testing.T) {
+	server, err := NewSqliteServer(openTestDB(t))
+	assert.Nil(t, err)
+
+	const n = 3*maxChunk + 10
+	records := make([]gdp.Record, 0, n)
+	for i := 0; i < n; i++ {
+		records = append(records, chainRecord(fmt.Sprint(i), fmt.Sprint(i-1)))
+	}
+	_, err = server.WriteRecords(records)
+	assert.Nil(t, err)
+
+	// Repeated and missing hashes are queried in chunks
+	wanted := make([]gdp.Hash, 0, 2*n)
+	for i := 0; i < n; i++ {
+		wanted = append(wanted, records[i].Hash, records[i].Hash, gdp.GenerateHash(fmt.Sprint("missing", i)))
+	}
+
+	read, err := server.ReadRecords(wanted)
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, records, read)
+
+	metadata, err := server.ReadMetadata(wanted)
+	assert.Nil(t, err)
+	assert.Len(t, metadata, n)
+
+	metadata, err = server.ReadMetadata(wanted[:1])
+	assert.Nil(t, err)
+	assert.Equal(t, []gdp.Metadatum{records[0].Metadatum}, metadata)
+
+	next, err := server.FindNextRecords(records[0].Hash)
+	assert.Nil(t, err)
+	assert.Equal(t, []gdp.Metadatum{records[1].Metadatum}, next)
+
+	// Statements are prepared once for each size of chunk
+	assert.True(t, len(server.stmts.stmts) <= 10, len(server.stmts.stmts))
+}
@@ -6,22 +6,25 @@ package main
 import "C"
 
 import (
-	"log"
-
 	"github.com/tonyyanga/gdp-replicate/daemon"
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/policy"
 	"go.uber.org/zap"
 )
 
-/* CreateLogSyncHandle creates the context for a log in the log server.
-   The returned LogSyncHandle manages the global sync status of this log. */
+/* CreateLogSyncHandle creates the context for a log in the log server
+   with the default policy, see CreateLogSyncHandleWithConfig.
+   The returned LogSyncHandle manages the global sync status of this log.
+
+   Return code is LOG_SYNC_OK or an error code, see LogSyncError.
+   On failure, the returned handle is only valid for GetLastError. */
 //export CreateLogSyncHandle
-func CreateLogSyncHandle(sqlFile string) (C.LogSyncHandle, C.int) {
-	ticket, err := newLogSyncCtx(sqlFile)
+func CreateLogSyncHandle(sqlFile string) (handle C.LogSyncHandle, code C.int) {
+	defer recoverPanic(nullTicket, &code)
+
+	ticket, err := newLogSyncCtx(sqlFile, defaultPolicy, policy.Options{}, nil)
 	if err != nil {
-		log.Printf("%v", err)
-		return C.LogSyncHandle{handleTicket: 0}, 1
+		return C.LogSyncHandle{handleTicket: 0}, fail(nullTicket, createFailure(err), err)
 	}
 
 	zap.S().Infow(
@@ -32,48 +35,66 @@ func CreateLogSyncHandle(sqlFile string) (C.LogSyncHandle, C.int) {
 
 	cTicket := *(*C.uint32_t)(&ticket)
 
-	return C.LogSyncHandle{handleTicket: cTicket}, 0
+	return C.LogSyncHandle{handleTicket: cTicket}, C.LOG_SYNC_OK
 }
 
 /* Call ReleaseLogSyncHandle to release corresponding memory in Go */
 //export ReleaseLogSyncHandle
 func ReleaseLogSyncHandle(handle C.LogSyncHandle) {
-	delete(logCtxMap, uint32(handle.handleTicket))
+	ticket := uint32(handle.handleTicket)
+
+	// there is no return code, panics are only reported by GetLastError
+	var code C.int
+	defer recoverPanic(ticket, &code)
+
+	releaseLogSyncCtx(ticket)
+	clearLastError(ticket)
 }
 
 /* Trigger a sync with a given peer
 
+   Return code is LOG_SYNC_OK or an error code, see LogSyncError.
+   C.Msg should not be used on errors, or if a callback is registered
+   with RegisterMsgCallback, which receives the message instead.
+
    Memory convention:
    Memory pointed to by the returned C.Msg data pointer should
    be freed by the caller.
 */
 //export InitSync
 func InitSync(handle C.LogSyncHandle, peer C.PeerAddr) (C.Msg, C.int) {
-	ctx, err := getLogSyncCtx(handle)
+	return initSync(uint32(handle.handleTicket), peerAddrToHash(peer))
+}
+
+// initSync implements InitSync with Go types
+func initSync(ticket HandleTicket, gdpAddr gdp.Hash) (cMsg C.Msg, code C.int) {
+	defer recoverPanic(ticket, &code)
+
+	ctx, err := getLogSyncCtx(ticket)
 	if err != nil {
-		// TODO
-		return C.Msg{}, 1
+		return C.Msg{}, fail(ticket, C.LOG_SYNC_ERR_INVALID_HANDLE, err)
 	}
 
-	gdpAddr := peerAddrToHash(peer)
-
 	policy := ctx.Policy
 	msg, err := policy.GenerateMessage(gdpAddr)
 	if err != nil {
-		// TODO
-		return C.Msg{}, 1
+		return C.Msg{}, fail(ticket, C.LOG_SYNC_ERR_POLICY, err)
 	}
 
-	return toCMsg(msg), 0
+	return ctx.sendMsg(ticket, gdpAddr, msg)
 }
 
 /* Provide an incoming message to the library to process
    This function releases data in msg.
 
    Return code:
-   0 = successful completion
-   1 = an error occurred, C.Msg should not be used
-   -1 = no message returned, C.Msg should not be used
+   LOG_SYNC_OK = successful completion
+   LOG_SYNC_NO_MSG = no message returned, C.Msg should not be used
+   any other code = an error occurred, C.Msg should not be used,
+                    see LogSyncError
+
+   If a callback is registered with RegisterMsgCallback, it receives
+   the message instead, and C.Msg should not be used.
 
    Memory convention:
    Memory pointed to by the pointer in the C.Msg provided is
@@ -83,29 +104,37 @@ func InitSync(handle C.LogSyncHandle, peer C.PeerAddr) (C.Msg, C.int) {
 */
 //export HandleMsg
 func HandleMsg(handle C.LogSyncHandle, peer C.PeerAddr, msg C.Msg) (C.Msg, C.int) {
+	return handleMsg(uint32(handle.handleTicket), peerAddrToHash(peer), msg)
+}
+
+// handleMsg implements HandleMsg with Go types
+func handleMsg(ticket HandleTicket, gdpAddr gdp.Hash, msg C.Msg) (cMsg C.Msg, code C.int) {
+	defer recoverPanic(ticket, &code)
+
 	completionErr := policy.ErrConversationFinished
 
-	ctx, err := getLogSyncCtx(handle)
+	ctx, err := getLogSyncCtx(ticket)
 	if err != nil {
-		// TODO
-		return C.Msg{}, 1
+		return C.Msg{}, fail(ticket, C.LOG_SYNC_ERR_INVALID_HANDLE, err)
 	}
 
-	gdpAddr := peerAddrToHash(peer)
+	goMsg, err := toGoMsg(msg)
+	if err != nil {
+		return C.Msg{}, fail(ticket, C.LOG_SYNC_ERR_DECODE, err)
+	}
 
 	policy := ctx.Policy
-	respMsg, err := policy.ProcessMessage(gdpAddr, toGoMsg(msg))
+	respMsg, err := policy.ProcessMessage(gdpAddr, goMsg)
 	if err != nil {
 		if err == completionErr {
 			// Policy completed
-			return C.Msg{}, -1
+			return C.Msg{}, C.LOG_SYNC_NO_MSG
 		} else {
-			// TODO
-			return C.Msg{}, 1
+			return C.Msg{}, fail(ticket, C.LOG_SYNC_ERR_POLICY, err)
 		}
 	}
 
-	return toCMsg(respMsg), 0
+	return ctx.sendMsg(ticket, gdpAddr, respMsg)
 }
 
 // empty main func required to compile to a shared library
@@ -0,0 +1,295 @@
+/*
+Package membership keeps track of the replicas of a cluster through
+gossip, so replicas can join, leave and fail without restarting the
+others.
+
+Every replica owns a heartbeat counter that it increments whenever it
+gossips. Replicas exchange the counters they know of, see Gossip, and
+keep the highest one of every member. A member whose counter has not
+increased for the fail timeout is considered dead, and forgotten after
+twice the fail timeout. A member that leaves gossips its departure
+with a higher counter, so it is removed without waiting for the
+timeout.
+
+Counters start from the time a replica starts, so a replica that
+restarts supersedes what is known about its previous run.
+*/
+package membership
+
+import (
+	"encoding/gob"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"go.uber.org/zap"
+)
+
+// State of a member
+type State int
+
+// States
+const (
+	// Alive members take part in replication
+	Alive State = iota
+
+	// Dead members stopped gossiping and are skipped
+	Dead
+
+	// Left members announced their departure
+	Left
+)
+
+func (state State) String() string {
+	switch state {
+	case Alive:
+		return "alive"
+	case Dead:
+		return "dead"
+	case Left:
+		return "left"
+	default:
+		return "unknown"
+	}
+}
+
+// Member is a replica of the cluster
+type Member struct {
+	// GDP address of the replica
+	Addr gdp.Hash
+
+	// Network address the replica listens on
+	Listen string
+
+	// Increases over the lifetime of the replica
+	Heartbeat uint64
+
+	State State
+}
+
+// Gossip is the view of the cluster sent by a replica
+type Gossip struct {
+	Members []Member
+}
+
+// DefaultFailTimeout is the default time after which a member that
+// stopped gossiping is considered dead
+const DefaultFailTimeout = 10 * time.Second
+
+// memberState is a member and the local time its counter last increased
+type memberState struct {
+	Member
+	updated time.Time
+}
+
+// Membership is the local view of the cluster. All methods are safe for
+// concurrent use.
+type Membership struct {
+	mutex   sync.Mutex
+	self    Member
+	members map[gdp.Hash]*memberState
+
+	failTimeout time.Duration
+
+	// notified of changes of members, outside of the mutex
+	handlers []func(Member)
+}
+
+func init() {
+	// Gossip travels as a gob encoded value between replicas
+	gob.Register(&Gossip{})
+}
+
+// New creates the view of the cluster of the replica at addr,
+// listening on listen
+func New(addr gdp.Hash, listen string) *Membership {
+	return &Membership{
+		self: Member{
+			Addr:      addr,
+			Listen:    listen,
+			Heartbeat: uint64(time.Now().UnixNano()),
+			State:     Alive,
+		},
+		members:     make(map[gdp.Hash]*memberState),
+		failTimeout: DefaultFailTimeout,
+	}
+}
+
+// SetFailTimeout sets the time after which a member that stopped
+// gossiping is considered dead
+func (m *Membership) SetFailTimeout(timeout time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.failTimeout = timeout
+}
+
+// OnChange registers a handler notified when a member joins, changes
+// its address, or changes state. Must be called before members are
+// added.
+func (m *Membership) OnChange(handler func(Member)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.handlers = append(m.handlers, handler)
+}
+
+// Join adds seeds, a map from GDP address to network address, as alive
+// members. Seeds are forgotten like other members if they never gossip.
+func (m *Membership) Join(seeds map[gdp.Hash]string) {
+	changed := make([]Member, 0, len(seeds))
+
+	m.mutex.Lock()
+	now := time.Now()
+	for addr, listen := range seeds {
+		if addr == m.self.Addr {
+			continue
+		}
+		if _, ok := m.members[addr]; ok {
+			continue
+		}
+		state := &memberState{
+			Member:  Member{Addr: addr, Listen: listen, State: Alive},
+			updated: now,
+		}
+		m.members[addr] = state
+		changed = append(changed, state.Member)
+	}
+	m.mutex.Unlock()
+
+	m.notify(changed)
+}
+
+// Leave announces that this replica leaves the cluster. The next
+// Gossip carries the announcement.
+func (m *Membership) Leave() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.self.Heartbeat++
+	m.self.State = Left
+}
+
+// Alive returns the GDP addresses of the alive members
+func (m *Membership) Alive() []gdp.Hash {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	alive := make([]gdp.Hash, 0, len(m.members))
+	for addr, state := range m.members {
+		if state.State == Alive {
+			alive = append(alive, addr)
+		}
+	}
+	return alive
+}
+
+// Members returns all known members, excluding this replica
+func (m *Membership) Members() []Member {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	members := make([]Member, 0, len(m.members))
+	for _, state := range m.members {
+		members = append(members, state.Member)
+	}
+	return members
+}
+
+// Gossip increments the counter of this replica and returns the view
+// to send to another replica. Dead members are left out, as they may
+// only be dead to this replica.
+func (m *Membership) Gossip() *Gossip {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.self.State == Alive {
+		m.self.Heartbeat++
+	}
+
+	members := make([]Member, 0, len(m.members)+1)
+	members = append(members, m.self)
+	for _, state := range m.members {
+		if state.State != Dead {
+			members = append(members, state.Member)
+		}
+	}
+	return &Gossip{Members: members}
+}
+
+// Merge updates the view with gossip received from another replica
+func (m *Membership) Merge(gossip *Gossip) {
+	changed := make([]Member, 0)
+
+	m.mutex.Lock()
+	now := time.Now()
+	for _, member := range gossip.Members {
+		if member.Addr == m.self.Addr {
+			continue
+		}
+
+		state, ok := m.members[member.Addr]
+		if !ok {
+			if member.State != Alive {
+				continue
+			}
+			state = &memberState{Member: member, updated: now}
+			m.members[member.Addr] = state
+			changed = append(changed, member)
+			continue
+		}
+
+		if member.Heartbeat <= state.Heartbeat {
+			continue
+		}
+		notify := member.State != state.State || member.Listen != state.Listen
+		state.Member = member
+		state.updated = now
+		if notify {
+			changed = append(changed, member)
+		}
+	}
+	m.mutex.Unlock()
+
+	m.notify(changed)
+}
+
+// Expire marks members that stopped gossiping as dead, and forgets
+// members dead or left for twice the fail timeout
+func (m *Membership) Expire() {
+	changed := make([]Member, 0)
+
+	m.mutex.Lock()
+	now := time.Now()
+	for addr, state := range m.members {
+		idle := now.Sub(state.updated)
+		if idle > 2*m.failTimeout && state.State != Alive {
+			delete(m.members, addr)
+		} else if idle > m.failTimeout && state.State == Alive {
+			state.State = Dead
+			changed = append(changed, state.Member)
+		}
+	}
+	m.mutex.Unlock()
+
+	m.notify(changed)
+}
+
+func (m *Membership) notify(changed []Member) {
+	if len(changed) == 0 {
+		return
+	}
+
+	m.mutex.Lock()
+	handlers := append([]func(Member){}, m.handlers...)
+	m.mutex.Unlock()
+
+	for _, member := range changed {
+		zap.S().Infow(
+			"member changed",
+			"member", member.Addr.Readable(),
+			"listen", member.Listen,
+			"state", member.State.String(),
+		)
+		for _, handler := range handlers {
+			handler(member)
+		}
+	}
+}
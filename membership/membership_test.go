@@ -0,0 +1,99 @@
+package membership
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// recorder collects the changes a Membership notifies
+type recorder struct {
+	mutex   sync.Mutex
+	changes []Member
+}
+
+func (r *recorder) record(member Member) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.changes = append(r.changes, member)
+}
+
+func (r *recorder) last() Member {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.changes[len(r.changes)-1]
+}
+
+func TestGossip(t *testing.T) {
+	a := New(gdp.GenerateHash("a"), "localhost:1")
+	b := New(gdp.GenerateHash("b"), "localhost:2")
+	c := New(gdp.GenerateHash("c"), "localhost:3")
+	changes := &recorder{}
+	c.OnChange(changes.record)
+
+	// a knows b, b knows c, c learns of a through b
+	a.Join(map[gdp.Hash]string{b.self.Addr: "localhost:2"})
+	b.Join(map[gdp.Hash]string{c.self.Addr: "localhost:3"})
+	b.Merge(a.Gossip())
+	c.Merge(b.Gossip())
+
+	assert.ElementsMatch(t, []gdp.Hash{a.self.Addr, b.self.Addr}, c.Alive())
+	assert.Len(t, changes.changes, 2)
+
+	// Stale gossip does not override newer counters
+	stale := a.Gossip()
+	b.Merge(a.Gossip())
+	b.Merge(stale)
+
+	// A member that leaves is removed without waiting for the timeout
+	a.Leave()
+	b.Merge(a.Gossip())
+	c.Merge(b.Gossip())
+	assert.Equal(t, []gdp.Hash{b.self.Addr}, c.Alive())
+	assert.Equal(t, Left, changes.last().State)
+	assert.Equal(t, a.self.Addr, changes.last().Addr)
+
+	// Gossip about a replica itself is ignored
+	c.Merge(&Gossip{Members: []Member{{Addr: c.self.Addr, Heartbeat: 1 << 63, State: Left}}})
+	assert.Equal(t, Alive, c.self.State)
+}
+
+func TestExpire(t *testing.T) {
+	a := New(gdp.GenerateHash("a"), "localhost:1")
+	b := New(gdp.GenerateHash("b"), "localhost:2")
+	changes := &recorder{}
+	a.OnChange(changes.record)
+	a.SetFailTimeout(20 * time.Millisecond)
+
+	a.Merge(b.Gossip())
+	assert.Equal(t, []gdp.Hash{b.self.Addr}, a.Alive())
+
+	// Gossip keeps a member alive
+	time.Sleep(15 * time.Millisecond)
+	a.Merge(b.Gossip())
+	time.Sleep(15 * time.Millisecond)
+	a.Expire()
+	assert.Equal(t, []gdp.Hash{b.self.Addr}, a.Alive())
+
+	// Silence makes it dead, then forgotten
+	time.Sleep(25 * time.Millisecond)
+	a.Expire()
+	assert.Empty(t, a.Alive())
+	assert.Equal(t, Dead, changes.last().State)
+	assert.Len(t, a.Members(), 1)
+
+	// Dead members are not gossiped about
+	assert.Len(t, a.Gossip().Members, 1)
+
+	time.Sleep(25 * time.Millisecond)
+	a.Expire()
+	assert.Empty(t, a.Members())
+
+	// A member that restarts is alive again
+	a.Merge(New(b.self.Addr, "localhost:4").Gossip())
+	assert.Equal(t, []gdp.Hash{b.self.Addr}, a.Alive())
+	assert.Equal(t, "localhost:4", changes.last().Listen)
+}
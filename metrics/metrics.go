@@ -0,0 +1,170 @@
+/*
+Package metrics collects statistics of replication in the Prometheus
+format, so replicas can be monitored and benchmarked without scraping
+their logs. See Handler.
+
+Conversations are labelled with the name of the policy, see
+policy.Names, and with the GDP address of the peer in hex.
+*/
+package metrics
+
+import (
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+const namespace = "gdp_replicate"
+
+// Reasons a conversation is aborted
+const (
+	// No message of the conversation within the conversation timeout
+	ReasonTimeout = "timeout"
+
+	// A new conversation with the same peer started
+	ReasonReplaced = "replaced"
+
+	// The log of the conversation is no longer replicated
+	ReasonClosed = "closed"
+)
+
+var (
+	ConversationsStarted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "conversations_started_total",
+			Help:      "Conversations started with peers, as initiator or receiver.",
+		},
+		[]string{"policy", "peer"},
+	)
+
+	ConversationsFinished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "conversations_finished_total",
+			Help:      "Conversations with peers that ran to their end.",
+		},
+		[]string{"policy", "peer"},
+	)
+
+	ConversationsAborted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "conversations_aborted_total",
+			Help:      "Conversations with peers dropped before their end.",
+		},
+		[]string{"policy", "peer", "reason"},
+	)
+
+	RecordsSent = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "records_sent_total",
+			Help:      "Records sent to peers.",
+		},
+		[]string{"policy"},
+	)
+
+	RecordsReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "records_received_total",
+			Help:      "Records received from peers, before verification.",
+		},
+		[]string{"policy"},
+	)
+
+	RecordsWritten = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "records_written_total",
+			Help:      "Records received from peers and written to the database, by outcome of the write.",
+		},
+		[]string{"status"},
+	)
+
+	BytesSent = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_sent_total",
+			Help:      "Bytes of messages sent to peers.",
+		},
+	)
+
+	BytesReceived = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "bytes_received_total",
+			Help:      "Bytes of messages received from peers.",
+		},
+	)
+
+	MessageDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "message_duration_seconds",
+			Help:      "Time to process a message from a peer, by stage of the conversation.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"policy", "stage"},
+	)
+
+	WriteDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "write_duration_seconds",
+			Help:      "Time to write a batch of records to the database.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+	)
+
+	Divergence = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "divergence_records",
+			Help:      "Estimated records held by only one of this replica and a peer, as of the last conversation.",
+		},
+		[]string{"policy", "peer"},
+	)
+)
+
+// Registry holds the metrics of this package and of the Go runtime
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		ConversationsStarted,
+		ConversationsFinished,
+		ConversationsAborted,
+		RecordsSent,
+		RecordsReceived,
+		RecordsWritten,
+		BytesSent,
+		BytesReceived,
+		MessageDuration,
+		WriteDuration,
+		Divergence,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics of Registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// Peer returns the label of a peer
+func Peer(peer gdp.Hash) string {
+	return hex.EncodeToString(peer[:])
+}
+
+// Since returns the seconds elapsed since start, for histograms
+func Since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
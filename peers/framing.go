@@ -0,0 +1,157 @@
+package peers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+
+	"github.com/tonyyanga/gdp-replicate/codec"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/metrics"
+)
+
+/*
+A stream between peers starts with a codec.TypeHello envelope naming the
+sender, followed by one envelope per message. Content without a codec
+message type is sent as a gob encoded interface value. The log of a
+LogMessage is sent in the envelope of its content.
+
+Streams of older replicas, which hold gob encoded Messages, are detected
+by their missing magic and still accepted.
+
+Bytes of streams are counted in metrics.
+*/
+
+var errMissingHello = errors.New("stream does not start with hello")
+
+// goValue wraps content without a codec message type
+type goValue struct {
+	Content interface{}
+}
+
+// countingWriter counts the bytes written to a stream
+type countingWriter struct {
+	w io.Writer
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	metrics.BytesSent.Add(float64(n))
+	return n, err
+}
+
+// countingReader counts the bytes read from a stream
+type countingReader struct {
+	r io.Reader
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	metrics.BytesReceived.Add(float64(n))
+	return n, err
+}
+
+// writeHello starts a stream from sender
+func writeHello(w io.Writer, sender gdp.Hash) error {
+	return codec.WriteFrame(countingWriter{w}, codec.GobID, codec.TypeHello, sender[:])
+}
+
+// writeContent writes content to a stream in an envelope of c
+func writeContent(w io.Writer, c codec.Codec, content interface{}) error {
+	w = countingWriter{w}
+
+	log := gdp.NullHash
+	if logMsg, ok := content.(*LogMessage); ok {
+		log = logMsg.Log
+		content = logMsg.Content
+	}
+
+	if _, err := codec.TypeOf(content); err == nil {
+		return codec.WriteLogMessage(w, c, log, content)
+	}
+
+	buf := &bytes.Buffer{}
+	registerContentTypes()
+	err := gob.NewEncoder(buf).Encode(&goValue{Content: content})
+	if err != nil {
+		return err
+	}
+	return codec.WriteLogFrame(w, log, codec.GobID, codec.TypeGoValue, buf.Bytes())
+}
+
+// messageReader reads the messages of an incoming stream
+type messageReader struct {
+	reader *bufio.Reader
+
+	// set once the format of the stream is known
+	sender  *gdp.Hash
+	decoder *gob.Decoder // legacy streams only
+}
+
+func newMessageReader(r io.Reader) *messageReader {
+	return &messageReader{reader: bufio.NewReader(countingReader{r})}
+}
+
+// next returns the next message of the stream and its sender
+func (mr *messageReader) next() (gdp.Hash, interface{}, error) {
+	if mr.sender == nil && mr.decoder == nil {
+		magic, err := mr.reader.Peek(len(codec.Magic))
+		if err != nil {
+			return gdp.NullHash, nil, err
+		}
+
+		if codec.IsEnvelope(magic) {
+			sender, err := mr.readHello()
+			if err != nil {
+				return gdp.NullHash, nil, err
+			}
+			mr.sender = &sender
+		} else {
+			registerContentTypes()
+			mr.decoder = gob.NewDecoder(mr.reader)
+		}
+	}
+
+	if mr.decoder != nil {
+		msg := &Message{}
+		err := mr.decoder.Decode(msg)
+		return msg.Sender, msg.Content, err
+	}
+
+	header, payload, err := codec.ReadFrame(mr.reader)
+	if err != nil {
+		return *mr.sender, nil, err
+	}
+
+	var content interface{}
+	if header.Type == codec.TypeGoValue {
+		value := &goValue{}
+		registerContentTypes()
+		err = gob.NewDecoder(bytes.NewReader(payload)).Decode(value)
+		content = value.Content
+	} else {
+		content, err = codec.DecodePayload(header, payload)
+	}
+
+	if err == nil && header.Log != gdp.NullHash {
+		content = &LogMessage{Log: header.Log, Content: content}
+	}
+	return *mr.sender, content, err
+}
+
+func (mr *messageReader) readHello() (gdp.Hash, error) {
+	var sender gdp.Hash
+
+	header, payload, err := codec.ReadFrame(mr.reader)
+	if err != nil {
+		return sender, err
+	}
+	if header.Type != codec.TypeHello || len(payload) != len(sender) {
+		return sender, errMissingHello
+	}
+
+	copy(sender[:], payload)
+	return sender, nil
+}
@@ -0,0 +1,76 @@
+package peers
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/codec"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/policy"
+)
+
+func TestMessageReader(t *testing.T) {
+	sender := gdp.GenerateHash("sender")
+	graphMsg := &policy.GraphMsgContent{Num: 2, Session: 7}
+
+	// Framed stream mixing codecs and plain Go values
+	stream := &bytes.Buffer{}
+	assert.Nil(t, writeHello(stream, sender))
+	assert.Nil(t, writeContent(stream, codec.Binary, graphMsg))
+	assert.Nil(t, writeContent(stream, codec.Gob, graphMsg))
+	assert.Nil(t, writeContent(stream, codec.Binary, "hello there"))
+
+	reader := newMessageReader(stream)
+	for i := 0; i < 2; i++ {
+		src, content, err := reader.next()
+		assert.Nil(t, err)
+		assert.Equal(t, sender, src)
+		assert.Equal(t, graphMsg, content)
+	}
+	src, content, err := reader.next()
+	assert.Nil(t, err)
+	assert.Equal(t, sender, src)
+	assert.Equal(t, "hello there", content)
+	_, _, err = reader.next()
+	assert.Equal(t, io.EOF, err)
+
+	// Content of a log carries the log in its envelope
+	log := gdp.GenerateHash("log")
+	stream.Reset()
+	assert.Nil(t, writeHello(stream, sender))
+	assert.Nil(t, writeContent(stream, codec.Binary, &LogMessage{Log: log, Content: graphMsg}))
+	assert.Nil(t, writeContent(stream, codec.Binary, &LogMessage{Log: log, Content: "hello there"}))
+
+	reader = newMessageReader(stream)
+	_, content, err = reader.next()
+	assert.Nil(t, err)
+	assert.Equal(t, &LogMessage{Log: log, Content: graphMsg}, content)
+	_, content, err = reader.next()
+	assert.Nil(t, err)
+	assert.Equal(t, &LogMessage{Log: log, Content: "hello there"}, content)
+
+	// Stream of an older replica
+	stream.Reset()
+	registerContentTypes()
+	encoder := gob.NewEncoder(stream)
+	assert.Nil(t, encoder.Encode(&Message{Sender: sender, Content: graphMsg}))
+	assert.Nil(t, encoder.Encode(&Message{Sender: sender, Content: "legacy"}))
+
+	reader = newMessageReader(stream)
+	src, content, err = reader.next()
+	assert.Nil(t, err)
+	assert.Equal(t, sender, src)
+	assert.Equal(t, graphMsg, content)
+	_, content, err = reader.next()
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy", content)
+
+	// Framed stream without hello
+	stream.Reset()
+	assert.Nil(t, writeContent(stream, codec.Binary, graphMsg))
+	_, _, err = newMessageReader(stream).next()
+	assert.Equal(t, errMissingHello, err)
+}
@@ -1,24 +1,55 @@
 package peers
 
 import (
+	"crypto/tls"
 	"encoding/gob"
 	"errors"
+	"io"
 	"net"
+	"sync"
 
+	"github.com/tonyyanga/gdp-replicate/codec"
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/policy"
 	"go.uber.org/zap"
 )
 
-var errUnknownPeerAddr = errors.New("peer with unknown addr")
+var (
+	errUnknownPeerAddr = errors.New("peer with unknown addr")
+
+	// ErrServerClosed is returned by ListenAndServe after Close
+	ErrServerClosed = errors.New("replication server closed")
+)
 
 // GobServer is a ReplicationServer that communicates with other
 // servers through TCP and gob serialization. One choice behind
 // is the high level of abstraction of the network communication
 // and serializiation.
+//
+// Policy messages are sent in codec envelopes using gob unless another
+// codec is set with SetCodec. Incoming messages are decoded with the
+// codec named in their envelope.
+//
+// If TLS is configured, connections are mutually authenticated and
+// messages whose Sender does not match the certificate of the
+// connection are dropped.
 type GobServer struct {
-	peerAddrs map[gdp.Hash]string
-	Addr      gdp.Hash
+	// address book, guarded by peersMutex
+	peersMutex sync.RWMutex
+	peerAddrs  map[gdp.Hash]string
+
+	Addr gdp.Hash
+
+	// nil if connections are plain TCP
+	tlsConfig *tls.Config
+
+	// codec of outgoing policy messages
+	codec codec.Codec
+
+	// listener of ListenAndServe, closed by Close
+	listenerMutex sync.Mutex
+	listener      net.Listener
+	closed        bool
 }
 
 // NewGobServer initializes a GobServer
@@ -26,12 +57,150 @@ func NewGobServer(addr gdp.Hash, peerAddrs map[gdp.Hash]string) *GobServer {
 	return &GobServer{
 		Addr:      addr,
 		peerAddrs: peerAddrs,
+		codec:     codec.Gob,
+	}
+}
+
+// NewTLSGobServer initializes a GobServer that uses mutually
+// authenticated TLS. config must hold the certificate bound to addr and
+// the CA used to verify peers.
+func NewTLSGobServer(
+	addr gdp.Hash,
+	peerAddrs map[gdp.Hash]string,
+	config *tls.Config,
+) *GobServer {
+	return &GobServer{
+		Addr:      addr,
+		peerAddrs: peerAddrs,
+		tlsConfig: config,
+		codec:     codec.Gob,
+	}
+}
+
+// SetCodec sets the codec of outgoing policy messages. Must be called
+// before messages are sent.
+func (server *GobServer) SetCodec(c codec.Codec) {
+	server.codec = c
+}
+
+// listen opens a listener at address, using TLS if configured.
+// The listener is closed by Close.
+func (server *GobServer) listen(address string) (net.Listener, error) {
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+	if server.closed {
+		return nil, ErrServerClosed
+	}
+
+	var listener net.Listener
+	var err error
+	if server.tlsConfig != nil {
+		listener, err = tls.Listen("tcp", address, serverTLSConfig(server.tlsConfig))
+	} else {
+		listener, err = net.Listen("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	server.listener = listener
+	return listener, nil
+}
+
+// isClosed reports whether Close was called
+func (server *GobServer) isClosed() bool {
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+	return server.closed
+}
+
+// Close stops ListenAndServe from accepting connections, connections
+// being served complete normally
+func (server *GobServer) Close() error {
+	server.listenerMutex.Lock()
+	defer server.listenerMutex.Unlock()
+
+	server.closed = true
+	if server.listener != nil {
+		return server.listener.Close()
+	}
+	return nil
+}
+
+// SetPeerAddr adds peer to the address book or changes its address
+func (server *GobServer) SetPeerAddr(peer gdp.Hash, addr string) {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	// the map may be shared with the caller of NewGobServer
+	peerAddrs := make(map[gdp.Hash]string, len(server.peerAddrs)+1)
+	for hash, ipAddr := range server.peerAddrs {
+		peerAddrs[hash] = ipAddr
+	}
+	peerAddrs[peer] = addr
+	server.peerAddrs = peerAddrs
+}
+
+// RemovePeer removes peer from the address book
+func (server *GobServer) RemovePeer(peer gdp.Hash) {
+	server.peersMutex.Lock()
+	defer server.peersMutex.Unlock()
+
+	peerAddrs := make(map[gdp.Hash]string, len(server.peerAddrs))
+	for hash, ipAddr := range server.peerAddrs {
+		if hash != peer {
+			peerAddrs[hash] = ipAddr
+		}
+	}
+	server.peerAddrs = peerAddrs
+}
+
+// peerAddr looks up the address of peer
+func (server *GobServer) peerAddr(peer gdp.Hash) (string, bool) {
+	server.peersMutex.RLock()
+	defer server.peersMutex.RUnlock()
+
+	ipAddr, present := server.peerAddrs[peer]
+	return ipAddr, present
+}
+
+// dial opens a connection to peer, using TLS if configured
+func (server *GobServer) dial(peer gdp.Hash) (net.Conn, error) {
+	ipAddr, present := server.peerAddr(peer)
+	if !present {
+		zap.S().Errorw(
+			"Failed to resolve peer to addr",
+			"peer", peer,
+		)
+		return nil, errUnknownPeerAddr
+	}
+
+	if server.tlsConfig != nil {
+		return tls.Dial("tcp", ipAddr, clientTLSConfig(server.tlsConfig, peer))
+	}
+	return net.Dial("tcp", ipAddr)
+}
+
+// authenticate checks that sender is the peer at the other end of
+// conn. Always succeeds without TLS.
+func (server *GobServer) authenticate(conn net.Conn, sender gdp.Hash) error {
+	if server.tlsConfig == nil {
+		return nil
+	}
+
+	identity, err := authenticatedPeer(conn)
+	if err != nil {
+		return err
+	}
+	if identity != sender {
+		return errPeerIdentityMismatch
 	}
+	return nil
 }
 
 // ListenAndServe makes a GobServer begin listening for connections
 // at the specified address. Incoming connections are handled through
-// the handler asynchronously.
+// the handler asynchronously. Returns ErrServerClosed after Close.
 func (server *GobServer) ListenAndServe(
 	address string,
 	handler func(src gdp.Hash, msg interface{}),
@@ -40,13 +209,16 @@ func (server *GobServer) ListenAndServe(
 		"Starting server",
 		"address", address,
 	)
-	listener, err := net.Listen("tcp", address)
+	listener, err := server.listen(address)
 	if err != nil {
 		return err
 	}
 
 	for {
 		conn, err := listener.Accept()
+		if err != nil && server.isClosed() {
+			return ErrServerClosed
+		}
 		if err != nil {
 			zap.S().Errorw(
 				"Failed to accept incoming connection",
@@ -62,19 +234,32 @@ func (server *GobServer) ListenAndServe(
 			)
 			defer conn.Close()
 
-			dec := gob.NewDecoder(conn)
-			gob.Register(&policy.NaiveMsgContent{})
-			gob.Register(&policy.GraphMsgContent{})
-			msg := &Message{}
-			err := dec.Decode(msg)
-			if err != nil {
-				zap.S().Errorw(
-					"Failed to decode msg",
-					"error", err,
-				)
-				return
+			reader := newMessageReader(conn)
+			for {
+				sender, content, err := reader.next()
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					zap.S().Errorw(
+						"Failed to decode msg",
+						"error", err,
+					)
+					return
+				}
+
+				err = server.authenticate(conn, sender)
+				if err != nil {
+					zap.S().Errorw(
+						"Dropping msg from unauthenticated sender",
+						"sender", sender.Readable(),
+						"remote", conn.RemoteAddr(),
+						"error", err,
+					)
+					return
+				}
+				handler(sender, content)
 			}
-			handler(msg.Sender, msg.Content)
 		}(conn)
 	}
 }
@@ -83,36 +268,42 @@ func (server *GobServer) ListenAndServe(
 // Any type can be used for content, as long as the handler of the
 // receiver is expecting that type.
 func (server *GobServer) Send(peer gdp.Hash, content interface{}) error {
-	ipAddr, present := server.peerAddrs[peer]
-	if !present {
-		zap.S().Errorw(
-			"Failed to resolve peer to addr",
-			"peer", peer,
-		)
-		return errUnknownPeerAddr
-	}
-
-	conn, err := net.Dial("tcp", ipAddr)
+	conn, err := server.dial(peer)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
-	msg := Message{
-		Sender:  server.Addr,
-		Content: content,
+	err = writeHello(conn, server.Addr)
+	if err != nil {
+		return err
 	}
+	return writeContent(conn, server.codec, content)
+}
 
-	encoder := gob.NewEncoder(conn)
+// registerContentTypes registers the policy messages that may be sent
+// as content with gob, by older replicas or in a goValue.
+func registerContentTypes() {
 	gob.Register(&policy.NaiveMsgContent{})
 	gob.Register(&policy.GraphMsgContent{})
-
-	return encoder.Encode(msg)
+	gob.Register(&policy.MerkleMsgContent{})
+	gob.Register(&policy.IBLTMsgContent{})
 }
 
 // Message is the wrapper for communication between peers.
 // Messages contain the identifciation of the sender.
+//
+// Only streams of older replicas consist of gob encoded Messages.
 type Message struct {
 	Sender  gdp.Hash
 	Content interface{}
 }
+
+// LogMessage is content belonging to a log, for replicas hosting
+// several logs. Sending a LogMessage puts Log in the envelope of
+// Content, and handlers receive a LogMessage for any envelope naming
+// a log. Other content belongs to no log.
+type LogMessage struct {
+	Log     gdp.Hash
+	Content interface{}
+}
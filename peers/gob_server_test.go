@@ -29,3 +29,32 @@ func TestGobServer(t *testing.T) {
 	assert.Equal(t, "hello there", receivedMsg)
 	fmt.Println("Finishing test")
 }
+
+func TestGobServerClose(t *testing.T) {
+	serverAddr := "localhost:8009"
+	server := NewGobServer(gdp.NullHash, map[gdp.Hash]string{})
+	assert.Equal(t, errUnknownPeerAddr, server.Send(gdp.NullHash, "hello"))
+	server.SetPeerAddr(gdp.NullHash, serverAddr)
+
+	served := make(chan error)
+	go func() {
+		served <- server.ListenAndServe(serverAddr, func(src gdp.Hash, msg interface{}) {})
+	}()
+
+	// Wait for the listener before closing it
+	for server.Send(gdp.NullHash, "hello") != nil {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, server.Close())
+
+	server.RemovePeer(gdp.NullHash)
+	assert.Equal(t, errUnknownPeerAddr, server.Send(gdp.NullHash, "hello"))
+
+	select {
+	case err := <-served:
+		assert.Equal(t, ErrServerClosed, err)
+	case <-time.After(time.Second):
+		t.Fatal("ListenAndServe did not return after Close")
+	}
+	assert.Equal(t, ErrServerClosed, server.ListenAndServe(serverAddr, nil))
+}
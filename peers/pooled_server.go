@@ -0,0 +1,371 @@
+package peers
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/codec"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"go.uber.org/zap"
+)
+
+const (
+	minReconnectBackoff = 50 * time.Millisecond
+	maxReconnectBackoff = 5 * time.Second
+	maxSendAttempts     = 5
+
+	// time a frame may take to be written before the stream is
+	// considered stalled
+	defaultWriteTimeout = 10 * time.Second
+
+	// max number of messages of a stream handled at once
+	maxStreamHandlers = 16
+)
+
+var errStreamClosed = errors.New("stream to peer closed")
+
+// PooledGobServer is a ReplicationServer that keeps one long-lived
+// stream to each peer instead of dialing for every message. Messages
+// of all conversations with a peer are multiplexed over its stream,
+// since the stream identifies its sender and every envelope carries
+// its own content. Broken streams are re-established with exponential backoff.
+//
+// Incoming streams may come from a GobServer, which sends a single
+// message per stream, or from an older replica sending gob Messages.
+type PooledGobServer struct {
+	// address book, dialing and authentication
+	server *GobServer
+
+	// time a frame may take to be written, see defaultWriteTimeout
+	writeTimeout time.Duration
+
+	mutex sync.Mutex
+	conns map[gdp.Hash]*pooledConn
+}
+
+// pooledConn is the outgoing stream to a peer
+type pooledConn struct {
+	// held while the stream is opened or a frame written to it, so
+	// frames are not interleaved
+	writeMutex sync.Mutex
+
+	// guards the fields below. Never held during I/O, so closing the
+	// stream does not wait for a stalled write.
+	mutex  sync.Mutex
+	conn   net.Conn
+	closed bool
+}
+
+// NewPooledGobServer initializes a PooledGobServer
+func NewPooledGobServer(addr gdp.Hash, peerAddrs map[gdp.Hash]string) *PooledGobServer {
+	return &PooledGobServer{
+		server:       NewGobServer(addr, peerAddrs),
+		writeTimeout: defaultWriteTimeout,
+		conns:        make(map[gdp.Hash]*pooledConn),
+	}
+}
+
+// NewTLSPooledGobServer initializes a PooledGobServer whose streams use
+// mutually authenticated TLS. See NewTLSGobServer.
+func NewTLSPooledGobServer(
+	addr gdp.Hash,
+	peerAddrs map[gdp.Hash]string,
+	config *tls.Config,
+) *PooledGobServer {
+	return &PooledGobServer{
+		server:       NewTLSGobServer(addr, peerAddrs, config),
+		writeTimeout: defaultWriteTimeout,
+		conns:        make(map[gdp.Hash]*pooledConn),
+	}
+}
+
+// SetCodec sets the codec of outgoing policy messages. Must be called
+// before messages are sent.
+func (pool *PooledGobServer) SetCodec(c codec.Codec) {
+	pool.server.SetCodec(c)
+}
+
+// ListenAndServe accepts streams from peers and decodes messages from
+// them until they are closed. Each message is handled asynchronously.
+// Returns ErrServerClosed after Close.
+func (pool *PooledGobServer) ListenAndServe(
+	address string,
+	handler func(src gdp.Hash, msg interface{}),
+) error {
+	zap.S().Infow(
+		"Starting pooled server",
+		"address", address,
+	)
+	listener, err := pool.server.listen(address)
+	if err != nil {
+		return err
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil && pool.server.isClosed() {
+			return ErrServerClosed
+		}
+		if err != nil {
+			zap.S().Errorw(
+				"Failed to accept incoming connection",
+				"error", err,
+			)
+			continue
+		}
+		go pool.serveConn(conn, handler)
+	}
+}
+
+// serveConn decodes messages from an incoming stream. At most
+// maxStreamHandlers of its messages are handled at once, further
+// messages are not read until a handler returns.
+func (pool *PooledGobServer) serveConn(
+	conn net.Conn,
+	handler func(src gdp.Hash, msg interface{}),
+) {
+	zap.S().Infow(
+		"Handling stream",
+		"receiver", conn.LocalAddr(),
+		"sender", conn.RemoteAddr(),
+	)
+	defer conn.Close()
+
+	handlers := make(chan struct{}, maxStreamHandlers)
+	reader := newMessageReader(conn)
+	for {
+		sender, content, err := reader.next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			zap.S().Errorw(
+				"Failed to decode msg",
+				"error", err,
+			)
+			return
+		}
+
+		err = pool.server.authenticate(conn, sender)
+		if err != nil {
+			zap.S().Errorw(
+				"Closing stream from unauthenticated sender",
+				"sender", sender.Readable(),
+				"remote", conn.RemoteAddr(),
+				"error", err,
+			)
+			return
+		}
+
+		handlers <- struct{}{}
+		go func(sender gdp.Hash, content interface{}) {
+			defer func() { <-handlers }()
+			handler(sender, content)
+		}(sender, content)
+	}
+}
+
+// Send sends content to a peer over its stream, opening the stream if
+// needed. Fails after maxSendAttempts attempts to (re)connect. A write
+// that failed after part of the frame was sent is not retried, as the
+// peer may have received the message.
+func (pool *PooledGobServer) Send(peer gdp.Hash, content interface{}) error {
+	backoff := minReconnectBackoff
+	for attempt := 1; ; attempt++ {
+		if pool.server.isClosed() {
+			return ErrServerClosed
+		}
+
+		written, err := pool.sendOnce(peer, content)
+		if err == nil {
+			return nil
+		}
+
+		if written || attempt >= maxSendAttempts {
+			zap.S().Errorw(
+				"Failed to send to peer",
+				"peer", peer.Readable(),
+				"attempts", attempt,
+				"error", err,
+			)
+			return err
+		}
+
+		zap.S().Infow(
+			"Reconnecting to peer",
+			"peer", peer.Readable(),
+			"backoff", backoff,
+			"error", err,
+		)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// sendOnce writes content to the stream of peer, opening it if needed.
+// Returns true if part of the frame was written.
+func (pool *PooledGobServer) sendOnce(peer gdp.Hash, content interface{}) (bool, error) {
+	pc := pool.getConn(peer)
+
+	pc.writeMutex.Lock()
+	defer pc.writeMutex.Unlock()
+
+	conn, err := pool.stream(peer, pc)
+	if err != nil {
+		return false, err
+	}
+
+	w := &trackingWriter{w: conn}
+	conn.SetWriteDeadline(time.Now().Add(pool.writeTimeout))
+	err = writeContent(w, pool.server.codec, content)
+	if err != nil {
+		pc.drop(conn)
+		return w.written > 0, err
+	}
+	return false, nil
+}
+
+// trackingWriter records the bytes written of a frame
+type trackingWriter struct {
+	w       io.Writer
+	written int
+}
+
+func (tw *trackingWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	tw.written += n
+	return n, err
+}
+
+// Close stops ListenAndServe from accepting streams and closes all
+// outgoing streams. Sends in progress fail.
+func (pool *PooledGobServer) Close() error {
+	err := pool.server.Close()
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for peer, pc := range pool.conns {
+		pc.close()
+		delete(pool.conns, peer)
+	}
+	return err
+}
+
+// SetPeerAddr adds peer to the address book or changes its address.
+// The stream to peer is re-established at its new address.
+func (pool *PooledGobServer) SetPeerAddr(peer gdp.Hash, addr string) {
+	old, present := pool.server.peerAddr(peer)
+	pool.server.SetPeerAddr(peer, addr)
+	if present && old != addr {
+		pool.closeConn(peer)
+	}
+}
+
+// RemovePeer removes peer from the address book and closes its stream
+func (pool *PooledGobServer) RemovePeer(peer gdp.Hash) {
+	pool.server.RemovePeer(peer)
+	pool.closeConn(peer)
+}
+
+// closeConn closes the stream to peer if any
+func (pool *PooledGobServer) closeConn(peer gdp.Hash) {
+	pool.mutex.Lock()
+	pc, ok := pool.conns[peer]
+	delete(pool.conns, peer)
+	pool.mutex.Unlock()
+
+	if ok {
+		pc.close()
+	}
+}
+
+func (pool *PooledGobServer) getConn(peer gdp.Hash) *pooledConn {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	pc, ok := pool.conns[peer]
+	if !ok {
+		pc = &pooledConn{}
+		pool.conns[peer] = pc
+	}
+	return pc
+}
+
+// stream returns the stream of pc, dialing peer if there is none.
+// Assumes the writeMutex of pc is held by caller
+func (pool *PooledGobServer) stream(peer gdp.Hash, pc *pooledConn) (net.Conn, error) {
+	pc.mutex.Lock()
+	conn, closed := pc.conn, pc.closed
+	pc.mutex.Unlock()
+
+	if closed {
+		return nil, errStreamClosed
+	}
+	if conn != nil {
+		return conn, nil
+	}
+
+	conn, err := pool.server.dial(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(pool.writeTimeout))
+	err = writeHello(conn, pool.server.Addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	// closed while dialing
+	if pc.closed {
+		conn.Close()
+		return nil, errStreamClosed
+	}
+	pc.conn = conn
+
+	go pc.watch(conn)
+	return conn, nil
+}
+
+// watch detects a stream closed by the peer. Peers never write to our
+// outgoing streams, so any read returning means the stream is gone.
+func (pc *pooledConn) watch(conn net.Conn) {
+	buf := make([]byte, 1)
+	conn.Read(buf)
+	pc.drop(conn)
+}
+
+// drop closes conn and clears it if it is still the stream of pc
+func (pc *pooledConn) drop(conn net.Conn) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	conn.Close()
+	if pc.conn == conn {
+		pc.conn = nil
+	}
+}
+
+// close closes the stream of pc for good, a write in progress fails
+func (pc *pooledConn) close() {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	pc.closed = true
+	if pc.conn != nil {
+		pc.conn.Close()
+	}
+	pc.conn = nil
+}
@@ -0,0 +1,240 @@
+package peers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// countingListener counts accepted connections
+type countingListener struct {
+	net.Listener
+	mutex    sync.Mutex
+	accepted int
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mutex.Lock()
+		l.accepted++
+		l.mutex.Unlock()
+	}
+	return conn, err
+}
+
+func (l *countingListener) count() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.accepted
+}
+
+func TestPooledGobServer(t *testing.T) {
+	serverAddr := "localhost:8200"
+	serverHash := gdp.GenerateHash(serverAddr)
+	clientHash := gdp.GenerateHash("client")
+
+	listener, err := net.Listen("tcp", serverAddr)
+	assert.Nil(t, err)
+	counter := &countingListener{Listener: listener}
+
+	server := NewPooledGobServer(serverHash, nil)
+	received := make(chan string, 100)
+	handler := func(src gdp.Hash, msg interface{}) {
+		assert.Equal(t, clientHash, src)
+		received <- msg.(string)
+	}
+	go func() {
+		for {
+			conn, err := counter.Accept()
+			if err != nil {
+				return
+			}
+			go server.serveConn(conn, handler)
+		}
+	}()
+	defer listener.Close()
+
+	client := NewPooledGobServer(clientHash, map[gdp.Hash]string{serverHash: serverAddr})
+	defer client.Close()
+
+	// Concurrent conversations share one stream
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, client.Send(serverHash, fmt.Sprintf("msg %d", i)))
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		select {
+		case msg := <-received:
+			seen[msg] = true
+		case <-time.After(time.Second):
+			t.Fatal("missing messages")
+		}
+	}
+	assert.Equal(t, 20, len(seen))
+	assert.Equal(t, 1, counter.count())
+
+	// A broken stream is re-established on the next send
+	pc := client.getConn(serverHash)
+	pc.mutex.Lock()
+	pc.conn.Close()
+	pc.mutex.Unlock()
+	time.Sleep(50 * time.Millisecond)
+
+	assert.Nil(t, client.Send(serverHash, "after reconnect"))
+	select {
+	case msg := <-received:
+		assert.Equal(t, "after reconnect", msg)
+	case <-time.After(time.Second):
+		t.Fatal("message after reconnect not received")
+	}
+	assert.Equal(t, 2, counter.count())
+}
+
+func TestPooledGobServerUnreachable(t *testing.T) {
+	client := NewPooledGobServer(gdp.NullHash, map[gdp.Hash]string{
+		gdp.NullHash: "localhost:1",
+	})
+	assert.NotNil(t, client.Send(gdp.NullHash, "hello there"))
+	assert.Equal(t, errUnknownPeerAddr, client.Send(gdp.GenerateHash("unknown"), "hello"))
+}
+
+func TestPooledGobServerStalledPeer(t *testing.T) {
+	// A peer that accepts streams but never reads them
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	peer := gdp.GenerateHash("stalled")
+	client := NewPooledGobServer(gdp.GenerateHash("client"), map[gdp.Hash]string{
+		peer: listener.Addr().String(),
+	})
+	large := strings.Repeat("x", 4<<20)
+
+	// Sends fail once the buffers of the stream are full, without
+	// resending the frame partly written
+	client.writeTimeout = 100 * time.Millisecond
+	start := time.Now()
+	for i := 0; i < 20 && err == nil; i++ {
+		err = client.Send(peer, large)
+	}
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second, time.Since(start))
+
+	// Close does not wait for a stalled send, which fails
+	client.writeTimeout = time.Hour
+	sent := make(chan error, 1)
+	go func() {
+		var err error
+		for err == nil {
+			err = client.Send(peer, large)
+		}
+		sent <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		client.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waits for a stalled send")
+	}
+	select {
+	case err := <-sent:
+		assert.NotNil(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("stalled send not aborted by Close")
+	}
+}
+
+func TestPooledGobServerHandlerLimit(t *testing.T) {
+	serverHash := gdp.GenerateHash("server")
+	clientHash := gdp.GenerateHash("client")
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	var mutex sync.Mutex
+	running, maxRunning := 0, 0
+	release := make(chan struct{})
+	handled := make(chan struct{}, 100)
+	handler := func(src gdp.Hash, msg interface{}) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		<-release
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		handled <- struct{}{}
+	}
+
+	server := NewPooledGobServer(serverHash, nil)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serveConn(conn, handler)
+		}
+	}()
+
+	client := NewPooledGobServer(clientHash, map[gdp.Hash]string{
+		serverHash: listener.Addr().String(),
+	})
+	defer client.Close()
+
+	numMsgs := 3 * maxStreamHandlers
+	for i := 0; i < numMsgs; i++ {
+		assert.Nil(t, client.Send(serverHash, fmt.Sprintf("msg %d", i)))
+	}
+
+	// Messages beyond the limit wait for a handler to return
+	time.Sleep(100 * time.Millisecond)
+	mutex.Lock()
+	assert.Equal(t, maxStreamHandlers, running)
+	mutex.Unlock()
+
+	close(release)
+	for i := 0; i < numMsgs; i++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatal("missing messages")
+		}
+	}
+	assert.Equal(t, maxStreamHandlers, maxRunning)
+}
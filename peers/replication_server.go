@@ -8,4 +8,11 @@ type ReplicationServer interface {
 		handler func(src gdp.Hash, msg interface{}),
 	) error
 	Send(peer gdp.Hash, msg interface{}) error
+
+	// Update the address book used by Send
+	SetPeerAddr(peer gdp.Hash, addr string)
+	RemovePeer(peer gdp.Hash)
+
+	// Close stops ListenAndServe, which returns ErrServerClosed
+	Close() error
 }
@@ -0,0 +1,131 @@
+package peers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+var (
+	errNoPeerCertificate    = errors.New("peer presented no certificate")
+	errBadCertIdentity      = errors.New("certificate common name is not a GDP address")
+	errPeerIdentityMismatch = errors.New("peer certificate does not match peer address")
+	errBadCACert            = errors.New("unable to parse CA certificate")
+)
+
+// A peer's GDP address is bound to its certificate by storing the hex
+// encoded address as the Subject CommonName. Certificates must be
+// signed by a CA trusted by all replicas.
+
+// PeerHashFromCertificate returns the GDP address bound to cert.
+func PeerHashFromCertificate(cert *x509.Certificate) (gdp.Hash, error) {
+	var hash gdp.Hash
+
+	raw, err := hex.DecodeString(cert.Subject.CommonName)
+	if err != nil || len(raw) != len(hash) {
+		return gdp.NullHash, errBadCertIdentity
+	}
+
+	copy(hash[:], raw)
+	return hash, nil
+}
+
+// NewTLSConfig loads a certificate, its key and the CA certificate used
+// to verify peers from PEM files.
+func NewTLSConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, errBadCACert
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+	}, nil
+}
+
+// serverTLSConfig requires and verifies client certificates
+func serverTLSConfig(config *tls.Config) *tls.Config {
+	serverConfig := config.Clone()
+	serverConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if serverConfig.ClientCAs == nil {
+		serverConfig.ClientCAs = serverConfig.RootCAs
+	}
+	return serverConfig
+}
+
+// clientTLSConfig verifies that the server's certificate chains to a
+// trusted CA and is bound to peer. Host names are not checked since
+// peers are identified by their GDP address.
+func clientTLSConfig(config *tls.Config, peer gdp.Hash) *tls.Config {
+	clientConfig := config.Clone()
+	roots := clientConfig.RootCAs
+
+	clientConfig.InsecureSkipVerify = true
+	clientConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errNoPeerCertificate
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		if err != nil {
+			return err
+		}
+
+		identity, err := PeerHashFromCertificate(state.PeerCertificates[0])
+		if err != nil {
+			return err
+		}
+		if identity != peer {
+			return errPeerIdentityMismatch
+		}
+		return nil
+	}
+	return clientConfig
+}
+
+// authenticatedPeer completes the handshake on conn and returns the
+// GDP address bound to the client certificate.
+func authenticatedPeer(conn net.Conn) (gdp.Hash, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return gdp.NullHash, errNoPeerCertificate
+	}
+
+	err := tlsConn.Handshake()
+	if err != nil {
+		return gdp.NullHash, err
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return gdp.NullHash, errNoPeerCertificate
+	}
+
+	return PeerHashFromCertificate(certs[0])
+}
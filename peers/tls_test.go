@@ -0,0 +1,121 @@
+package peers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// tlsConfigFor issues a certificate bound to addr
+func (ca *testCA) tlsConfigFor(t *testing.T, addr gdp.Hash) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: hex.EncodeToString(addr[:])},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		RootCAs:      ca.pool,
+	}
+}
+
+func TestTLSGobServer(t *testing.T) {
+	ca := newTestCA(t)
+
+	serverAddr := "localhost:8100"
+	serverHash := gdp.GenerateHash(serverAddr)
+	clientHash := gdp.GenerateHash("client")
+	peerAddrs := map[gdp.Hash]string{serverHash: serverAddr}
+
+	server := NewTLSGobServer(serverHash, nil, ca.tlsConfigFor(t, serverHash))
+
+	received := make(chan gdp.Hash, 2)
+	go server.ListenAndServe(serverAddr, func(src gdp.Hash, msg interface{}) {
+		received <- src
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	// Authenticated sender
+	client := NewTLSGobServer(clientHash, peerAddrs, ca.tlsConfigFor(t, clientHash))
+	assert.Nil(t, client.Send(serverHash, "hello there"))
+	select {
+	case src := <-received:
+		assert.Equal(t, clientHash, src)
+	case <-time.After(time.Second):
+		t.Fatal("message from authenticated peer not received")
+	}
+
+	// A client claiming to be the server is dropped
+	impostor := NewTLSGobServer(serverHash, peerAddrs, ca.tlsConfigFor(t, clientHash))
+	assert.Nil(t, impostor.Send(serverHash, "hello there"))
+	select {
+	case src := <-received:
+		t.Fatalf("message from impostor of %s accepted", src.Readable())
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// The server must present the certificate of the intended peer
+	wrongPeer := map[gdp.Hash]string{clientHash: serverAddr}
+	client = NewTLSGobServer(clientHash, wrongPeer, ca.tlsConfigFor(t, clientHash))
+	assert.NotNil(t, client.Send(clientHash, "hello there"))
+
+	// Plain TCP clients are rejected
+	plain := NewGobServer(clientHash, peerAddrs)
+	plain.Send(serverHash, "hello there")
+	select {
+	case <-received:
+		t.Fatal("message over plain TCP accepted")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
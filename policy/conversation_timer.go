@@ -0,0 +1,215 @@
+package policy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/metrics"
+)
+
+// DefaultConversationTimeout is how long a conversation may stay idle
+// before it is aborted
+const DefaultConversationTimeout = 30 * time.Second
+
+var (
+	ErrConversationTimeout = errors.New("conversation timed out")
+	ErrConversationClosed  = errors.New("conversation aborted, log closed")
+)
+
+// An AbortHandler is notified when a conversation with peer is aborted
+type AbortHandler func(peer gdp.Hash, err error)
+
+// Conversation describes a conversation in progress with a peer
+type Conversation struct {
+	Peer    gdp.Hash
+	Session uint64
+
+	// Time of the last message of the conversation
+	LastActive time.Time
+}
+
+// ReapInterval is the time between checks for idle conversations that
+// abort them at most half a timeout late, see ReapConversations
+func ReapInterval(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		timeout = DefaultConversationTimeout
+	}
+	return timeout / 2
+}
+
+// ReapConversations periodically aborts conversations with peers that
+// stopped responding, until done is closed
+func ReapConversations(reaper ConversationReaper, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reaper.ExpireConversations()
+		case <-done:
+			return
+		}
+	}
+}
+
+// conversationTimer keeps track of the last activity of each
+// conversation in progress, which must be followed by another within
+// the timeout. Activity is recorded whenever a message of the
+// conversation is generated or processed.
+//
+// Since it sees conversations start and end, it also counts them in
+// metrics, labelled with the name of the policy.
+type conversationTimer struct {
+	mutex sync.Mutex
+
+	// name of the policy in metrics
+	policy string
+
+	// no deadlines if <= 0
+	timeout    time.Duration
+	lastActive map[conversationKey]time.Time
+	onAbort    AbortHandler
+
+	// all conversations are past their deadline once closed, see close
+	closed bool
+}
+
+func newConversationTimer(policy string) *conversationTimer {
+	return &conversationTimer{
+		policy:     policy,
+		timeout:    DefaultConversationTimeout,
+		lastActive: make(map[conversationKey]time.Time),
+	}
+}
+
+// touch extends the deadline of a conversation, starting it if needed
+func (timer *conversationTimer) touch(key conversationKey) {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+
+	if _, ok := timer.lastActive[key]; !ok {
+		metrics.ConversationsStarted.WithLabelValues(timer.policy, metrics.Peer(key.peer)).Inc()
+	}
+	timer.lastActive[key] = time.Now()
+}
+
+// stop removes the deadline of a finished conversation
+func (timer *conversationTimer) stop(key conversationKey) {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+
+	if _, ok := timer.lastActive[key]; ok {
+		metrics.ConversationsFinished.WithLabelValues(timer.policy, metrics.Peer(key.peer)).Inc()
+		delete(timer.lastActive, key)
+	}
+}
+
+// replace removes the deadline of a conversation replaced by a newer
+// one with the same peer
+func (timer *conversationTimer) replace(key conversationKey) {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+
+	if _, ok := timer.lastActive[key]; ok {
+		metrics.ConversationsAborted.WithLabelValues(
+			timer.policy,
+			metrics.Peer(key.peer),
+			metrics.ReasonReplaced,
+		).Inc()
+		delete(timer.lastActive, key)
+	}
+}
+
+// expiredLocked checks if a conversation passed its deadline
+// Assumes the mutex is held by caller
+func (timer *conversationTimer) expiredLocked(key conversationKey, now time.Time) bool {
+	lastActive, ok := timer.lastActive[key]
+	if ok && timer.closed {
+		return true
+	}
+	return ok && timer.timeout > 0 && now.After(lastActive.Add(timer.timeout))
+}
+
+// expired checks if a conversation passed its deadline
+func (timer *conversationTimer) expired(key conversationKey, now time.Time) bool {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+	return timer.expiredLocked(key, now)
+}
+
+// expiredConversations returns conversations that passed their deadline
+func (timer *conversationTimer) expiredConversations(now time.Time) []conversationKey {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+
+	keys := make([]conversationKey, 0)
+	for key := range timer.lastActive {
+		if timer.expiredLocked(key, now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// conversations returns the conversations in progress
+func (timer *conversationTimer) conversations() []Conversation {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+
+	conversations := make([]Conversation, 0, len(timer.lastActive))
+	for key, lastActive := range timer.lastActive {
+		conversations = append(conversations, Conversation{
+			Peer:       key.peer,
+			Session:    key.session,
+			LastActive: lastActive,
+		})
+	}
+	return conversations
+}
+
+// abort removes the deadline of a conversation that timed out and
+// notifies the abort handler. Once the timer is closed, conversations
+// are aborted with ErrConversationClosed instead of err.
+func (timer *conversationTimer) abort(key conversationKey, err error) {
+	timer.mutex.Lock()
+	reason := metrics.ReasonTimeout
+	if timer.closed {
+		reason = metrics.ReasonClosed
+		err = ErrConversationClosed
+	}
+	if _, ok := timer.lastActive[key]; ok {
+		metrics.ConversationsAborted.WithLabelValues(
+			timer.policy,
+			metrics.Peer(key.peer),
+			reason,
+		).Inc()
+	}
+	delete(timer.lastActive, key)
+	onAbort := timer.onAbort
+	timer.mutex.Unlock()
+
+	if onAbort != nil {
+		onAbort(key.peer, err)
+	}
+}
+
+// close puts all conversations past their deadline, for good
+func (timer *conversationTimer) close() {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+	timer.closed = true
+}
+
+func (timer *conversationTimer) setTimeout(timeout time.Duration) {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+	timer.timeout = timeout
+}
+
+func (timer *conversationTimer) setAbortHandler(handler AbortHandler) {
+	timer.mutex.Lock()
+	defer timer.mutex.Unlock()
+	timer.onAbort = handler
+}
@@ -0,0 +1,78 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
+)
+
+func TestConversationTimeout(t *testing.T) {
+	records := gdptest.Chain("record", 10)
+	a := newTestLogServer(t, "a", records[:5])
+	b := newTestLogServer(t, "b", records)
+
+	aPolicy := NewGraphDiffPolicy(newTestGraph(t, a))
+	bPolicy := NewGraphDiffPolicy(newTestGraph(t, b))
+	aPolicy.SetConversationTimeout(10 * time.Millisecond)
+
+	aborted := make([]gdp.Hash, 0)
+	aPolicy.SetAbortHandler(func(peer gdp.Hash, err error) {
+		assert.Equal(t, ErrConversationTimeout, err)
+		aborted = append(aborted, peer)
+	})
+
+	// The peer never answers the first message
+	peer := gdp.GenerateHash("responder")
+	_, err := aPolicy.GenerateMessage(peer)
+	assert.Nil(t, err)
+	assert.Empty(t, aPolicy.ExpireConversations())
+	assert.Equal(t, 1, len(aPolicy.peers.get(peer).graphInUse))
+
+	conversations := aPolicy.Conversations()
+	assert.Len(t, conversations, 1)
+	assert.Equal(t, peer, conversations[0].Peer)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []gdp.Hash{peer}, aPolicy.ExpireConversations())
+	assert.Equal(t, []gdp.Hash{peer}, aborted)
+	assert.Empty(t, aPolicy.Conversations())
+	assert.Empty(t, aPolicy.peers.get(peer).graphInUse)
+	assert.Empty(t, aPolicy.peers.get(peer).peerLastMsgType)
+
+	// Finished conversations hold no deadline
+	runConversation(t, aPolicy, bPolicy)
+	assertSameRecords(t, a, b)
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, aPolicy.ExpireConversations())
+	assert.Empty(t, bPolicy.ExpireConversations())
+	assert.Equal(t, 1, len(aborted))
+}
+
+func TestAbortConversations(t *testing.T) {
+	aPolicy := NewExternalGraphDiffPolicy(newTestLogServer(t, "a", gdptest.Chain("record", 5)))
+
+	aborted := make([]gdp.Hash, 0)
+	aPolicy.SetAbortHandler(func(peer gdp.Hash, err error) {
+		assert.Equal(t, ErrConversationClosed, err)
+		aborted = append(aborted, peer)
+	})
+
+	// Conversations are aborted long before their deadline
+	peer := gdp.GenerateHash("responder")
+	_, err := aPolicy.GenerateMessage(peer)
+	assert.Nil(t, err)
+	assert.Len(t, aPolicy.peers.get(peer).snapshotInUse, 1)
+
+	assert.Equal(t, []gdp.Hash{peer}, aPolicy.AbortConversations())
+	assert.Equal(t, []gdp.Hash{peer}, aborted)
+	assert.Empty(t, aPolicy.Conversations())
+	assert.Empty(t, aPolicy.peers.get(peer).snapshotInUse)
+
+	// and so are conversations started afterwards
+	_, err = aPolicy.GenerateMessage(peer)
+	assert.Nil(t, err)
+	assert.Equal(t, []gdp.Hash{peer}, aPolicy.ExpireConversations())
+}
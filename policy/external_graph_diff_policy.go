@@ -1,10 +1,11 @@
 package policy
 
 import (
-	"sync"
+	"time"
 
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/trace"
 	"go.uber.org/zap"
 )
 
@@ -14,183 +15,155 @@ import (
 type ExternalGraphDiffPolicy struct {
 	logserver logserver.SnapshotLogServer
 
-	// current snapshot in use for a specific peer
-	// should reset to nil and be released when message exchange ends
-	snapshotInUse map[gdp.Hash]*logserver.Snapshot
+	// state of the conversations with each peer
+	peers *graphPeers
+}
 
-	// last message sent to the peer
-	// used to keep track of message exchanges state
-	peerLastMsgType map[gdp.Hash]PeerState
+func NewExternalGraphDiffPolicy(server logserver.SnapshotLogServer) *ExternalGraphDiffPolicy {
+	policy := &ExternalGraphDiffPolicy{logserver: server}
+	policy.peers = newGraphPeers(ExternalGraphDiffPolicyName, server, policy)
+	return policy
+}
 
-	// mutex for each peer
-	peerMutex map[gdp.Hash]*sync.Mutex
+// SetBatchSize sets the max number of records sent in one message.
+// Records are sent in a single message if size <= 0.
+func (policy *ExternalGraphDiffPolicy) SetBatchSize(size int) {
+	policy.peers.setBatchSize(size)
 }
 
-func NewExternalGraphDiffPolicy(server logserver.SnapshotLogServer) *ExternalGraphDiffPolicy {
-	return &ExternalGraphDiffPolicy{
-		logserver:       server,
-		snapshotInUse:   make(map[gdp.Hash]*logserver.Snapshot),
-		peerLastMsgType: make(map[gdp.Hash]PeerState),
-		peerMutex:       make(map[gdp.Hash]*sync.Mutex),
-	}
+// SetRecordVerifier sets the verifier used to check records received
+// from peers. A nil verifier disables verification.
+func (policy *ExternalGraphDiffPolicy) SetRecordVerifier(verifier gdp.RecordVerifier) {
+	policy.peers.verifier = verifier
 }
 
-func (policy *ExternalGraphDiffPolicy) getSnapshot(peer gdp.Hash) (*logserver.Snapshot, error) {
-	snapshot, err := policy.logserver.CreateSnapshot()
-	if err != nil {
-		zap.S().Errorw(
-			"Failed to create snapshot",
-			"error", err,
-		)
-		policy.resetPeerStatus(peer)
-		return nil, err
-	}
-	policy.snapshotInUse[peer] = snapshot
-	return snapshot, nil
+// SetTracer sets the tracer of records written from peers, see package
+// trace. A nil tracer disables tracing.
+func (policy *ExternalGraphDiffPolicy) SetTracer(tracer *trace.Tracer) {
+	policy.peers.tracer = tracer
 }
 
-func (policy *ExternalGraphDiffPolicy) GenerateMessage(dest gdp.Hash) (interface{}, error) {
-	policy.initPeerIfNeeded(dest)
+// SetConversationTimeout sets how long a conversation may be idle
+// before it is aborted. Conversations never time out if timeout <= 0.
+func (policy *ExternalGraphDiffPolicy) SetConversationTimeout(timeout time.Duration) {
+	policy.peers.timer.setTimeout(timeout)
+}
 
-	policy.peerMutex[dest].Lock()
-	defer policy.peerMutex[dest].Unlock()
+// SetAbortHandler sets the handler notified of aborted conversations
+func (policy *ExternalGraphDiffPolicy) SetAbortHandler(handler AbortHandler) {
+	policy.peers.timer.setAbortHandler(handler)
+}
 
-	if _, err := policy.getSnapshot(dest); err != nil {
-		return nil, err
-	}
+// Conversations returns the conversations in progress
+func (policy *ExternalGraphDiffPolicy) Conversations() []Conversation {
+	return policy.peers.timer.conversations()
+}
 
-	// update states to firstMsgSent
-	policy.peerLastMsgType[dest] = firstMsgSent
+// ExpireConversations aborts conversations past their deadline and
+// releases the snapshots held for them
+func (policy *ExternalGraphDiffPolicy) ExpireConversations() []gdp.Hash {
+	return policy.peers.expireConversations()
+}
 
-	// generate message
-	content := &GraphMsgContent{
-		Num:           first,
-		LogicalBegins: policy.snapshotInUse[dest].GetLogicalBegins(),
-		LogicalEnds:   policy.snapshotInUse[dest].GetLogicalEnds(),
-	}
+// AbortConversations aborts all conversations and releases the
+// snapshots held for them
+func (policy *ExternalGraphDiffPolicy) AbortConversations() []gdp.Hash {
+	return policy.peers.abortConversations()
+}
 
-	zap.S().Infow("Generate first msg")
-	return content, nil
+func (policy *ExternalGraphDiffPolicy) GenerateMessage(dest gdp.Hash) (
+	interface{},
+	error,
+) {
+	return policy.peers.generateMessage(dest)
 }
 
 func (policy *ExternalGraphDiffPolicy) ProcessMessage(src gdp.Hash, packedMsg interface{}) (
 	interface{},
 	error,
 ) {
-	zap.S().Debugw(
-		"processing message",
-		"src", src.Readable(),
-	)
+	return policy.peers.processMessage(src, packedMsg)
+}
 
-	msg, ok := packedMsg.(*GraphMsgContent)
-	if !ok {
-		return nil, errConversionError
-	}
-	policy.initPeerIfNeeded(src)
-
-	policy.peerMutex[src].Lock()
-	defer policy.peerMutex[src].Unlock()
-
-	peerStatus := policy.peerLastMsgType[src]
-
-	// validate peer status with incoming message
-	// if status doesn't match the message type, simply reset the state machine
-	switch msg.Num {
-	case first:
-		if peerStatus != noMsgExchanged {
-			policy.resetPeerStatus(src)
-			zap.S().Errorw(
-				"inconsistent state and msg",
-				"peerStatus", peerStatus,
-				"msgNum", msg.Num,
-			)
-			return nil, errInconsistentStateAndMessage
-		}
+// getSnapshot creates a new snapshot for a conversation and releases the
+// one used by its previous stage.
+// Assumes that the mutex of the peer is held by caller
+func (policy *ExternalGraphDiffPolicy) getSnapshot(key conversationKey) (*logserver.Snapshot, error) {
+	state := policy.peers.get(key.peer)
 
-		return policy.processFirstMsg(msg, src)
-	case second:
-		if peerStatus != firstMsgSent {
-			policy.resetPeerStatus(src)
-			zap.S().Errorw(
-				"inconsistent state and msg",
-				"peerStatus", peerStatus,
-				"msgNum", msg.Num,
-			)
-			return nil, errInconsistentStateAndMessage
-		}
+	if previous := state.snapshotInUse[key]; previous != nil {
+		policy.logserver.DestroySnapshot(previous)
+		delete(state.snapshotInUse, key)
+	}
 
-		return policy.processSecondMsg(msg, src)
-	case third:
-		if peerStatus != firstMsgRecved {
-			policy.resetPeerStatus(src)
-			zap.S().Errorw(
-				"inconsistent state and msg",
-				"peerStatus", peerStatus,
-				"msgNum", msg.Num,
-			)
-			return nil, errInconsistentStateAndMessage
-		}
+	snapshot, err := policy.logserver.CreateSnapshot()
+	if err != nil {
+		zap.S().Errorw(
+			"Failed to create snapshot",
+			"error", err,
+		)
+		policy.peers.reset(key)
+		return nil, err
+	}
+	state.snapshotInUse[key] = snapshot
+	return snapshot, nil
+}
 
-		return policy.processThirdMsg(msg, src)
-	case fourth:
-		if peerStatus != thirdMsgSent {
-			policy.resetPeerStatus(src)
-			zap.S().Errorw(
-				"inconsistent state and msg",
-				"peerStatus", peerStatus,
-				"msgNum", msg.Num,
-			)
-			return nil, errInconsistentStateAndMessage
-		}
+// Below are the hooks of graphSource, on snapshots of the log server
+// Hooks assume the mutex of the peer is held by caller
 
-		return policy.processFourthMsg(msg, src)
-	default:
-		return nil, errUnknownMessageType
+func (policy *ExternalGraphDiffPolicy) openGraph(key conversationKey) ([]gdp.Hash, []gdp.Hash, error) {
+	snapshot, err := policy.getSnapshot(key)
+	if err != nil {
+		return nil, nil, err
 	}
+	return snapshot.GetLogicalBegins(), snapshot.GetLogicalEnds(), nil
 }
 
-func (policy *ExternalGraphDiffPolicy) initPeerIfNeeded(peer gdp.Hash) {
-	mutex, ok := policy.peerMutex[peer]
-	if !ok {
-		policy.peerMutex[peer] = &sync.Mutex{}
-		mutex = policy.peerMutex[peer]
+// connectedAddrs searches a new snapshot, which holds the records
+// written so far in the conversation
+func (policy *ExternalGraphDiffPolicy) connectedAddrs(key conversationKey, hashes []gdp.Hash) ([]gdp.Hash, error) {
+	snapshot, err := policy.getSnapshot(key)
+	if err != nil {
+		return nil, err
 	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	addrs := getConnectedAddrs(snapshot, hashes)
+	return addrs, snapshot.Err()
+}
 
-	_, ok = policy.snapshotInUse[peer]
-	if !ok {
-		policy.snapshotInUse[peer] = nil
+// addRecords registers records in the snapshot of the conversation
+func (policy *ExternalGraphDiffPolicy) addRecords(key conversationKey, records []gdp.Record) error {
+	snapshot := policy.peers.get(key.peer).snapshotInUse[key]
+	if snapshot == nil {
+		return nil
 	}
 
-	_, ok = policy.peerLastMsgType[peer]
-	if !ok {
-		policy.peerLastMsgType[peer] = noMsgExchanged
-	}
+	snapshot.RegisterNewRecords(records)
+	return snapshot.Err()
 }
 
-// resetPeerState resets a peer's state to before any contact
-// Assumes that the mutex of peer is held by caller
-func (policy *ExternalGraphDiffPolicy) resetPeerStatus(peer gdp.Hash) {
-	snapshot, ok := policy.snapshotInUse[peer]
-	if ok && snapshot != nil {
-		policy.logserver.DestroySnapshot(policy.snapshotInUse[peer])
+func (policy *ExternalGraphDiffPolicy) releaseGraph(key conversationKey) {
+	state := policy.peers.get(key.peer)
+
+	if snapshot := state.snapshotInUse[key]; snapshot != nil {
+		policy.logserver.DestroySnapshot(snapshot)
 	}
-	policy.snapshotInUse[peer] = nil
-	policy.peerLastMsgType[peer] = noMsgExchanged
+	delete(state.snapshotInUse, key)
 }
 
 // Below are handlers for specific messages
-// Handlers assume the mutex of the src is held by caller
-func (policy *ExternalGraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
+// Handlers assume the mutex of the peer is held by caller
+func (policy *ExternalGraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error) {
+	state := policy.peers.get(key.peer)
+
 	var snapshot *logserver.Snapshot
-	snapshot, err := policy.getSnapshot(src)
+	snapshot, err := policy.getSnapshot(key)
 	if err != nil {
 		return nil, err
 	}
 
-	policy.peerLastMsgType[src] = firstMsgRecved
+	state.peerLastMsgType[key] = firstMsgRecved
 
 	// Now that we have peer begins and ends, we start processing
 	_, _, peerBeginsNotMatched, peerEndsNotMatched :=
@@ -218,9 +191,14 @@ func (policy *ExternalGraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src
 		}
 	}
 
-	recordsNotInRX, err := policy.logserver.ReadRecords(nodesToSend)
+	if err = snapshot.Err(); err != nil {
+		policy.peers.reset(key)
+		return nil, err
+	}
+
+	recordsNotInRX, more, err := state.stream.start(key, nodesToSend, policy.logserver.ReadRecords)
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.peers.reset(key)
 		return nil, err
 	}
 
@@ -229,9 +207,11 @@ func (policy *ExternalGraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src
 		RecordsNotInRX: recordsNotInRX,
 		LogicalBegins:  snapshot.GetLogicalBegins(),
 		LogicalEnds:    snapshot.GetLogicalEnds(),
+		MoreRecords:    more,
+		Session:        key.session,
 	}
 
-	policy.peerLastMsgType[src] = firstMsgRecved
+	state.peerLastMsgType[key] = firstMsgRecved
 	zap.S().Infow(
 		"Generating second message",
 		"numRecords", len(msgContent.RecordsNotInRX),
@@ -242,10 +222,20 @@ func (policy *ExternalGraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src
 	return msgContent, nil
 }
 
-func (policy *ExternalGraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
+func (policy *ExternalGraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error) {
+	state := policy.peers.get(key.peer)
+
 	var snapshot *logserver.Snapshot
-	snapshot, err := policy.getSnapshot(src)
+	snapshot, err := policy.getSnapshot(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Records the peer found we lack join the snapshot before the
+	// digests are compared
+	err = policy.peers.acceptBatch(msg.RecordsNotInRX, key)
 	if err != nil {
+		policy.peers.reset(key)
 		return nil, err
 	}
 
@@ -309,9 +299,15 @@ func (policy *ExternalGraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, sr
 
 	componentsToSend = getConnectedAddrs(snapshot, componentsToSend)
 	nodesToSend = append(nodesToSend, componentsToSend...)
-	recordsToSend, err := policy.logserver.ReadRecords(nodesToSend)
+	if err = snapshot.Err(); err != nil {
+		policy.peers.reset(key)
+		return nil, err
+	}
+	setDivergence(ExternalGraphDiffPolicyName, key.peer, len(nodesToSend)+len(requests))
+
+	recordsToSend, more, err := state.stream.start(key, nodesToSend, policy.logserver.ReadRecords)
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.peers.reset(key)
 		return nil, err
 	}
 
@@ -319,64 +315,14 @@ func (policy *ExternalGraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, sr
 		Num:            third,
 		HashesTXWants:  requests,
 		RecordsNotInRX: recordsToSend,
+		MoreRecords:    more,
+		Session:        key.session,
 	}
 
 	zap.S().Infow(
 		"Generating message third",
 	)
 
-	policy.peerLastMsgType[src] = thirdMsgSent
+	state.peerLastMsgType[key] = thirdMsgSent
 	return resp, nil
 }
-
-func (policy *ExternalGraphDiffPolicy) processThirdMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
-	var snapshot *logserver.Snapshot
-	snapshot, err := policy.getSnapshot(src)
-	if err != nil {
-		return nil, err
-	}
-
-	snapshot.RegisterNewRecords(msg.RecordsNotInRX)
-	err = policy.logserver.WriteRecords(msg.RecordsNotInRX)
-	if err != nil {
-		policy.resetPeerStatus(src)
-		return nil, err
-	}
-
-	reqAddrs := msg.HashesTXWants
-
-	// For each addr requested, send the entire connected component
-	addrs := getConnectedAddrs(snapshot, reqAddrs)
-	recordsRXWants, err := policy.logserver.ReadRecords(addrs)
-	if err != nil {
-		policy.resetPeerStatus(src)
-		return nil, err
-	}
-
-	resp := &GraphMsgContent{
-		Num:            fourth,
-		RecordsNotInRX: recordsRXWants,
-	}
-
-	zap.S().Infow(
-		"Generating fourth message",
-		"numRecords", len(recordsRXWants),
-	)
-
-	// When to revert to netural state?
-	policy.peerLastMsgType[src] = thirdMsgRecved
-
-	return resp, nil
-}
-
-func (policy *ExternalGraphDiffPolicy) processFourthMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
-	err := policy.logserver.WriteRecords(msg.RecordsNotInRX)
-	if err != nil {
-		policy.resetPeerStatus(src)
-		return nil, err
-	}
-
-	// last message, nothing to respond, reset state
-	policy.resetPeerStatus(src)
-	return nil, ErrConversationFinished
-}
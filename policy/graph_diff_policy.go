@@ -2,10 +2,11 @@ package policy
 
 import (
 	"errors"
-	"sync"
+	"time"
 
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/trace"
 	"go.uber.org/zap"
 )
 
@@ -41,16 +42,8 @@ const (
 type GraphDiffPolicy struct {
 	graph loggraph.LogGraph // most up to date graph
 
-	// current graph in use for a specific peer
-	// should reset to nil when message exchange ends
-	graphInUse map[gdp.Hash]loggraph.LogGraphClone
-
-	// last message sent to the peer
-	// used to keep track of message exchanges state
-	peerLastMsgType map[gdp.Hash]PeerState
-
-	// mutex for each peer
-	peerMutex map[gdp.Hash]*sync.Mutex
+	// state of the conversations with each peer
+	peers *graphPeers
 }
 
 type GraphMsgContent struct {
@@ -59,6 +52,12 @@ type GraphMsgContent struct {
 	LogicalEnds    []gdp.Hash
 	RecordsNotInRX []gdp.Record
 	HashesTXWants  []gdp.Hash
+
+	// RecordsNotInRX is only the first batch, see recordStream
+	MoreRecords bool
+
+	// Session identifies the conversation, see conversationKey
+	Session uint64
 }
 
 // Context for a specific peer
@@ -69,40 +68,55 @@ type peerPolicyContext struct {
 
 // NewGraphDiffPolicy constructs policy
 func NewGraphDiffPolicy(graph loggraph.LogGraph) *GraphDiffPolicy {
-	return &GraphDiffPolicy{
-		graph:           graph,
-		graphInUse:      make(map[gdp.Hash]loggraph.LogGraphClone),
-		peerLastMsgType: make(map[gdp.Hash]PeerState),
-		peerMutex:       make(map[gdp.Hash]*sync.Mutex),
-	}
+	policy := &GraphDiffPolicy{graph: graph}
+	policy.peers = newGraphPeers(GraphDiffPolicyName, graph, policy)
+	return policy
 }
 
-// initPeerIfNeeded initializes a peer's state for use if necessary.
-func (policy *GraphDiffPolicy) initPeerIfNeeded(peer gdp.Hash) {
-	mutex, ok := policy.peerMutex[peer]
-	if !ok {
-		policy.peerMutex[peer] = &sync.Mutex{}
-		mutex = policy.peerMutex[peer]
-	}
+// SetBatchSize sets the max number of records sent in one message.
+// Records are sent in a single message if size <= 0.
+func (policy *GraphDiffPolicy) SetBatchSize(size int) {
+	policy.peers.setBatchSize(size)
+}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+// SetRecordVerifier sets the verifier used to check records received
+// from peers. A nil verifier disables verification.
+func (policy *GraphDiffPolicy) SetRecordVerifier(verifier gdp.RecordVerifier) {
+	policy.peers.verifier = verifier
+}
 
-	_, ok = policy.graphInUse[peer]
-	if !ok {
-		policy.graphInUse[peer] = nil
-	}
+// SetTracer sets the tracer of records written from peers, see package
+// trace. A nil tracer disables tracing.
+func (policy *GraphDiffPolicy) SetTracer(tracer *trace.Tracer) {
+	policy.peers.tracer = tracer
+}
 
-	_, ok = policy.peerLastMsgType[peer]
-	if !ok {
-		policy.peerLastMsgType[peer] = noMsgExchanged
-	}
+// SetConversationTimeout sets how long a conversation may be idle
+// before it is aborted. Conversations never time out if timeout <= 0.
+func (policy *GraphDiffPolicy) SetConversationTimeout(timeout time.Duration) {
+	policy.peers.timer.setTimeout(timeout)
+}
+
+// SetAbortHandler sets the handler notified of aborted conversations
+func (policy *GraphDiffPolicy) SetAbortHandler(handler AbortHandler) {
+	policy.peers.timer.setAbortHandler(handler)
+}
+
+// Conversations returns the conversations in progress
+func (policy *GraphDiffPolicy) Conversations() []Conversation {
+	return policy.peers.timer.conversations()
 }
 
-// resetPeerState resets a peer's state to before any contact
-func (policy *GraphDiffPolicy) resetPeerStatus(peer gdp.Hash) {
-	policy.graphInUse[peer] = nil
-	policy.peerLastMsgType[peer] = noMsgExchanged
+// ExpireConversations aborts conversations past their deadline and
+// releases the graph clones held for them
+func (policy *GraphDiffPolicy) ExpireConversations() []gdp.Hash {
+	return policy.peers.expireConversations()
+}
+
+// AbortConversations aborts all conversations and releases the
+// graph clones held for them
+func (policy *GraphDiffPolicy) AbortConversations() []gdp.Hash {
+	return policy.peers.abortConversations()
 }
 
 // GenerateMessage begins the heartbeat process with a peer
@@ -110,130 +124,66 @@ func (policy *GraphDiffPolicy) GenerateMessage(dest gdp.Hash) (
 	interface{},
 	error,
 ) {
-	policy.initPeerIfNeeded(dest)
+	return policy.peers.generateMessage(dest)
+}
+
+func (policy *GraphDiffPolicy) ProcessMessage(src gdp.Hash, packedMsg interface{}) (
+	interface{},
+	error,
+) {
+	return policy.peers.processMessage(src, packedMsg)
+}
 
-	policy.peerMutex[dest].Lock()
-	defer policy.peerMutex[dest].Unlock()
+// Below are the hooks of graphSource, on clones of the graph
+// Hooks assume the mutex of the peer is held by caller
 
-	// update states to firstMsgSent
+func (policy *GraphDiffPolicy) openGraph(key conversationKey) ([]gdp.Hash, []gdp.Hash, error) {
 	clone, err := policy.graph.CreateClone()
 	if err != nil {
 		zap.S().Errorw(
 			"Failed to clone graph",
 			"error", err,
 		)
-		return nil, err
+		return nil, nil, err
 	}
 
-	policy.graphInUse[dest] = clone
-	policy.peerLastMsgType[dest] = firstMsgSent
-
-	// generate message
-	content := &GraphMsgContent{
-		Num:           first,
-		LogicalBegins: policy.graphInUse[dest].GetLogicalBegins(),
-		LogicalEnds:   policy.graphInUse[dest].GetLogicalEnds(),
-	}
-
-	zap.S().Infow("Generate first msg")
-	return content, nil
+	policy.peers.get(key.peer).graphInUse[key] = clone
+	return clone.GetLogicalBegins(), clone.GetLogicalEnds(), nil
 }
 
-func (policy *GraphDiffPolicy) ProcessMessage(src gdp.Hash, packedMsg interface{}) (
-	interface{},
-	error,
-) {
-	zap.S().Debugw(
-		"processing message",
-		"src", src.Readable(),
-	)
-
-	msg, ok := packedMsg.(*GraphMsgContent)
-	if !ok {
-		return nil, errConversionError
-	}
-	policy.initPeerIfNeeded(src)
-
-	policy.peerMutex[src].Lock()
-	defer policy.peerMutex[src].Unlock()
-
-	peerStatus := policy.peerLastMsgType[src]
-
-	// validate peer status with incoming message
-	// if status doesn't match the message type, simply reset the state machine
-	switch msg.Num {
-	case first:
-		if peerStatus != noMsgExchanged {
-			policy.resetPeerStatus(src)
-			zap.S().Errorw(
-				"inconsistent state and msg",
-				"peerStatus", peerStatus,
-				"msgNum", msg.Num,
-			)
-			return nil, errInconsistentStateAndMessage
-		}
-
-		return policy.processFirstMsg(msg, src)
-	case second:
-		if peerStatus != firstMsgSent {
-			policy.resetPeerStatus(src)
-			zap.S().Errorw(
-				"inconsistent state and msg",
-				"peerStatus", peerStatus,
-				"msgNum", msg.Num,
-			)
-			return nil, errInconsistentStateAndMessage
-		}
-
-		return policy.processSecondMsg(msg, src)
-	case third:
-		if peerStatus != firstMsgRecved {
-			policy.resetPeerStatus(src)
-			zap.S().Errorw(
-				"inconsistent state and msg",
-				"peerStatus", peerStatus,
-				"msgNum", msg.Num,
-			)
-			return nil, errInconsistentStateAndMessage
-		}
-
-		return policy.processThirdMsg(msg, src)
-	case fourth:
-		if peerStatus != thirdMsgSent {
-			policy.resetPeerStatus(src)
-			zap.S().Errorw(
-				"inconsistent state and msg",
-				"peerStatus", peerStatus,
-				"msgNum", msg.Num,
-			)
-			return nil, errInconsistentStateAndMessage
-		}
+func (policy *GraphDiffPolicy) connectedAddrs(key conversationKey, hashes []gdp.Hash) ([]gdp.Hash, error) {
+	return policy.getPeerPolicyContext(key).getConnectedAddrs(hashes), nil
+}
 
-		return policy.processFourthMsg(msg, src)
-	default:
-		return nil, errUnknownMessageType
-	}
+// addRecords does nothing, the clone of a conversation is not updated
+func (policy *GraphDiffPolicy) addRecords(key conversationKey, records []gdp.Record) error {
+	return nil
+}
 
+func (policy *GraphDiffPolicy) releaseGraph(key conversationKey) {
+	delete(policy.peers.get(key.peer).graphInUse, key)
 }
 
 // Below are handlers for specific messages
-// Handlers assume the mutex of the src is held by caller
-func (policy *GraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
+// Handlers assume the mutex of the peer is held by caller
+func (policy *GraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error) {
+	state := policy.peers.get(key.peer)
+
 	clone, err := policy.graph.CreateClone()
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.peers.reset(key)
 		return nil, err
 	}
-	policy.graphInUse[src] = clone
-	policy.peerLastMsgType[src] = firstMsgRecved
+	state.graphInUse[key] = clone
+	state.peerLastMsgType[key] = firstMsgRecved
 
-	ctx := policy.getPeerPolicyContext(src)
+	ctx := policy.getPeerPolicyContext(key)
 
 	// Now that we have peer begins and ends, we start processing
 	_, _, peerBeginsNotMatched, peerEndsNotMatched :=
 		ctx.compareBeginsEnds(msg.LogicalBegins, msg.LogicalEnds)
 
-	graph := policy.graphInUse[src]
+	graph := state.graphInUse[key]
 	nodeMap := graph.GetNodeMap()
 
 	nodesToSend := make([]gdp.Hash, 0)
@@ -258,9 +208,9 @@ func (policy *GraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src gdp.Has
 		}
 	}
 
-	recordsNotInRX, err := policy.graph.ReadRecords(nodesToSend)
+	recordsNotInRX, more, err := state.stream.start(key, nodesToSend, policy.graph.ReadRecords)
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.peers.reset(key)
 		return nil, err
 	}
 
@@ -269,9 +219,11 @@ func (policy *GraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src gdp.Has
 		RecordsNotInRX: recordsNotInRX,
 		LogicalBegins:  graph.GetLogicalBegins(),
 		LogicalEnds:    graph.GetLogicalEnds(),
+		MoreRecords:    more,
+		Session:        key.session,
 	}
 
-	policy.peerLastMsgType[src] = firstMsgRecved
+	state.peerLastMsgType[key] = firstMsgRecved
 	zap.S().Infow(
 		"Generating second message",
 		"numRecords", len(msgContent.RecordsNotInRX),
@@ -282,11 +234,18 @@ func (policy *GraphDiffPolicy) processFirstMsg(msg *GraphMsgContent, src gdp.Has
 	return msgContent, nil
 }
 
-func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
-	ctx := policy.getPeerPolicyContext(src)
+func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error) {
+	state := policy.peers.get(key.peer)
 
-	// Since the data section has been used to update the graph, we can compare digest of the
-	// peer's graph with up-to-date information
+	// Records the peer found we lack are written before the digests
+	// are compared
+	err := policy.peers.acceptBatch(msg.RecordsNotInRX, key)
+	if err != nil {
+		policy.peers.reset(key)
+		return nil, err
+	}
+
+	ctx := policy.getPeerPolicyContext(key)
 
 	myBeginsNotMatched,
 		myEndsNotMatched,
@@ -294,7 +253,7 @@ func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, src gdp.Ha
 		peerEndsNotMatched :=
 		ctx.compareBeginsEnds(msg.LogicalBegins, msg.LogicalEnds)
 
-	graph := policy.graphInUse[src]
+	graph := state.graphInUse[key]
 	nodeMap := graph.GetNodeMap()
 
 	nodesToSend := make([]gdp.Hash, 0)
@@ -351,9 +310,10 @@ func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, src gdp.Ha
 
 	componentsToSend = ctx.getConnectedAddrs(componentsToSend)
 	nodesToSend = append(nodesToSend, componentsToSend...)
-	recordsToSend, err := policy.graph.ReadRecords(nodesToSend)
+	setDivergence(GraphDiffPolicyName, key.peer, len(nodesToSend)+len(requests))
+	recordsToSend, more, err := state.stream.start(key, nodesToSend, policy.graph.ReadRecords)
 	if err != nil {
-		policy.resetPeerStatus(src)
+		policy.peers.reset(key)
 		return nil, err
 	}
 
@@ -361,59 +321,14 @@ func (policy *GraphDiffPolicy) processSecondMsg(msg *GraphMsgContent, src gdp.Ha
 		Num:            third,
 		HashesTXWants:  requests,
 		RecordsNotInRX: recordsToSend,
+		MoreRecords:    more,
+		Session:        key.session,
 	}
 
 	zap.S().Infow(
 		"Generating message third",
 	)
 
-	policy.peerLastMsgType[src] = thirdMsgSent
-	return resp, nil
-}
-
-func (policy *GraphDiffPolicy) processThirdMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
-	ctx := policy.getPeerPolicyContext(src)
-
-	err := policy.graph.WriteRecords(msg.RecordsNotInRX)
-	if err != nil {
-		policy.resetPeerStatus(src)
-		return nil, err
-	}
-
-	reqAddrs := msg.HashesTXWants
-
-	// For each addr requested, send the entire connected component
-	addrs := ctx.getConnectedAddrs(reqAddrs)
-	recordsRXWants, err := policy.graph.ReadRecords(addrs)
-	if err != nil {
-		policy.resetPeerStatus(src)
-		return nil, err
-	}
-
-	resp := &GraphMsgContent{
-		Num:            fourth,
-		RecordsNotInRX: recordsRXWants,
-	}
-
-	zap.S().Infow(
-		"Generating fourth message",
-		"numRecords", len(recordsRXWants),
-	)
-
-	// When to revert to netural state?
-	policy.peerLastMsgType[src] = thirdMsgRecved
-
+	state.peerLastMsgType[key] = thirdMsgSent
 	return resp, nil
 }
-
-func (policy *GraphDiffPolicy) processFourthMsg(msg *GraphMsgContent, src gdp.Hash) (*GraphMsgContent, error) {
-	err := policy.graph.WriteRecords(msg.RecordsNotInRX)
-	if err != nil {
-		policy.resetPeerStatus(src)
-		return nil, err
-	}
-
-	// last message, nothing to respond, reset state
-	policy.resetPeerStatus(src)
-	return nil, ErrConversationFinished
-}
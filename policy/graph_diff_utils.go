@@ -13,9 +13,9 @@ type graphQueryable interface {
 }
 
 // Get peer policy context
-func (policy *GraphDiffPolicy) getPeerPolicyContext(peer gdp.Hash) *peerPolicyContext {
+func (policy *GraphDiffPolicy) getPeerPolicyContext(key conversationKey) *peerPolicyContext {
 	return &peerPolicyContext{
-		graph:  policy.graphInUse[peer],
+		graph:  policy.peers.get(key.peer).graphInUse[key],
 		policy: policy,
 	}
 }
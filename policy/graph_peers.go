@@ -0,0 +1,511 @@
+package policy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/trace"
+	"go.uber.org/zap"
+)
+
+// graphPeer is the state of the conversations of a graph diff policy
+// with one peer. Messages of different peers are handled concurrently,
+// each under the mutex of its peer, which guards all other fields.
+type graphPeer struct {
+	mutex sync.Mutex
+
+	// current graph or snapshot in use for a specific conversation
+	// should be removed and released when message exchange ends
+	graphInUse    map[conversationKey]loggraph.LogGraphClone // GraphDiffPolicy
+	snapshotInUse map[conversationKey]*logserver.Snapshot    // ExternalGraphDiffPolicy
+
+	// last message sent in a conversation
+	// used to keep track of message exchanges state
+	peerLastMsgType map[conversationKey]PeerState
+
+	// session of the conversation initiated with / responded to the
+	// peer, 0 if none
+	initiated  uint64
+	responding uint64
+
+	// records still to be sent in each conversation
+	stream *recordStream
+
+	// stage message whose records are still being received
+	deferredMsg map[conversationKey]*GraphMsgContent
+}
+
+// recordStore reads and writes the records of a log
+type recordStore interface {
+	ReadRecords(hashes []gdp.Hash) ([]gdp.Record, error)
+	WriteRecords(records []gdp.Record) ([]logserver.WriteResult, error)
+}
+
+// graphSource is the part of a graph diff policy that depends on where
+// the graph of a conversation comes from, a clone of an in-memory graph
+// or a snapshot of the log server. Its methods assume the mutex of the
+// peer is held by caller.
+type graphSource interface {
+	// openGraph opens the graph of a new conversation and returns its
+	// logical begins and ends
+	openGraph(key conversationKey) ([]gdp.Hash, []gdp.Hash, error)
+
+	// processFirstMsg and processSecondMsg answer the first and second
+	// message of a conversation
+	processFirstMsg(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error)
+	processSecondMsg(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error)
+
+	// connectedAddrs returns the records connected to hashes in the
+	// graph of a conversation
+	connectedAddrs(key conversationKey, hashes []gdp.Hash) ([]gdp.Hash, error)
+
+	// addRecords adds records received in a conversation to its graph,
+	// before they are written
+	addRecords(key conversationKey, records []gdp.Record) error
+
+	// releaseGraph releases the graph of a conversation
+	releaseGraph(key conversationKey)
+}
+
+// graphPeers finds the state of each peer, creating it on first use, and
+// handles the stages and record transfers that graph diff policies
+// share. What depends on the graph is left to source.
+type graphPeers struct {
+	mutex sync.Mutex
+	peers map[gdp.Hash]*graphPeer
+
+	// batch size of the record streams of all peers
+	batchSize int
+
+	// name of the policy in metrics
+	policy string
+
+	store  recordStore
+	source graphSource
+
+	// verifies records from peers before they are written, may be nil
+	verifier gdp.RecordVerifier
+
+	// traces records written from peers, may be nil
+	tracer *trace.Tracer
+
+	// deadlines of conversations in progress
+	timer *conversationTimer
+}
+
+func newGraphPeers(policy string, store recordStore, source graphSource) *graphPeers {
+	return &graphPeers{
+		peers:     make(map[gdp.Hash]*graphPeer),
+		policy:    policy,
+		batchSize: DefaultBatchSize,
+		store:     store,
+		source:    source,
+		timer:     newConversationTimer(policy),
+	}
+}
+
+// get returns the state of peer
+func (peers *graphPeers) get(peer gdp.Hash) *graphPeer {
+	peers.mutex.Lock()
+	defer peers.mutex.Unlock()
+
+	state, ok := peers.peers[peer]
+	if !ok {
+		stream := newRecordStream(peers.policy)
+		stream.batchSize = peers.batchSize
+
+		state = &graphPeer{
+			graphInUse:      make(map[conversationKey]loggraph.LogGraphClone),
+			snapshotInUse:   make(map[conversationKey]*logserver.Snapshot),
+			peerLastMsgType: make(map[conversationKey]PeerState),
+			stream:          stream,
+			deferredMsg:     make(map[conversationKey]*GraphMsgContent),
+		}
+		peers.peers[peer] = state
+	}
+	return state
+}
+
+// all returns the states of all peers seen so far
+func (peers *graphPeers) all() []*graphPeer {
+	peers.mutex.Lock()
+	defer peers.mutex.Unlock()
+
+	states := make([]*graphPeer, 0, len(peers.peers))
+	for _, state := range peers.peers {
+		states = append(states, state)
+	}
+	return states
+}
+
+// setBatchSize sets the batch size of the record streams of all peers
+func (peers *graphPeers) setBatchSize(size int) {
+	peers.mutex.Lock()
+	peers.batchSize = size
+	peers.mutex.Unlock()
+
+	for _, state := range peers.all() {
+		state.mutex.Lock()
+		state.stream.batchSize = size
+		state.mutex.Unlock()
+	}
+}
+
+// expireConversations aborts conversations past their deadline
+func (peers *graphPeers) expireConversations() []gdp.Hash {
+	expired := make([]gdp.Hash, 0)
+	for _, key := range peers.timer.expiredConversations(time.Now()) {
+		state := peers.get(key.peer)
+		state.mutex.Lock()
+		if peers.expireIfNeeded(key) {
+			expired = append(expired, key.peer)
+		}
+		state.mutex.Unlock()
+	}
+	return expired
+}
+
+// abortConversations aborts all conversations
+func (peers *graphPeers) abortConversations() []gdp.Hash {
+	peers.timer.close()
+	return peers.expireConversations()
+}
+
+// expireIfNeeded aborts a conversation if it is past its deadline.
+// Returns true if the conversation was aborted.
+// Assumes that the mutex of the peer is held by caller
+func (peers *graphPeers) expireIfNeeded(key conversationKey) bool {
+	if !peers.timer.expired(key, time.Now()) {
+		return false
+	}
+
+	state := peers.get(key.peer)
+
+	zap.S().Infow(
+		"Conversation timed out",
+		"peer", key.peer.Readable(),
+		"session", key.session,
+		"peerStatus", state.peerLastMsgType[key],
+	)
+	peers.reset(key)
+	peers.timer.abort(key, ErrConversationTimeout)
+	return true
+}
+
+// updateDeadline extends the deadline of a conversation, or removes it
+// if the conversation is over.
+// Assumes that the mutex of the peer is held by caller
+func (peers *graphPeers) updateDeadline(key conversationKey) {
+	state := peers.get(key.peer)
+
+	_, sending := state.stream.pending[key]
+	_, receiving := state.deferredMsg[key]
+
+	if state.peerLastMsgType[key] == noMsgExchanged && !sending && !receiving {
+		peers.timer.stop(key)
+	} else {
+		peers.timer.touch(key)
+	}
+}
+
+// reset drops all state of a conversation and releases its graph
+// Assumes that the mutex of the peer is held by caller
+func (peers *graphPeers) reset(key conversationKey) {
+	state := peers.get(key.peer)
+
+	peers.source.releaseGraph(key)
+	delete(state.peerLastMsgType, key)
+	state.stream.reset(key)
+	delete(state.deferredMsg, key)
+
+	if state.initiated == key.session {
+		state.initiated = 0
+	}
+	if state.responding == key.session {
+		state.responding = 0
+	}
+}
+
+// generateMessage begins a conversation with dest
+func (peers *graphPeers) generateMessage(dest gdp.Hash) (interface{}, error) {
+	state := peers.get(dest)
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	// a new conversation replaces the one previously initiated
+	if state.initiated != 0 {
+		previous := conversationKey{dest, state.initiated}
+		peers.reset(previous)
+		peers.timer.replace(previous)
+	}
+
+	key := conversationKey{dest, newSessionID()}
+	defer peers.updateDeadline(key)
+
+	begins, ends, err := peers.source.openGraph(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// update states to firstMsgSent
+	state.peerLastMsgType[key] = firstMsgSent
+	state.initiated = key.session
+
+	content := &GraphMsgContent{
+		Num:           first,
+		LogicalBegins: begins,
+		LogicalEnds:   ends,
+		Session:       key.session,
+	}
+
+	zap.S().Infow("Generate first msg")
+	return content, nil
+}
+
+// expectedStates maps each stage message to the state of the
+// conversation it is valid in
+var expectedStates = map[int]PeerState{
+	first:  noMsgExchanged,
+	second: firstMsgSent,
+	third:  firstMsgRecved,
+	fourth: thirdMsgSent,
+}
+
+// processMessage handles a message of the conversations with src
+func (peers *graphPeers) processMessage(src gdp.Hash, packedMsg interface{}) (
+	interface{},
+	error,
+) {
+	zap.S().Debugw(
+		"processing message",
+		"src", src.Readable(),
+	)
+
+	msg, ok := packedMsg.(*GraphMsgContent)
+	if !ok {
+		return nil, errConversionError
+	}
+	defer observeStage(peers.policy, msg.Num, time.Now())
+
+	state := peers.get(src)
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	key := conversationKey{src, msg.Session}
+	defer peers.updateDeadline(key)
+
+	peers.expireIfNeeded(key)
+
+	switch msg.Num {
+	case batchRequest:
+		return peers.processBatchRequest(key)
+	case recordBatch:
+		return peers.processRecordBatch(msg, key)
+	}
+
+	expected, ok := expectedStates[msg.Num]
+	if !ok {
+		return nil, errUnknownMessageType
+	}
+
+	// validate peer status with incoming message
+	// if status doesn't match the message type, simply reset the state machine
+	peerStatus := state.peerLastMsgType[key]
+	if peerStatus != expected {
+		peers.reset(key)
+		zap.S().Errorw(
+			"inconsistent state and msg",
+			"peerStatus", peerStatus,
+			"msgNum", msg.Num,
+		)
+		return nil, errInconsistentStateAndMessage
+	}
+
+	if msg.Num == first {
+		// a new conversation replaces the one previously responded to
+		if state.responding != 0 {
+			previous := conversationKey{src, state.responding}
+			peers.reset(previous)
+			peers.timer.replace(previous)
+		}
+		state.responding = key.session
+
+		return peers.source.processFirstMsg(msg, key)
+	}
+
+	if msg.MoreRecords {
+		return peers.deferStage(msg, key)
+	}
+	return peers.processStage(msg, key)
+}
+
+// processStage answers a stage message after the first whose records
+// are all received
+// Assumes that the mutex of the peer is held by caller
+func (peers *graphPeers) processStage(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error) {
+	switch msg.Num {
+	case second:
+		return peers.source.processSecondMsg(msg, key)
+	case third:
+		return peers.processThirdMsg(msg, key)
+	case fourth:
+		return peers.processFourthMsg(msg, key)
+	default:
+		peers.reset(key)
+		return nil, errUnknownMessageType
+	}
+}
+
+// processThirdMsg writes the records of the third message and answers
+// with the connected components it requests
+// Assumes that the mutex of the peer is held by caller
+func (peers *graphPeers) processThirdMsg(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error) {
+	state := peers.get(key.peer)
+
+	err := peers.acceptBatch(msg.RecordsNotInRX, key)
+	if err != nil {
+		peers.reset(key)
+		return nil, err
+	}
+
+	// For each addr requested, send the entire connected component
+	addrs, err := peers.source.connectedAddrs(key, msg.HashesTXWants)
+	if err != nil {
+		peers.reset(key)
+		return nil, err
+	}
+
+	recordsRXWants, more, err := state.stream.start(key, addrs, peers.store.ReadRecords)
+	if err != nil {
+		peers.reset(key)
+		return nil, err
+	}
+
+	resp := &GraphMsgContent{
+		Num:            fourth,
+		RecordsNotInRX: recordsRXWants,
+		MoreRecords:    more,
+		Session:        key.session,
+	}
+
+	zap.S().Infow(
+		"Generating fourth message",
+		"numRecords", len(recordsRXWants),
+	)
+
+	// The conversation is over once all records are sent
+	if more {
+		state.peerLastMsgType[key] = thirdMsgRecved
+	} else {
+		peers.reset(key)
+	}
+
+	return resp, nil
+}
+
+// processFourthMsg writes the records of the last message
+// Assumes that the mutex of the peer is held by caller
+func (peers *graphPeers) processFourthMsg(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error) {
+	err := peers.acceptBatch(msg.RecordsNotInRX, key)
+
+	// last message, nothing to respond, reset state
+	peers.reset(key)
+	if err != nil {
+		return nil, err
+	}
+	return nil, ErrConversationFinished
+}
+
+// Below are handlers for record transfers within a stage
+// Handlers assume the mutex of the peer is held by caller
+
+// deferStage accepts the first batch of records of a stage message and
+// keeps the message until all batches are received
+func (peers *graphPeers) deferStage(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error) {
+	state := peers.get(key.peer)
+
+	err := peers.acceptBatch(msg.RecordsNotInRX, key)
+	if err != nil {
+		peers.reset(key)
+		return nil, err
+	}
+
+	msg.RecordsNotInRX = nil
+	msg.MoreRecords = false
+	state.deferredMsg[key] = msg
+
+	return &GraphMsgContent{Num: batchRequest, Session: key.session}, nil
+}
+
+func (peers *graphPeers) processBatchRequest(key conversationKey) (*GraphMsgContent, error) {
+	state := peers.get(key.peer)
+
+	records, more, err := state.stream.next(key, peers.store.ReadRecords)
+	if err != nil {
+		peers.reset(key)
+		return nil, err
+	}
+
+	zap.S().Debugw(
+		"Sending record batch",
+		"numRecords", len(records),
+		"more", more,
+	)
+
+	// The last batch of the fourth message ends the conversation
+	if !more && state.peerLastMsgType[key] == thirdMsgRecved {
+		peers.reset(key)
+	}
+
+	return &GraphMsgContent{
+		Num:            recordBatch,
+		RecordsNotInRX: records,
+		MoreRecords:    more,
+		Session:        key.session,
+	}, nil
+}
+
+func (peers *graphPeers) processRecordBatch(msg *GraphMsgContent, key conversationKey) (*GraphMsgContent, error) {
+	state := peers.get(key.peer)
+
+	deferred, ok := state.deferredMsg[key]
+	if !ok {
+		peers.reset(key)
+		return nil, errInconsistentStateAndMessage
+	}
+
+	err := peers.acceptBatch(msg.RecordsNotInRX, key)
+	if err != nil {
+		peers.reset(key)
+		return nil, err
+	}
+
+	if msg.MoreRecords {
+		return &GraphMsgContent{Num: batchRequest, Session: key.session}, nil
+	}
+
+	// All records received, resume the stage
+	delete(state.deferredMsg, key)
+	return peers.processStage(deferred, key)
+}
+
+// acceptBatch verifies and writes a batch of records received in a
+// stage message, after adding them to the graph of the conversation
+func (peers *graphPeers) acceptBatch(records []gdp.Record, key conversationKey) error {
+	receivedRecords(peers.policy, records)
+	err := verifyRecords(peers.verifier, key.peer, records)
+	if err != nil {
+		return err
+	}
+
+	err = peers.source.addRecords(key, records)
+	if err != nil {
+		return err
+	}
+
+	_, err = writeRecords(peers.store.WriteRecords, peers.tracer, key.peer, records)
+	return err
+}
@@ -0,0 +1,138 @@
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// number of cells each key is added to
+const ibltHashCount = 3
+
+var errIBLTSizeMismatch = errors.New("IBLTs of different sizes")
+
+// IBLTCell is a cell of an invertible Bloom lookup table
+type IBLTCell struct {
+	Count   int
+	KeySum  gdp.Hash // XOR of keys
+	HashSum uint64   // XOR of key checksums
+}
+
+// iblt is an invertible Bloom lookup table over record hashes. The
+// difference of two tables can be decoded into the keys only one of
+// them holds, as long as the number of such keys is small compared to
+// the size of the tables.
+type iblt struct {
+	cells []IBLTCell
+}
+
+// newIBLT creates a table with at least size cells
+func newIBLT(size int) *iblt {
+	if size < ibltHashCount {
+		size = ibltHashCount
+	}
+
+	// each hash function maps to its own range of cells
+	if size%ibltHashCount != 0 {
+		size += ibltHashCount - size%ibltHashCount
+	}
+	return &iblt{cells: make([]IBLTCell, size)}
+}
+
+// ibltSize returns the number of cells needed to decode a difference of
+// about diff keys
+func ibltSize(diff int) int {
+	return 2*diff + 2*ibltHashCount
+}
+
+// keyChecksum distinguishes cells holding a single key
+func keyChecksum(key gdp.Hash) uint64 {
+	sum := sha256.Sum256(key[:])
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// indices returns the cells a key is added to. Record hashes are
+// uniformly distributed, so their bytes are used as hash functions.
+func (table *iblt) indices(key gdp.Hash) [ibltHashCount]int {
+	var indices [ibltHashCount]int
+	width := len(table.cells) / ibltHashCount
+	for i := range indices {
+		h := binary.BigEndian.Uint64(key[8*i : 8*i+8])
+		indices[i] = i*width + int(h%uint64(width))
+	}
+	return indices
+}
+
+func (table *iblt) update(key gdp.Hash, delta int) {
+	checksum := keyChecksum(key)
+	for _, i := range table.indices(key) {
+		cell := &table.cells[i]
+		cell.Count += delta
+		xorHash(&cell.KeySum, key)
+		cell.HashSum ^= checksum
+	}
+}
+
+func (table *iblt) insert(key gdp.Hash) {
+	table.update(key, 1)
+}
+
+// subtract returns a table holding the keys of table minus the keys of
+// other
+func (table *iblt) subtract(other *iblt) (*iblt, error) {
+	if len(table.cells) != len(other.cells) {
+		return nil, errIBLTSizeMismatch
+	}
+
+	diff := &iblt{cells: make([]IBLTCell, len(table.cells))}
+	for i := range table.cells {
+		diff.cells[i] = IBLTCell{
+			Count:   table.cells[i].Count - other.cells[i].Count,
+			KeySum:  table.cells[i].KeySum,
+			HashSum: table.cells[i].HashSum ^ other.cells[i].HashSum,
+		}
+		xorHash(&diff.cells[i].KeySum, other.cells[i].KeySum)
+	}
+	return diff, nil
+}
+
+// decode lists the keys of a difference table, added is the keys of the
+// minuend only and removed the keys of the subtrahend only. Returns
+// false if the difference is too large for the table. The table is
+// emptied in the process.
+func (table *iblt) decode() (added, removed []gdp.Hash, ok bool) {
+	for progress := true; progress; {
+		progress = false
+		for i := range table.cells {
+			cell := table.cells[i]
+			if cell.Count != 1 && cell.Count != -1 {
+				continue
+			}
+			if keyChecksum(cell.KeySum) != cell.HashSum {
+				continue
+			}
+
+			if cell.Count == 1 {
+				added = append(added, cell.KeySum)
+			} else {
+				removed = append(removed, cell.KeySum)
+			}
+			table.update(cell.KeySum, -cell.Count)
+			progress = true
+
+			// a table cannot hold more keys than cells
+			if len(added)+len(removed) > len(table.cells) {
+				return nil, nil, false
+			}
+		}
+	}
+
+	for _, cell := range table.cells {
+		if cell.Count != 0 || cell.HashSum != 0 || cell.KeySum != gdp.NullHash {
+			return nil, nil, false
+		}
+	}
+	return added, removed, true
+}
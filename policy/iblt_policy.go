@@ -0,0 +1,284 @@
+package policy
+
+import (
+	"errors"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/trace"
+	"go.uber.org/zap"
+)
+
+/*
+IBLTPolicy replaces the full hash list of the first NaivePolicy message
+with an invertible Bloom lookup table, see iblt, sized for the expected
+difference between the replicas.
+
+1. The initiator sends its table.
+2. The receiver subtracts its own table and decodes the difference. On
+   success it answers with the second NaivePolicy message built from the
+   decoded hashes, and the exchange continues as a NaivePolicy exchange.
+   Otherwise it asks the initiator to fall back to NaivePolicy.
+
+The expected difference with each peer is learned from past exchanges.
+*/
+
+// DefaultExpectedDifference is the difference a table is sized for when
+// nothing is known about a peer
+const DefaultExpectedDifference = 32
+
+// max difference a table is sized for after failed decodings
+const maxExpectedDifference = 1 << 16
+
+var errIBLTMsgContentConversion = errors.New(
+	"Unable to cast packedMsg to *IBLTMsgContent",
+)
+
+// IBLTMsgContent holds the set reconciliation messages of IBLTPolicy.
+// Messages of the following exchange are NaiveMsgContent.
+type IBLTMsgContent struct {
+	Num   int
+	Cells []IBLTCell
+
+	// Number of records only one of the peers holds
+	Difference int
+
+	// Fallback asks the initiator to restart with NaivePolicy
+	Fallback bool
+
+	// Second message of the NaivePolicy exchange, nil if in sync
+	Reply *NaiveMsgContent
+}
+
+// IBLTPolicy is a Policy that reconciles hash sets with invertible Bloom
+// lookup tables, and exchanges records like NaivePolicy.
+type IBLTPolicy struct {
+	// state, records and locking are shared with the naive exchange
+	naive *NaivePolicy
+
+	// expected difference with each peer, guarded by naive.mutex
+	estimates       map[gdp.Hash]int
+	defaultEstimate int
+}
+
+func NewIBLTPolicy(logGraph loggraph.LogGraph) *IBLTPolicy {
+	return &IBLTPolicy{
+		naive:           newNaivePolicy(logGraph, IBLTPolicyName),
+		estimates:       make(map[gdp.Hash]int),
+		defaultEstimate: DefaultExpectedDifference,
+	}
+}
+
+// SetExpectedDifference sets the difference tables are sized for when
+// nothing is known about a peer
+func (policy *IBLTPolicy) SetExpectedDifference(diff int) {
+	policy.naive.mutex.Lock()
+	defer policy.naive.mutex.Unlock()
+	policy.defaultEstimate = diff
+}
+
+// SetBatchSize sets the max number of records sent in one message.
+// Records are sent in a single message if size <= 0.
+func (policy *IBLTPolicy) SetBatchSize(size int) {
+	policy.naive.SetBatchSize(size)
+}
+
+// SetRecordVerifier sets the verifier used to check records received
+// from peers. A nil verifier disables verification.
+func (policy *IBLTPolicy) SetRecordVerifier(verifier gdp.RecordVerifier) {
+	policy.naive.SetRecordVerifier(verifier)
+}
+
+// SetTracer sets the tracer of records written from peers, see package
+// trace. A nil tracer disables tracing.
+func (policy *IBLTPolicy) SetTracer(tracer *trace.Tracer) {
+	policy.naive.SetTracer(tracer)
+}
+
+// SetConversationTimeout sets how long a conversation may be idle
+// before it is aborted. Conversations never time out if timeout <= 0.
+func (policy *IBLTPolicy) SetConversationTimeout(timeout time.Duration) {
+	policy.naive.SetConversationTimeout(timeout)
+}
+
+// SetAbortHandler sets the handler notified of aborted conversations
+func (policy *IBLTPolicy) SetAbortHandler(handler AbortHandler) {
+	policy.naive.SetAbortHandler(handler)
+}
+
+// Conversations returns the conversations in progress
+func (policy *IBLTPolicy) Conversations() []Conversation {
+	return policy.naive.Conversations()
+}
+
+// ExpireConversations aborts conversations past their deadline
+func (policy *IBLTPolicy) ExpireConversations() []gdp.Hash {
+	return policy.naive.ExpireConversations()
+}
+
+// AbortConversations aborts all conversations
+func (policy *IBLTPolicy) AbortConversations() []gdp.Hash {
+	return policy.naive.AbortConversations()
+}
+
+// estimate returns the expected difference with peer
+// Assumes that the mutex is held by caller
+func (policy *IBLTPolicy) estimate(peer gdp.Hash) int {
+	if diff, ok := policy.estimates[peer]; ok {
+		return diff
+	}
+	return policy.defaultEstimate
+}
+
+// learnDifference updates the expected difference with peer after an
+// exchange
+// Assumes that the mutex is held by caller
+func (policy *IBLTPolicy) learnDifference(peer gdp.Hash, diff int) {
+	if diff > maxExpectedDifference {
+		diff = maxExpectedDifference
+	}
+
+	if diff > policy.defaultEstimate {
+		policy.estimates[peer] = diff
+	} else {
+		delete(policy.estimates, peer)
+	}
+}
+
+// buildTable creates a table of size cells holding all local hashes
+// Assumes that the mutex is held by caller
+func (policy *IBLTPolicy) buildTable(size int) *iblt {
+	table := newIBLT(size)
+	for _, hash := range policy.naive.getAllRecordHashes() {
+		table.insert(hash)
+	}
+	return table
+}
+
+func (policy *IBLTPolicy) GenerateMessage(dest gdp.Hash) (interface{}, error) {
+	policy.naive.mutex.Lock()
+	defer policy.naive.mutex.Unlock()
+	defer policy.naive.updateDeadline(dest)
+
+	policy.naive.initPeerIfNeeded(dest)
+
+	// a new conversation replaces any conversation in progress
+	policy.naive.resetPeer(dest)
+
+	table := policy.buildTable(ibltSize(policy.estimate(dest)))
+	policy.naive.myState[dest] = initHeartBeat
+
+	zap.S().Infow(
+		"Generate first msg",
+		"numCells", len(table.cells),
+	)
+	return &IBLTMsgContent{
+		Num:   first,
+		Cells: table.cells,
+	}, nil
+}
+
+func (policy *IBLTPolicy) ProcessMessage(src gdp.Hash, packedMsg interface{}) (
+	interface{},
+	error,
+) {
+	// The exchange following reconciliation is left to NaivePolicy
+	if msg, ok := packedMsg.(*NaiveMsgContent); ok {
+		return policy.naive.ProcessMessage(src, msg)
+	}
+
+	msg, ok := packedMsg.(*IBLTMsgContent)
+	if !ok {
+		return nil, errIBLTMsgContentConversion
+	}
+	defer observeStage(IBLTPolicyName, msg.Num, time.Now())
+
+	policy.naive.mutex.Lock()
+	defer policy.naive.mutex.Unlock()
+	defer policy.naive.updateDeadline(src)
+
+	policy.naive.initPeerIfNeeded(src)
+	policy.naive.expireIfNeeded(src)
+
+	myState := policy.naive.myState[src]
+	if myState == resting && msg.Num == first {
+		return policy.processFirstMsg(src, msg)
+	} else if myState == initHeartBeat && msg.Num == second {
+		return policy.processSecondMsg(src, msg)
+	}
+
+	zap.S().Errorw(
+		"expected different msg based on state",
+		"state", myState,
+		"msgNum", msg.Num,
+	)
+	policy.naive.resetPeer(src)
+	return nil, errInconsistentStateAndMsgNum
+}
+
+// processFirstMsg decodes the difference between the peer's table and
+// the local one
+func (policy *IBLTPolicy) processFirstMsg(src gdp.Hash, msg *IBLTMsgContent) (interface{}, error) {
+	// no peer sizes a table beyond maxExpectedDifference, a larger one
+	// would only cost memory to rebuild locally
+	if len(msg.Cells) > ibltSize(maxExpectedDifference) {
+		zap.S().Errorw(
+			"IBLT too large, falling back to naive exchange",
+			"numCells", len(msg.Cells),
+		)
+		return &IBLTMsgContent{Num: second, Fallback: true}, nil
+	}
+
+	theirs := &iblt{cells: msg.Cells}
+	diff, err := theirs.subtract(policy.buildTable(len(msg.Cells)))
+	if err != nil {
+		return nil, err
+	}
+
+	onlyTheirs, onlyMine, ok := diff.decode()
+	if !ok {
+		zap.S().Infow(
+			"Failed to decode IBLT, falling back to naive exchange",
+			"numCells", len(msg.Cells),
+		)
+		return &IBLTMsgContent{Num: second, Fallback: true}, nil
+	}
+
+	difference := len(onlyMine) + len(onlyTheirs)
+	policy.learnDifference(src, difference)
+	setDivergence(IBLTPolicyName, src, difference)
+	zap.S().Infow(
+		"Decoded IBLT",
+		"numOnlyMine", len(onlyMine),
+		"numOnlyTheirs", len(onlyTheirs),
+	)
+
+	resp := &IBLTMsgContent{Num: second, Difference: difference}
+	if difference == 0 {
+		return resp, nil
+	}
+
+	resp.Reply, err = policy.naive.respondToDifferences(src, onlyMine, onlyTheirs)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// processSecondMsg continues the exchange as a NaivePolicy exchange
+func (policy *IBLTPolicy) processSecondMsg(src gdp.Hash, msg *IBLTMsgContent) (interface{}, error) {
+	if msg.Fallback {
+		policy.learnDifference(src, 2*policy.estimate(src)+1)
+		return policy.naive.generateMessage(src), nil
+	}
+
+	policy.learnDifference(src, msg.Difference)
+	setDivergence(IBLTPolicyName, src, msg.Difference)
+
+	if msg.Reply == nil {
+		policy.naive.resetPeer(src)
+		return nil, ErrConversationFinished
+	}
+	return policy.naive.processMessage(src, msg.Reply)
+}
@@ -0,0 +1,98 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
+)
+
+func TestIBLT(t *testing.T) {
+	records := gdptest.Chain("record", 500)
+
+	a := newIBLT(ibltSize(20))
+	b := newIBLT(ibltSize(20))
+	for _, record := range records[:495] {
+		a.insert(record.Hash)
+	}
+	for _, record := range records[5:] {
+		b.insert(record.Hash)
+	}
+
+	// The difference of large sets decodes into the few differing keys
+	diff, err := a.subtract(b)
+	assert.Nil(t, err)
+	onlyA, onlyB, ok := diff.decode()
+	assert.True(t, ok)
+	assert.ElementsMatch(t, hashesOf(records[:5]), onlyA)
+	assert.ElementsMatch(t, hashesOf(records[495:]), onlyB)
+
+	// Too small a table fails to decode
+	small := newIBLT(ibltSize(1))
+	for _, record := range records {
+		small.insert(record.Hash)
+	}
+	_, _, ok = small.decode()
+	assert.False(t, ok)
+
+	_, err = a.subtract(small)
+	assert.Equal(t, errIBLTSizeMismatch, err)
+}
+
+func hashesOf(records []gdp.Record) []gdp.Hash {
+	hashes := make([]gdp.Hash, 0, len(records))
+	for _, record := range records {
+		hashes = append(hashes, record.Hash)
+	}
+	return hashes
+}
+
+func TestIBLTPolicy(t *testing.T) {
+	records := gdptest.Chain("record", 300)
+
+	a := newTestLogServer(t, "a", records[:295])
+	b := newTestLogServer(t, "b", records[5:])
+	aPolicy := NewIBLTPolicy(newTestGraph(t, a))
+	bPolicy := NewIBLTPolicy(newTestGraph(t, b))
+
+	// Small difference: one table, then the naive record exchange
+	msg, err := aPolicy.GenerateMessage(gdp.GenerateHash("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, len(newIBLT(ibltSize(DefaultExpectedDifference)).cells), len(msg.(*IBLTMsgContent).Cells))
+	assert.Equal(t, 3, runConversation(t, aPolicy, bPolicy))
+	assertSameRecords(t, a, b)
+
+	// In sync: two messages
+	assert.Equal(t, 2, runConversation(t, aPolicy, bPolicy))
+
+	// Large difference: decoding fails and the naive exchange takes over
+	c := newTestLogServer(t, "c", records[:3])
+	cPolicy := NewIBLTPolicy(newTestGraph(t, c))
+	assert.Equal(t, 5, runConversation(t, cPolicy, aPolicy))
+	assertSameRecords(t, a, c)
+	assert.True(t, cPolicy.estimate(gdp.GenerateHash("responder")) > DefaultExpectedDifference)
+}
+
+func TestIBLTPolicyOversizedTable(t *testing.T) {
+	records := gdptest.Chain("record", 10)
+
+	a := newTestLogServer(t, "a", records[:5])
+	b := newTestLogServer(t, "b", records)
+	aPolicy := NewIBLTPolicy(newTestGraph(t, a))
+	bPolicy := NewIBLTPolicy(newTestGraph(t, b))
+	aAddr, bAddr := gdp.GenerateHash("a"), gdp.GenerateHash("b")
+
+	msg, err := aPolicy.GenerateMessage(bAddr)
+	assert.Nil(t, err)
+	msg.(*IBLTMsgContent).Cells = make([]IBLTCell, ibltSize(maxExpectedDifference)+1)
+
+	// The table is not rebuilt, the naive exchange takes over
+	resp, err := bPolicy.ProcessMessage(aAddr, msg)
+	assert.Nil(t, err)
+	assert.True(t, resp.(*IBLTMsgContent).Fallback)
+
+	msg, err = aPolicy.ProcessMessage(bAddr, resp)
+	assert.Nil(t, err)
+	assert.IsType(t, &NaiveMsgContent{}, msg)
+}
@@ -0,0 +1,496 @@
+package policy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/trace"
+	"go.uber.org/zap"
+)
+
+/*
+MerklePolicy finds differences between two replicas by comparing a hash
+tree, see hashTree, instead of full hash lists.
+
+Every message of a conversation is a round that carries
+
+1. digests of subtrees the sender wants compared
+2. full hash lists of subtrees small enough to compare hash by hash
+3. hashes of records the sender wants
+4. records the receiver is missing
+
+The initiator starts with the digest of the root. Both replicas rebuild
+their tree from the log server when a conversation starts, so records
+written to the log by others, such as gdplogd, are compared. The receiver of a
+subtree digest that does not match its own either answers with the
+digests of its children, or with its hashes under the subtree once
+either side holds at most merkleLeafSize hashes there. A hash list is
+answered with the records the sender lacks and a request for the
+records the receiver lacks. The conversation ends with the first round
+that carries nothing.
+
+Rounds are stateless apart from record transfers, so the replicas only
+need to agree on the session of a transfer, see recordStream.
+*/
+
+// All rounds of a Merkle conversation share one message number
+const merkleRound = first
+
+var errMerkleMsgContentConversion = errors.New(
+	"Unable to cast packedMsg to *MerkleMsgContent",
+)
+
+// MerkleNodeDigest describes the subtree of hashes starting with Path
+type MerkleNodeDigest struct {
+	Path   []byte // nibbles from the root
+	Digest gdp.Hash
+	Count  int
+}
+
+// MerkleBucket holds all hashes starting with Path
+type MerkleBucket struct {
+	Path   []byte
+	Hashes []gdp.Hash
+}
+
+// MerkleMsgContent is a round of a MerklePolicy conversation. All fields
+// are labelled from the perspective of the sender.
+type MerkleMsgContent struct {
+	Num     int
+	Session uint64
+
+	Nodes   []MerkleNodeDigest
+	Buckets []MerkleBucket
+	Wants   []gdp.Hash
+	Records []gdp.Record
+
+	// Records is only the first batch, see recordStream
+	MoreRecords bool
+}
+
+// empty checks if a round carries nothing, which ends the conversation
+func (msg *MerkleMsgContent) empty() bool {
+	return len(msg.Nodes) == 0 &&
+		len(msg.Buckets) == 0 &&
+		len(msg.Wants) == 0 &&
+		len(msg.Records) == 0
+}
+
+// startsConversation checks if a round is the first of a conversation,
+// the only round that carries the digest of the root
+func (msg *MerkleMsgContent) startsConversation() bool {
+	for _, node := range msg.Nodes {
+		if len(node.Path) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// MerklePolicy is a Policy that compares hash trees of two replicas.
+// Messages and round trips grow with the number of differences rather
+// than with the size of the log.
+type MerklePolicy struct {
+	logServer logserver.LogServer
+	tree      *hashTree
+
+	// guards all fields below and the tree
+	mutex sync.Mutex
+
+	// verifies records from peers before they are written, may be nil
+	verifier gdp.RecordVerifier
+
+	// traces records written from peers, may be nil
+	tracer *trace.Tracer
+
+	// records still to be sent in each conversation
+	stream *recordStream
+
+	// round whose records are still being received
+	deferredMsg map[conversationKey]*MerkleMsgContent
+
+	// deadlines of record transfers in progress
+	timer *conversationTimer
+}
+
+// NewMerklePolicy constructs a MerklePolicy from the records in
+// logServer
+func NewMerklePolicy(logServer logserver.LogServer) (*MerklePolicy, error) {
+	policy := &MerklePolicy{
+		logServer:   logServer,
+		stream:      newRecordStream(MerklePolicyName),
+		deferredMsg: make(map[conversationKey]*MerkleMsgContent),
+		timer:       newConversationTimer(MerklePolicyName),
+	}
+
+	err := policy.refreshTree()
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// refreshTree rebuilds the tree from the records in the log server,
+// including records written since by others than the policy
+func (policy *MerklePolicy) refreshTree() error {
+	metadata, err := policy.logServer.ReadAllMetadata()
+	if err != nil {
+		return err
+	}
+
+	tree := newHashTree()
+	for _, metadatum := range metadata {
+		tree.insert(metadatum.Hash)
+	}
+	policy.tree = tree
+	return nil
+}
+
+// SetBatchSize sets the max number of records sent in one message.
+// Records are sent in a single message if size <= 0.
+func (policy *MerklePolicy) SetBatchSize(size int) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	policy.stream.batchSize = size
+}
+
+// SetRecordVerifier sets the verifier used to check records received
+// from peers. A nil verifier disables verification.
+func (policy *MerklePolicy) SetRecordVerifier(verifier gdp.RecordVerifier) {
+	policy.verifier = verifier
+}
+
+// SetTracer sets the tracer of records written from peers, see package
+// trace. A nil tracer disables tracing.
+func (policy *MerklePolicy) SetTracer(tracer *trace.Tracer) {
+	policy.tracer = tracer
+}
+
+// SetConversationTimeout sets how long a conversation may be idle
+// before it is aborted. Conversations never time out if timeout <= 0.
+func (policy *MerklePolicy) SetConversationTimeout(timeout time.Duration) {
+	policy.timer.setTimeout(timeout)
+}
+
+// SetAbortHandler sets the handler notified of aborted conversations
+func (policy *MerklePolicy) SetAbortHandler(handler AbortHandler) {
+	policy.timer.setAbortHandler(handler)
+}
+
+// Conversations returns the conversations in progress
+func (policy *MerklePolicy) Conversations() []Conversation {
+	return policy.timer.conversations()
+}
+
+// ExpireConversations aborts record transfers past their deadline
+func (policy *MerklePolicy) ExpireConversations() []gdp.Hash {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	expired := make([]gdp.Hash, 0)
+	for _, key := range policy.timer.expiredConversations(time.Now()) {
+		if policy.expireIfNeeded(key) {
+			expired = append(expired, key.peer)
+		}
+	}
+	return expired
+}
+
+// AbortConversations aborts all record transfers
+func (policy *MerklePolicy) AbortConversations() []gdp.Hash {
+	policy.timer.close()
+	return policy.ExpireConversations()
+}
+
+// expireIfNeeded aborts a conversation if it is past its deadline.
+// Returns true if the conversation was aborted.
+func (policy *MerklePolicy) expireIfNeeded(key conversationKey) bool {
+	if !policy.timer.expired(key, time.Now()) {
+		return false
+	}
+
+	zap.S().Infow(
+		"Conversation timed out",
+		"peer", key.peer.Readable(),
+		"session", key.session,
+	)
+	policy.resetConversation(key)
+	policy.timer.abort(key, ErrConversationTimeout)
+	return true
+}
+
+// updateDeadline extends the deadline of a conversation with a record
+// transfer in progress, or removes it otherwise
+func (policy *MerklePolicy) updateDeadline(key conversationKey) {
+	_, sending := policy.stream.pending[key]
+	_, receiving := policy.deferredMsg[key]
+
+	if sending || receiving {
+		policy.timer.touch(key)
+	} else {
+		policy.timer.stop(key)
+	}
+}
+
+// resetConversation drops the record transfers of a conversation
+func (policy *MerklePolicy) resetConversation(key conversationKey) {
+	policy.stream.reset(key)
+	delete(policy.deferredMsg, key)
+}
+
+// GenerateMessage begins a conversation with the digest of the root
+func (policy *MerklePolicy) GenerateMessage(dest gdp.Hash) (interface{}, error) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	err := policy.refreshTree()
+	if err != nil {
+		return nil, err
+	}
+
+	digest, count := policy.tree.digest(nil)
+	msg := &MerkleMsgContent{
+		Num:     merkleRound,
+		Session: newSessionID(),
+		Nodes: []MerkleNodeDigest{{
+			Path:   []byte{},
+			Digest: digest,
+			Count:  count,
+		}},
+	}
+
+	zap.S().Infow(
+		"Generate first msg",
+		"numRecords", count,
+	)
+	return msg, nil
+}
+
+func (policy *MerklePolicy) ProcessMessage(src gdp.Hash, packedMsg interface{}) (
+	interface{},
+	error,
+) {
+	zap.S().Debugw(
+		"processing message",
+		"src", src.Readable(),
+	)
+
+	msg, ok := packedMsg.(*MerkleMsgContent)
+	if !ok {
+		return nil, errMerkleMsgContentConversion
+	}
+	defer observeStage(MerklePolicyName, msg.Num, time.Now())
+
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	key := conversationKey{src, msg.Session}
+	defer policy.updateDeadline(key)
+
+	policy.expireIfNeeded(key)
+
+	switch msg.Num {
+	case batchRequest:
+		return policy.processBatchRequest(key)
+	case recordBatch:
+		return policy.processRecordBatch(msg, key)
+	case merkleRound:
+		if msg.MoreRecords {
+			return policy.deferRound(msg, key)
+		}
+		return policy.processRound(msg, key)
+	default:
+		return nil, errUnknownMessageType
+	}
+}
+
+// processRound writes the records of a round and answers its digests,
+// hash lists and requests
+func (policy *MerklePolicy) processRound(msg *MerkleMsgContent, key conversationKey) (*MerkleMsgContent, error) {
+	if msg.startsConversation() {
+		err := policy.refreshTree()
+		if err != nil {
+			policy.resetConversation(key)
+			return nil, err
+		}
+	}
+
+	err := policy.acceptBatch(msg.Records, key)
+	if err != nil {
+		policy.resetConversation(key)
+		return nil, err
+	}
+
+	resp := &MerkleMsgContent{
+		Num:     merkleRound,
+		Session: key.session,
+	}
+
+	toSend := make([]gdp.Hash, 0, len(msg.Wants))
+	toSend = append(toSend, msg.Wants...)
+
+	difference := 0
+	for _, bucket := range msg.Buckets {
+		mine := policy.tree.hashesUnder(bucket.Path)
+		onlyMine, onlyTheirs := findDifferences(mine, bucket.Hashes)
+		toSend = append(toSend, onlyMine...)
+		resp.Wants = append(resp.Wants, onlyTheirs...)
+		difference += len(onlyMine) + len(onlyTheirs)
+	}
+	if len(msg.Buckets) > 0 {
+		setDivergence(MerklePolicyName, key.peer, difference)
+	}
+
+	for _, node := range msg.Nodes {
+		policy.compareNode(node, resp)
+	}
+
+	resp.Records, resp.MoreRecords, err = policy.stream.start(key, toSend, policy.logServer.ReadRecords)
+	if err != nil {
+		policy.resetConversation(key)
+		return nil, err
+	}
+
+	if resp.empty() {
+		zap.S().Infow(
+			"Replicas in sync",
+			"peer", key.peer.Readable(),
+		)
+		setDivergence(MerklePolicyName, key.peer, 0)
+		return nil, ErrConversationFinished
+	}
+
+	zap.S().Infow(
+		"Generating round",
+		"numNodes", len(resp.Nodes),
+		"numBuckets", len(resp.Buckets),
+		"numWants", len(resp.Wants),
+		"numRecords", len(resp.Records),
+	)
+	return resp, nil
+}
+
+// compareNode compares a subtree digest of the peer with the local one
+// and adds what is needed to resolve a mismatch to resp
+func (policy *MerklePolicy) compareNode(node MerkleNodeDigest, resp *MerkleMsgContent) {
+	digest, count := policy.tree.digest(node.Path)
+	if digest == node.Digest && count == node.Count {
+		return
+	}
+
+	if count <= merkleLeafSize ||
+		node.Count <= merkleLeafSize ||
+		len(node.Path) >= merkleMaxDepth {
+		resp.Buckets = append(resp.Buckets, MerkleBucket{
+			Path:   node.Path,
+			Hashes: policy.tree.hashesUnder(node.Path),
+		})
+		return
+	}
+
+	for i := 0; i < merkleFanout; i++ {
+		path := make([]byte, len(node.Path)+1)
+		copy(path, node.Path)
+		path[len(node.Path)] = byte(i)
+
+		childDigest, childCount := policy.tree.digest(path)
+		resp.Nodes = append(resp.Nodes, MerkleNodeDigest{
+			Path:   path,
+			Digest: childDigest,
+			Count:  childCount,
+		})
+	}
+}
+
+// Below are handlers for record transfers within a round
+
+// deferRound accepts the first batch of records of a round and keeps the
+// round until all batches are received
+func (policy *MerklePolicy) deferRound(msg *MerkleMsgContent, key conversationKey) (*MerkleMsgContent, error) {
+	err := policy.acceptBatch(msg.Records, key)
+	if err != nil {
+		policy.resetConversation(key)
+		return nil, err
+	}
+
+	msg.Records = nil
+	msg.MoreRecords = false
+	policy.deferredMsg[key] = msg
+
+	return &MerkleMsgContent{Num: batchRequest, Session: key.session}, nil
+}
+
+func (policy *MerklePolicy) processBatchRequest(key conversationKey) (*MerkleMsgContent, error) {
+	records, more, err := policy.stream.next(key, policy.logServer.ReadRecords)
+	if err != nil {
+		policy.resetConversation(key)
+		return nil, err
+	}
+
+	zap.S().Debugw(
+		"Sending record batch",
+		"numRecords", len(records),
+		"more", more,
+	)
+
+	return &MerkleMsgContent{
+		Num:         recordBatch,
+		Session:     key.session,
+		Records:     records,
+		MoreRecords: more,
+	}, nil
+}
+
+func (policy *MerklePolicy) processRecordBatch(msg *MerkleMsgContent, key conversationKey) (*MerkleMsgContent, error) {
+	deferred, ok := policy.deferredMsg[key]
+	if !ok {
+		policy.resetConversation(key)
+		return nil, errInconsistentStateAndMessage
+	}
+
+	err := policy.acceptBatch(msg.Records, key)
+	if err != nil {
+		policy.resetConversation(key)
+		return nil, err
+	}
+
+	if msg.MoreRecords {
+		return &MerkleMsgContent{Num: batchRequest, Session: key.session}, nil
+	}
+
+	// All records received, resume the round
+	delete(policy.deferredMsg, key)
+	return policy.processRound(deferred, key)
+}
+
+// acceptBatch writes records received from a peer and adds them to the
+// tree
+func (policy *MerklePolicy) acceptBatch(records []gdp.Record, key conversationKey) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	receivedRecords(MerklePolicyName, records)
+	err := verifyRecords(policy.verifier, key.peer, records)
+	if err != nil {
+		return err
+	}
+
+	inserted, err := writeRecords(policy.logServer.WriteRecords, policy.tracer, key.peer, records)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range inserted {
+		policy.tree.insert(record.Hash)
+	}
+	zap.S().Infow(
+		"Wrote records",
+		"num", len(inserted),
+	)
+	return nil
+}
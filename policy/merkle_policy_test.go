@@ -0,0 +1,118 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
+)
+
+func TestHashTree(t *testing.T) {
+	records := gdptest.Chain("record", 200)
+
+	a := newHashTree()
+	b := newHashTree()
+	for i := range records {
+		assert.True(t, a.insert(records[i].Hash))
+		assert.True(t, b.insert(records[len(records)-1-i].Hash))
+	}
+	assert.False(t, a.insert(records[0].Hash))
+
+	// Digests do not depend on insertion order
+	aDigest, aCount := a.digest(nil)
+	bDigest, bCount := b.digest(nil)
+	assert.Equal(t, aDigest, bDigest)
+	assert.Equal(t, 200, aCount)
+	assert.Equal(t, 200, bCount)
+	assert.Equal(t, 200, len(a.hashesUnder([]byte{})))
+
+	// Children cover the hashes of their parent
+	total := 0
+	for i := 0; i < merkleFanout; i++ {
+		path := []byte{byte(i)}
+		_, count := a.digest(path)
+		total += count
+		for _, hash := range a.hashesUnder(path) {
+			assert.Equal(t, byte(i), nibble(hash, 0))
+		}
+	}
+	assert.Equal(t, 200, total)
+
+	extra := gdp.GenerateHash("extra")
+	assert.True(t, b.insert(extra))
+	bDigest, _ = b.digest(nil)
+	assert.NotEqual(t, aDigest, bDigest)
+	assert.True(t, b.contains(extra))
+	assert.False(t, a.contains(extra))
+}
+
+func TestMerklePolicy(t *testing.T) {
+	records := gdptest.Chain("record", 2000)
+
+	// Replicas share most records and each holds a few the other lacks
+	a := newTestLogServer(t, "a", records[:1995])
+	b := newTestLogServer(t, "b", records[5:])
+
+	aPolicy, err := NewMerklePolicy(a)
+	assert.Nil(t, err)
+	bPolicy, err := NewMerklePolicy(b)
+	assert.Nil(t, err)
+
+	numMsgs := runConversation(t, aPolicy, bPolicy)
+	assertSameRecords(t, a, b)
+
+	// A few rounds per tree level, independent of the log size
+	assert.True(t, numMsgs <= 2*merkleMaxDepth, "took %d messages", numMsgs)
+
+	aDigest, _ := aPolicy.tree.digest(nil)
+	bDigest, _ := bPolicy.tree.digest(nil)
+	assert.Equal(t, aDigest, bDigest)
+
+	// Replicas in sync finish after the first message
+	assert.Equal(t, 1, runConversation(t, aPolicy, bPolicy))
+}
+
+func TestMerkleRecordStream(t *testing.T) {
+	records := gdptest.Chain("record", 30)
+
+	long := newTestLogServer(t, "long", records)
+	short := newTestLogServer(t, "short", records[:2])
+
+	longPolicy, err := NewMerklePolicy(long)
+	assert.Nil(t, err)
+	shortPolicy, err := NewMerklePolicy(short)
+	assert.Nil(t, err)
+	longPolicy.SetBatchSize(4)
+	shortPolicy.SetBatchSize(4)
+
+	runConversation(t, shortPolicy, longPolicy)
+	assertSameRecords(t, long, short)
+	assert.Empty(t, longPolicy.stream.pending)
+	assert.Empty(t, shortPolicy.deferredMsg)
+}
+
+func TestMerkleLocalWrites(t *testing.T) {
+	records := gdptest.Chain("record", 25)
+
+	a := newTestLogServer(t, "a", records[:10])
+	b := newTestLogServer(t, "b", records[:10])
+
+	aPolicy, err := NewMerklePolicy(a)
+	assert.Nil(t, err)
+	bPolicy, err := NewMerklePolicy(b)
+	assert.Nil(t, err)
+
+	// Records appended to both logs by writers other than the policies
+	_, err = a.WriteRecords(records[10:20])
+	assert.Nil(t, err)
+	_, err = b.WriteRecords(records[20:])
+	assert.Nil(t, err)
+
+	runConversation(t, aPolicy, bPolicy)
+	assertSameRecords(t, a, b)
+
+	metadata, err := b.ReadAllMetadata()
+	assert.Nil(t, err)
+	assert.Len(t, metadata, 25)
+}
@@ -0,0 +1,145 @@
+package policy
+
+import (
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+const (
+	// number of children of an inner node, one per hash nibble
+	merkleFanout = 16
+
+	// depth of leaves, which hold the hashes
+	merkleMaxDepth = 8
+
+	// subtrees with at most this many hashes are compared hash by hash
+	merkleLeafSize = 32
+)
+
+// merkleNode is a node of a hashTree. It covers all hashes that start
+// with the nibbles on the path from the root to the node.
+type merkleNode struct {
+	// XOR of all hashes covered by the node
+	digest gdp.Hash
+	count  int
+
+	// nil for leaves
+	children []*merkleNode
+
+	// hashes covered by a leaf, nil for inner nodes
+	hashes map[gdp.Hash]bool
+}
+
+// hashTree is a prefix tree over record hashes in which every node keeps
+// a digest of the hashes it covers. Two trees holding the same hashes
+// have the same digests, regardless of insertion order.
+type hashTree struct {
+	root *merkleNode
+}
+
+func newHashTree() *hashTree {
+	return &hashTree{root: &merkleNode{}}
+}
+
+// nibble returns the i-th 4-bit digit of a hash
+func nibble(hash gdp.Hash, i int) byte {
+	if i%2 == 0 {
+		return hash[i/2] >> 4
+	}
+	return hash[i/2] & 0x0f
+}
+
+// insert adds a hash to the tree. Returns false if the hash was already
+// present.
+func (tree *hashTree) insert(hash gdp.Hash) bool {
+	if tree.contains(hash) {
+		return false
+	}
+
+	node := tree.root
+	for depth := 0; ; depth++ {
+		xorHash(&node.digest, hash)
+		node.count++
+
+		if depth == merkleMaxDepth {
+			if node.hashes == nil {
+				node.hashes = make(map[gdp.Hash]bool)
+			}
+			node.hashes[hash] = true
+			return true
+		}
+
+		if node.children == nil {
+			node.children = make([]*merkleNode, merkleFanout)
+		}
+		i := nibble(hash, depth)
+		if node.children[i] == nil {
+			node.children[i] = &merkleNode{}
+		}
+		node = node.children[i]
+	}
+}
+
+func (tree *hashTree) contains(hash gdp.Hash) bool {
+	node := tree.root
+	for depth := 0; depth < merkleMaxDepth; depth++ {
+		if node.children == nil {
+			return false
+		}
+		node = node.children[nibble(hash, depth)]
+		if node == nil {
+			return false
+		}
+	}
+	return node.hashes[hash]
+}
+
+// lookup returns the node at path, nil if no hash starts with path
+func (tree *hashTree) lookup(path []byte) *merkleNode {
+	node := tree.root
+	for _, i := range path {
+		if node.children == nil || int(i) >= merkleFanout {
+			return nil
+		}
+		node = node.children[i]
+		if node == nil {
+			return nil
+		}
+	}
+	return node
+}
+
+// digest returns the digest and number of hashes starting with path
+func (tree *hashTree) digest(path []byte) (gdp.Hash, int) {
+	node := tree.lookup(path)
+	if node == nil {
+		return gdp.NullHash, 0
+	}
+	return node.digest, node.count
+}
+
+// hashesUnder returns all hashes starting with path
+func (tree *hashTree) hashesUnder(path []byte) []gdp.Hash {
+	hashes := make([]gdp.Hash, 0)
+
+	var collect func(node *merkleNode)
+	collect = func(node *merkleNode) {
+		if node == nil {
+			return
+		}
+		for hash := range node.hashes {
+			hashes = append(hashes, hash)
+		}
+		for _, child := range node.children {
+			collect(child)
+		}
+	}
+	collect(tree.lookup(path))
+
+	return hashes
+}
+
+func xorHash(dst *gdp.Hash, src gdp.Hash) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
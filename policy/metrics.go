@@ -0,0 +1,39 @@
+package policy
+
+import (
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/metrics"
+)
+
+// stageNames label the messages of a conversation in metrics
+var stageNames = map[int]string{
+	first:        "first",
+	second:       "second",
+	third:        "third",
+	fourth:       "fourth",
+	batchRequest: "batchRequest",
+	recordBatch:  "recordBatch",
+}
+
+// observeStage records the time since start spent processing a message
+// of stage
+func observeStage(policy string, stage int, start time.Time) {
+	name, ok := stageNames[stage]
+	if !ok {
+		name = "unknown"
+	}
+	metrics.MessageDuration.WithLabelValues(policy, name).Observe(metrics.Since(start))
+}
+
+// receivedRecords counts records received from peers
+func receivedRecords(policy string, records []gdp.Record) {
+	metrics.RecordsReceived.WithLabelValues(policy).Add(float64(len(records)))
+}
+
+// setDivergence records the number of records only one of this replica
+// and peer holds
+func setDivergence(policy string, peer gdp.Hash, n int) {
+	metrics.Divergence.WithLabelValues(policy, metrics.Peer(peer)).Set(float64(n))
+}
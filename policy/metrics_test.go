@@ -0,0 +1,47 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
+	"github.com/tonyyanga/gdp-replicate/metrics"
+)
+
+func TestMetrics(t *testing.T) {
+	records := gdptest.Chain("record", 20)
+	a := newTestLogServer(t, "a", records[:12])
+	b := newTestLogServer(t, "b", records[8:])
+	aPolicy := NewIBLTPolicy(newTestGraph(t, a))
+	bPolicy := NewIBLTPolicy(newTestGraph(t, b))
+
+	initiator := metrics.Peer(gdp.GenerateHash("initiator"))
+	responder := metrics.Peer(gdp.GenerateHash("responder"))
+
+	started := metrics.ConversationsStarted.WithLabelValues(IBLTPolicyName, responder)
+	finished := metrics.ConversationsFinished.WithLabelValues(IBLTPolicyName, initiator)
+	sent := metrics.RecordsSent.WithLabelValues(IBLTPolicyName)
+	received := metrics.RecordsReceived.WithLabelValues(IBLTPolicyName)
+
+	startedBefore := testutil.ToFloat64(started)
+	finishedBefore := testutil.ToFloat64(finished)
+	sentBefore := testutil.ToFloat64(sent)
+	receivedBefore := testutil.ToFloat64(received)
+
+	runConversation(t, aPolicy, bPolicy)
+	assertSameRecords(t, a, b)
+
+	assert.Equal(t, startedBefore+1, testutil.ToFloat64(started))
+	assert.Equal(t, finishedBefore+1, testutil.ToFloat64(finished))
+	assert.Equal(t, sentBefore+16, testutil.ToFloat64(sent))
+	assert.Equal(t, receivedBefore+16, testutil.ToFloat64(received))
+
+	// Each side held 8 records the other lacked
+	assert.Equal(t, 16.0, testutil.ToFloat64(metrics.Divergence.WithLabelValues(IBLTPolicyName, initiator)))
+	assert.Equal(t, 16.0, testutil.ToFloat64(metrics.Divergence.WithLabelValues(IBLTPolicyName, responder)))
+
+	// Messages are timed by stage
+	assert.True(t, testutil.CollectAndCount(metrics.MessageDuration) > 0)
+}
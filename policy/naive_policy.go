@@ -2,9 +2,12 @@ package policy
 
 import (
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/trace"
 	"go.uber.org/zap"
 )
 
@@ -13,14 +16,131 @@ import (
 type NaivePolicy struct {
 	logGraph loggraph.LogGraph
 	myState  map[gdp.Hash]PeerState
+
+	// guards the state of all peers
+	mutex sync.Mutex
+
+	// verifies records from peers before they are written, may be nil
+	verifier gdp.RecordVerifier
+
+	// traces records written from peers, may be nil
+	tracer *trace.Tracer
+
+	// records still to be sent to each peer
+	stream *recordStream
+
+	// message whose records are still being received from a peer
+	deferredMsg map[gdp.Hash]*NaiveMsgContent
+
+	// deadlines of conversations in progress
+	timer *conversationTimer
+
+	// name of the policy in metrics
+	name string
 }
 
 func NewNaivePolicy(
 	logGraph loggraph.LogGraph,
 ) *NaivePolicy {
+	return newNaivePolicy(logGraph, NaivePolicyName)
+}
+
+// newNaivePolicy constructs a NaivePolicy reported as name in metrics
+func newNaivePolicy(logGraph loggraph.LogGraph, name string) *NaivePolicy {
 	return &NaivePolicy{
-		logGraph: logGraph,
-		myState:  make(map[gdp.Hash]PeerState),
+		logGraph:    logGraph,
+		myState:     make(map[gdp.Hash]PeerState),
+		stream:      newRecordStream(name),
+		deferredMsg: make(map[gdp.Hash]*NaiveMsgContent),
+		timer:       newConversationTimer(name),
+		name:        name,
+	}
+}
+
+// SetBatchSize sets the max number of records sent in one message.
+// Records are sent in a single message if size <= 0.
+func (policy *NaivePolicy) SetBatchSize(size int) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	policy.stream.batchSize = size
+}
+
+// SetRecordVerifier sets the verifier used to check records received
+// from peers. A nil verifier disables verification.
+func (policy *NaivePolicy) SetRecordVerifier(verifier gdp.RecordVerifier) {
+	policy.verifier = verifier
+}
+
+// SetTracer sets the tracer of records written from peers, see package
+// trace. A nil tracer disables tracing.
+func (policy *NaivePolicy) SetTracer(tracer *trace.Tracer) {
+	policy.tracer = tracer
+}
+
+// SetConversationTimeout sets how long a conversation may be idle
+// before it is aborted. Conversations never time out if timeout <= 0.
+func (policy *NaivePolicy) SetConversationTimeout(timeout time.Duration) {
+	policy.timer.setTimeout(timeout)
+}
+
+// SetAbortHandler sets the handler notified of aborted conversations
+func (policy *NaivePolicy) SetAbortHandler(handler AbortHandler) {
+	policy.timer.setAbortHandler(handler)
+}
+
+// Conversations returns the conversations in progress
+func (policy *NaivePolicy) Conversations() []Conversation {
+	return policy.timer.conversations()
+}
+
+// ExpireConversations aborts conversations past their deadline
+func (policy *NaivePolicy) ExpireConversations() []gdp.Hash {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+
+	expired := make([]gdp.Hash, 0)
+	for _, key := range policy.timer.expiredConversations(time.Now()) {
+		if policy.expireIfNeeded(key.peer) {
+			expired = append(expired, key.peer)
+		}
+	}
+	return expired
+}
+
+// AbortConversations aborts all conversations
+func (policy *NaivePolicy) AbortConversations() []gdp.Hash {
+	policy.timer.close()
+	return policy.ExpireConversations()
+}
+
+// expireIfNeeded aborts the conversation with peer if it is past its
+// deadline. Returns true if the conversation was aborted.
+func (policy *NaivePolicy) expireIfNeeded(peer gdp.Hash) bool {
+	if !policy.timer.expired(peerKey(peer), time.Now()) {
+		return false
+	}
+
+	zap.S().Infow(
+		"Conversation timed out",
+		"peer", peer.Readable(),
+		"state", policy.myState[peer],
+	)
+	policy.resetPeer(peer)
+	policy.timer.abort(peerKey(peer), ErrConversationTimeout)
+	return true
+}
+
+// updateDeadline extends the deadline of the conversation with peer,
+// or removes it if the conversation is over
+func (policy *NaivePolicy) updateDeadline(peer gdp.Hash) {
+	_, sending := policy.stream.pending[peerKey(peer)]
+	_, receiving := policy.deferredMsg[peer]
+
+	if policy.myState[peer] == resting && !sending && !receiving {
+		policy.timer.stop(peerKey(peer))
+	} else {
+		policy.timer.touch(peerKey(peer))
 	}
 }
 
@@ -34,6 +154,9 @@ type NaiveMsgContent struct {
 	HashesWeWant    []gdp.Hash
 	RecordsTheyWant []gdp.Record
 	RecordsWeWant   []gdp.Record
+
+	// RecordsWeWant is only the first batch, see recordStream
+	MoreRecords bool
 }
 
 const (
@@ -54,14 +177,27 @@ var (
 func (policy *NaivePolicy) GenerateMessage(
 	dest gdp.Hash,
 ) (interface{}, error) {
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	defer policy.updateDeadline(dest)
+
+	return policy.generateMessage(dest), nil
+}
+
+// generateMessage begins an exchange with dest.
+// Assumes that the mutex is held by caller
+func (policy *NaivePolicy) generateMessage(dest gdp.Hash) *NaiveMsgContent {
 	policy.initPeerIfNeeded(dest)
 
+	// a new conversation replaces any conversation in progress
+	policy.resetPeer(dest)
+
 	msg := &NaiveMsgContent{}
 	msg.HashesAll = policy.getAllRecordHashes()
 	msg.MsgNum = first
 
 	policy.myState[dest] = initHeartBeat
-	return msg, nil
+	return msg
 }
 
 func (policy *NaivePolicy) ProcessMessage(
@@ -72,13 +208,41 @@ func (policy *NaivePolicy) ProcessMessage(
 		"processing message",
 		"src", src.Readable(),
 	)
+	msg, ok := packedMsg.(*NaiveMsgContent)
+	if !ok {
+		return nil, errNaiveMsgContentConversion
+	}
+
+	defer observeStage(policy.name, msg.MsgNum, time.Now())
+
+	policy.mutex.Lock()
+	defer policy.mutex.Unlock()
+	defer policy.updateDeadline(src)
+
+	return policy.processMessage(src, msg)
+}
+
+// processMessage dispatches a message according to the state of src.
+// Assumes that the mutex is held by caller
+func (policy *NaivePolicy) processMessage(
+	src gdp.Hash,
+	msg *NaiveMsgContent,
+) (*NaiveMsgContent, error) {
 	policy.initPeerIfNeeded(src)
+	policy.expireIfNeeded(src)
 
 	myState := policy.myState[src]
 
-	msg, ok := packedMsg.(*NaiveMsgContent)
-	if !ok {
-		return nil, errNaiveMsgContentConversion
+	if msg.MsgNum == batchRequest {
+		return policy.processBatchRequest(src)
+	} else if msg.MsgNum == recordBatch {
+		return policy.processRecordBatch(src, msg)
+	}
+
+	if msg.MoreRecords &&
+		(myState == initHeartBeat && msg.MsgNum == second ||
+			myState == receiveHeartBeat && msg.MsgNum == third) {
+		return policy.deferMsg(src, msg)
 	}
 
 	if myState == resting && msg.MsgNum == first {
@@ -93,7 +257,7 @@ func (policy *NaivePolicy) ProcessMessage(
 			"state", myState,
 			"msgNum", msg.MsgNum,
 		)
-		policy.myState[src] = resting
+		policy.resetPeer(src)
 		return nil, errInconsistentStateAndMsgNum
 	}
 }
@@ -110,8 +274,20 @@ func (policy *NaivePolicy) processFirstMsg(
 	// find the differences
 	onlyMine, onlyTheirs := findDifferences(myHashes, msg.HashesAll)
 
+	return policy.respondToDifferences(src, onlyMine, onlyTheirs)
+}
+
+// respondToDifferences sends the records only src lacks and requests the
+// records only src has
+func (policy *NaivePolicy) respondToDifferences(
+	src gdp.Hash,
+	onlyMine []gdp.Hash,
+	onlyTheirs []gdp.Hash,
+) (*NaiveMsgContent, error) {
+	setDivergence(policy.name, src, len(onlyMine)+len(onlyTheirs))
+
 	// load the records with hashes that only I have
-	onlyMyRecords, err := policy.logGraph.ReadRecords(onlyMine)
+	onlyMyRecords, more, err := policy.stream.start(peerKey(src), onlyMine, policy.logGraph.ReadRecords)
 	if err != nil {
 		return nil, err
 	}
@@ -121,6 +297,7 @@ func (policy *NaivePolicy) processFirstMsg(
 		MsgNum:         second,
 		HashesTheyWant: onlyTheirs,
 		RecordsWeWant:  onlyMyRecords,
+		MoreRecords:    more,
 	}
 	policy.myState[src] = receiveHeartBeat
 	return responseContent, nil
@@ -134,20 +311,31 @@ func (policy *NaivePolicy) processSecondMsg(
 
 	var err error
 	resp := &NaiveMsgContent{MsgNum: third}
-	resp.RecordsWeWant, err = policy.logGraph.ReadRecords(
+	resp.RecordsWeWant, resp.MoreRecords, err = policy.stream.start(
+		peerKey(src),
 		msg.HashesTheyWant,
+		policy.logGraph.ReadRecords,
 	)
 	if err != nil {
+		policy.resetPeer(src)
 		return nil, err
 	}
 
 	// save received data
-	err = policy.logGraph.WriteRecords(msg.RecordsWeWant)
+	receivedRecords(policy.name, msg.RecordsWeWant)
+	err = verifyRecords(policy.verifier, src, msg.RecordsWeWant)
+	if err != nil {
+		policy.resetPeer(src)
+		return nil, err
+	}
+
+	_, err = writeRecords(policy.logGraph.WriteRecords, policy.tracer, src, msg.RecordsWeWant)
 	if err != nil {
 		zap.S().Errorw(
 			"Failed to save given records",
 			"error", err.Error(),
 		)
+		policy.resetPeer(src)
 		return nil, err
 	}
 	zap.S().Infow(
@@ -166,8 +354,16 @@ func (policy *NaivePolicy) processThirdMsg(
 ) (*NaiveMsgContent, error) {
 	zap.S().Infow("processing third msg")
 
-	err := policy.logGraph.WriteRecords(msg.RecordsWeWant)
+	receivedRecords(policy.name, msg.RecordsWeWant)
+	err := verifyRecords(policy.verifier, src, msg.RecordsWeWant)
 	if err != nil {
+		policy.resetPeer(src)
+		return nil, err
+	}
+
+	_, err = writeRecords(policy.logGraph.WriteRecords, policy.tracer, src, msg.RecordsWeWant)
+	if err != nil {
+		policy.resetPeer(src)
 		return nil, err
 	}
 	zap.S().Infow(
@@ -179,6 +375,88 @@ func (policy *NaivePolicy) processThirdMsg(
 	return nil, ErrConversationFinished
 }
 
+// deferMsg writes the first batch of records of msg and keeps msg
+// until all batches are received
+func (policy *NaivePolicy) deferMsg(
+	src gdp.Hash,
+	msg *NaiveMsgContent,
+) (*NaiveMsgContent, error) {
+	err := policy.acceptBatch(src, msg.RecordsWeWant)
+	if err != nil {
+		policy.resetPeer(src)
+		return nil, err
+	}
+
+	msg.RecordsWeWant = nil
+	msg.MoreRecords = false
+	policy.deferredMsg[src] = msg
+
+	return &NaiveMsgContent{MsgNum: batchRequest}, nil
+}
+
+func (policy *NaivePolicy) processBatchRequest(
+	src gdp.Hash,
+) (*NaiveMsgContent, error) {
+	records, more, err := policy.stream.next(peerKey(src), policy.logGraph.ReadRecords)
+	if err != nil {
+		policy.resetPeer(src)
+		return nil, err
+	}
+
+	return &NaiveMsgContent{
+		MsgNum:        recordBatch,
+		RecordsWeWant: records,
+		MoreRecords:   more,
+	}, nil
+}
+
+func (policy *NaivePolicy) processRecordBatch(
+	src gdp.Hash,
+	msg *NaiveMsgContent,
+) (*NaiveMsgContent, error) {
+	deferred, ok := policy.deferredMsg[src]
+	if !ok {
+		policy.resetPeer(src)
+		return nil, errInconsistentStateAndMsgNum
+	}
+
+	err := policy.acceptBatch(src, msg.RecordsWeWant)
+	if err != nil {
+		policy.resetPeer(src)
+		return nil, err
+	}
+
+	if msg.MoreRecords {
+		return &NaiveMsgContent{MsgNum: batchRequest}, nil
+	}
+
+	// All records received, resume the message
+	delete(policy.deferredMsg, src)
+	if deferred.MsgNum == second {
+		return policy.processSecondMsg(src, deferred)
+	}
+	return policy.processThirdMsg(src, deferred)
+}
+
+// acceptBatch writes a batch of records received from src
+func (policy *NaivePolicy) acceptBatch(src gdp.Hash, records []gdp.Record) error {
+	receivedRecords(policy.name, records)
+	err := verifyRecords(policy.verifier, src, records)
+	if err != nil {
+		return err
+	}
+
+	_, err = writeRecords(policy.logGraph.WriteRecords, policy.tracer, src, records)
+	return err
+}
+
+// resetPeer drops all state of the message exchange with peer
+func (policy *NaivePolicy) resetPeer(peer gdp.Hash) {
+	policy.myState[peer] = resting
+	policy.stream.reset(peerKey(peer))
+	delete(policy.deferredMsg, peer)
+}
+
 func (policy *NaivePolicy) initPeerIfNeeded(peer gdp.Hash) {
 	_, present := policy.myState[peer]
 	if !present {
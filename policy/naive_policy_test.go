@@ -20,7 +20,10 @@ func policyFromFile(t *testing.T, dbName string) *NaivePolicy {
 	db, err := sql.Open("sqlite3", sqlFile)
 	assert.Nil(t, err)
 
-	logServer := logserver.NewSqliteServer(db)
+	logServer, err := logserver.NewSqliteServer(db)
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
 	logGraph, err := loggraph.NewSimpleGraph(logServer)
 	assert.Nil(t, err)
 
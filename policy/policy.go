@@ -11,6 +11,7 @@ package policy
 import (
 	"errors"
 	"io"
+	"time"
 
 	"github.com/tonyyanga/gdp-replicate/gdp"
 )
@@ -49,4 +50,35 @@ type Policy interface {
 	ProcessMessage(src gdp.Hash, packedMsg interface{}) (interface{}, error)
 }
 
+// A ConversationReaper is a Policy that aborts conversations with peers
+// that stopped responding, releasing the state kept for them.
+type ConversationReaper interface {
+	Policy
+
+	// Set how long a conversation may be idle before it is aborted
+	SetConversationTimeout(timeout time.Duration)
+
+	// Set the handler notified of aborted conversations
+	SetAbortHandler(handler AbortHandler)
+
+	// Abort conversations past their deadline
+	// Returns the peers whose conversation was aborted
+	ExpireConversations() []gdp.Hash
+
+	// Abort all conversations, before the log server of the policy is
+	// closed. Conversations started later are aborted by the next
+	// ExpireConversations.
+	// Returns the peers whose conversation was aborted
+	AbortConversations() []gdp.Hash
+}
+
+// A ConversationInspector is a Policy that reports its conversations in
+// progress
+type ConversationInspector interface {
+	Policy
+
+	// Conversations in progress, with any peer
+	Conversations() []Conversation
+}
+
 var ErrConversationFinished = errors.New("conversation finished")
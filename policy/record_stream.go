@@ -0,0 +1,105 @@
+package policy
+
+import (
+	"errors"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/metrics"
+)
+
+/*
+Records are transferred in batches of bounded size.
+
+A message of a stage that carries more records than fit in one batch
+holds the first batch and sets MoreRecords. Its receiver writes the batch
+right away, keeps the rest of the stage message aside, and pulls the
+remaining batches with batchRequest messages, each answered by a
+recordBatch message. Once the last batch is written, the stage message
+is processed as usual.
+
+Since every batch is persisted when it arrives, records received before
+a disconnect are not transferred again by the next message exchange.
+*/
+
+// Record transfer messages, exchanged within a stage
+const (
+	batchRequest int = iota + 100 // receiver asks for the next batch
+	recordBatch                   // sender delivers the next batch
+)
+
+// DefaultBatchSize is the default max number of records per message
+const DefaultBatchSize = 1024
+
+var errNoPendingRecords = errors.New("no pending records for peer")
+
+type recordReader func(hashes []gdp.Hash) ([]gdp.Record, error)
+
+// recordStream keeps track of the records still to be sent to peers
+type recordStream struct {
+	// name of the policy in metrics
+	policy string
+
+	// max number of records per batch, no limit if <= 0
+	batchSize int
+
+	// hashes of records not sent yet in each conversation
+	pending map[conversationKey][]gdp.Hash
+}
+
+func newRecordStream(policy string) *recordStream {
+	return &recordStream{
+		policy:    policy,
+		batchSize: DefaultBatchSize,
+		pending:   make(map[conversationKey][]gdp.Hash),
+	}
+}
+
+// start begins the transfer of records with hashes in a conversation, replacing
+// any transfer in progress. It returns the first batch and whether
+// more batches remain.
+func (stream *recordStream) start(
+	key conversationKey,
+	hashes []gdp.Hash,
+	read recordReader,
+) ([]gdp.Record, bool, error) {
+	stream.pending[key] = hashes
+	return stream.next(key, read)
+}
+
+// next returns the next batch of records of a conversation and whether more
+// batches remain.
+func (stream *recordStream) next(
+	key conversationKey,
+	read recordReader,
+) ([]gdp.Record, bool, error) {
+	hashes, ok := stream.pending[key]
+	if !ok {
+		return nil, false, errNoPendingRecords
+	}
+
+	n := len(hashes)
+	if stream.batchSize > 0 && n > stream.batchSize {
+		n = stream.batchSize
+	}
+
+	records, err := read(hashes[:n])
+	if err != nil {
+		stream.reset(key)
+		return nil, false, err
+	}
+
+	metrics.RecordsSent.WithLabelValues(stream.policy).Add(float64(len(records)))
+
+	more := n < len(hashes)
+	if more {
+		stream.pending[key] = hashes[n:]
+	} else {
+		stream.reset(key)
+	}
+	return records, more, nil
+}
+
+// reset drops any transfer in progress in a conversation
+func (stream *recordStream) reset(key conversationKey) {
+	delete(stream.pending, key)
+}
@@ -0,0 +1,177 @@
+package policy
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+)
+
+// newTestLogServer creates a log server in a temporary database
+// holding records
+func newTestLogServer(t *testing.T, name string, records []gdp.Record) *logserver.SqliteServer {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), name+".db"))
+	assert.Nil(t, err)
+
+	server, err := logserver.NewSqliteServer(db)
+	assert.Nil(t, err)
+	_, err = server.WriteRecords(records)
+	assert.Nil(t, err)
+	return server
+}
+
+func newTestGraph(t *testing.T, server logserver.LogServer) loggraph.LogGraph {
+	graph, err := loggraph.NewSimpleGraph(server)
+	assert.Nil(t, err)
+	return graph
+}
+
+// runConversation exchanges messages between two policies until the
+// conversation finishes and returns the number of messages sent
+func runConversation(t *testing.T, initiator, responder Policy) int {
+	addrs := map[Policy]gdp.Hash{
+		initiator: gdp.GenerateHash("initiator"),
+		responder: gdp.GenerateHash("responder"),
+	}
+
+	msg, err := initiator.GenerateMessage(addrs[responder])
+	assert.Nil(t, err)
+
+	numMsgs := 1
+	sender, receiver := initiator, responder
+	for msg != nil {
+		msg, err = receiver.ProcessMessage(addrs[sender], msg)
+		if err == ErrConversationFinished {
+			break
+		}
+		assert.Nil(t, err)
+		if err != nil {
+			break
+		}
+
+		if msg != nil {
+			numMsgs++
+		}
+		sender, receiver = receiver, sender
+		if numMsgs > 1000 {
+			t.Fatal("conversation does not terminate")
+		}
+	}
+	return numMsgs
+}
+
+func assertSameRecords(t *testing.T, a, b logserver.LogServer) {
+	aRecords, err := a.ReadAllMetadata()
+	assert.Nil(t, err)
+	bRecords, err := b.ReadAllMetadata()
+	assert.Nil(t, err)
+
+	aHashes := make([]gdp.Hash, 0, len(aRecords))
+	for _, m := range aRecords {
+		aHashes = append(aHashes, m.Hash)
+	}
+	bHashes := make([]gdp.Hash, 0, len(bRecords))
+	for _, m := range bRecords {
+		bHashes = append(bHashes, m.Hash)
+	}
+
+	onlyA, onlyB := findDifferences(aHashes, bHashes)
+	assert.Empty(t, onlyA)
+	assert.Empty(t, onlyB)
+}
+
+func TestGraphDiffRecordStream(t *testing.T) {
+	records := gdptest.Chain("record", 20)
+
+	long := newTestLogServer(t, "long", records)
+	short := newTestLogServer(t, "short", records[:3])
+
+	longPolicy := NewGraphDiffPolicy(newTestGraph(t, long))
+	shortPolicy := NewGraphDiffPolicy(newTestGraph(t, short))
+	longPolicy.SetBatchSize(4)
+	shortPolicy.SetBatchSize(4)
+
+	numMsgs := runConversation(t, shortPolicy, longPolicy)
+	assertSameRecords(t, long, short)
+
+	// 17 missing records take 5 batches, 4 extra round trips
+	assert.True(t, numMsgs > 4)
+}
+
+func TestNaiveRecordStream(t *testing.T) {
+	records := gdptest.Chain("record", 20)
+
+	// Each side holds records the other lacks
+	a := newTestLogServer(t, "a", records[:12])
+	b := newTestLogServer(t, "b", records[8:])
+
+	aPolicy := NewNaivePolicy(newTestGraph(t, a))
+	bPolicy := NewNaivePolicy(newTestGraph(t, b))
+	aPolicy.SetBatchSize(3)
+	bPolicy.SetBatchSize(3)
+
+	numMsgs := runConversation(t, aPolicy, bPolicy)
+	assertSameRecords(t, a, b)
+	assert.True(t, numMsgs > 3)
+
+	// Without a batch limit the exchange takes three messages
+	c := newTestLogServer(t, "c", records[:5])
+	cPolicy := NewNaivePolicy(newTestGraph(t, c))
+	cPolicy.SetBatchSize(0)
+	aPolicy.SetBatchSize(0)
+	assert.Equal(t, 3, runConversation(t, aPolicy, cPolicy))
+	assertSameRecords(t, a, c)
+}
+
+// TestSecondStageRecords checks that records sent with the second
+// message, whole or in batches, are written before the third
+func TestSecondStageRecords(t *testing.T) {
+	records := gdptest.Chain("record", 20)
+	longAddr := gdp.GenerateHash("long")
+
+	for _, name := range []string{GraphDiffPolicyName, ExternalGraphDiffPolicyName} {
+		for _, batches := range [][]int{{3, 20}, {3, 11, 20}} {
+			short := newTestLogServer(t, name+"-short", records[:3])
+			shortPolicy, err := New(name, short, Options{})
+			assert.Nil(t, err)
+
+			msg, err := shortPolicy.GenerateMessage(longAddr)
+			assert.Nil(t, err)
+			session := msg.(*GraphMsgContent).Session
+
+			// The long log sends all records after the end of the
+			// short log with the second message
+			msg = &GraphMsgContent{
+				Num:            second,
+				LogicalBegins:  []gdp.Hash{records[0].Hash},
+				LogicalEnds:    []gdp.Hash{records[19].Hash},
+				RecordsNotInRX: records[batches[0]:batches[1]],
+				MoreRecords:    len(batches) > 2,
+				Session:        session,
+			}
+			for i := 1; i < len(batches); i++ {
+				if i > 1 {
+					msg = &GraphMsgContent{
+						Num:            recordBatch,
+						RecordsNotInRX: records[batches[i-1]:batches[i]],
+						MoreRecords:    i < len(batches)-1,
+						Session:        session,
+					}
+				}
+				msg, err = shortPolicy.ProcessMessage(longAddr, msg)
+				assert.Nil(t, err)
+			}
+			assert.Equal(t, third, msg.(*GraphMsgContent).Num)
+
+			held, err := short.ReadAllMetadata()
+			assert.Nil(t, err)
+			assert.Len(t, held, len(records), "%s, %d batches", name, len(batches)-1)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package policy
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/loggraph"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/trace"
+)
+
+// Names of the policies registered by this package
+const (
+	NaivePolicyName             = "naive"
+	GraphDiffPolicyName         = "graph"
+	ExternalGraphDiffPolicyName = "external"
+	IBLTPolicyName              = "iblt"
+	MerklePolicyName            = "merkle"
+)
+
+var ErrUnknownPolicy = errors.New("unknown policy")
+
+// Options configure a policy created with New. Zero values keep the
+// defaults of the policy, options a policy does not support are ignored.
+type Options struct {
+	// Max number of records sent in one message, negative for no limit.
+	// Defaults to DefaultBatchSize.
+	BatchSize int
+
+	// How long a conversation may be idle before it is aborted.
+	// Defaults to DefaultConversationTimeout.
+	ConversationTimeout time.Duration
+
+	// Checks records received from peers, all records are accepted
+	// if nil
+	Verifier gdp.RecordVerifier
+
+	// Difference IBLT tables are sized for when nothing is known
+	// about a peer. Defaults to DefaultExpectedDifference.
+	ExpectedDifference int
+
+	// Traces records written from peers, no tracing if nil
+	Tracer *trace.Tracer
+}
+
+// A Factory creates a policy for the log in server
+type Factory func(server logserver.SnapshotLogServer, opts Options) (Policy, error)
+
+var (
+	factoriesMutex = &sync.RWMutex{}
+	factories      = map[string]Factory{
+		NaivePolicyName:             newNaiveFactory,
+		GraphDiffPolicyName:         newGraphDiffFactory,
+		ExternalGraphDiffPolicyName: newExternalGraphDiffFactory,
+		IBLTPolicyName:              newIBLTFactory,
+		MerklePolicyName:            newMerkleFactory,
+	}
+)
+
+// Register makes a policy available to New under name, replacing any
+// policy registered with the same name
+func Register(name string, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	factories[name] = factory
+}
+
+// Names returns the names of the registered policies in order
+func Names() []string {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the policy registered under name for the log in server
+// and applies opts
+func New(name string, server logserver.SnapshotLogServer, opts Options) (Policy, error) {
+	factoriesMutex.RLock()
+	factory, ok := factories[name]
+	factoriesMutex.RUnlock()
+	if !ok {
+		return nil, ErrUnknownPolicy
+	}
+
+	policy, err := factory(server, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts.apply(policy)
+	return policy, nil
+}
+
+// apply sets the options supported by policy
+func (opts Options) apply(policy Policy) {
+	if opts.BatchSize != 0 {
+		if setter, ok := policy.(interface{ SetBatchSize(int) }); ok {
+			size := opts.BatchSize
+			if size < 0 {
+				size = 0
+			}
+			setter.SetBatchSize(size)
+		}
+	}
+
+	if opts.ConversationTimeout > 0 {
+		if reaper, ok := policy.(ConversationReaper); ok {
+			reaper.SetConversationTimeout(opts.ConversationTimeout)
+		}
+	}
+
+	if opts.Verifier != nil {
+		if setter, ok := policy.(interface {
+			SetRecordVerifier(gdp.RecordVerifier)
+		}); ok {
+			setter.SetRecordVerifier(opts.Verifier)
+		}
+	}
+
+	if opts.Tracer != nil {
+		if setter, ok := policy.(interface{ SetTracer(*trace.Tracer) }); ok {
+			setter.SetTracer(opts.Tracer)
+		}
+	}
+
+	if opts.ExpectedDifference > 0 {
+		if setter, ok := policy.(interface{ SetExpectedDifference(int) }); ok {
+			setter.SetExpectedDifference(opts.ExpectedDifference)
+		}
+	}
+}
+
+func newNaiveFactory(server logserver.SnapshotLogServer, opts Options) (Policy, error) {
+	graph, err := loggraph.NewSimpleGraph(server)
+	if err != nil {
+		return nil, err
+	}
+	return NewNaivePolicy(graph), nil
+}
+
+func newGraphDiffFactory(server logserver.SnapshotLogServer, opts Options) (Policy, error) {
+	graph, err := loggraph.NewSimpleGraph(server)
+	if err != nil {
+		return nil, err
+	}
+	return NewGraphDiffPolicy(graph), nil
+}
+
+func newExternalGraphDiffFactory(server logserver.SnapshotLogServer, opts Options) (Policy, error) {
+	return NewExternalGraphDiffPolicy(server), nil
+}
+
+func newIBLTFactory(server logserver.SnapshotLogServer, opts Options) (Policy, error) {
+	graph, err := loggraph.NewSimpleGraph(server)
+	if err != nil {
+		return nil, err
+	}
+	return NewIBLTPolicy(graph), nil
+}
+
+func newMerkleFactory(server logserver.SnapshotLogServer, opts Options) (Policy, error) {
+	return NewMerklePolicy(server)
+}
@@ -0,0 +1,73 @@
+package policy
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/trace"
+)
+
+func TestRegistry(t *testing.T) {
+	records := gdptest.Chain("record", 10)
+
+	assert.Equal(t, []string{"external", "graph", "iblt", "merkle", "naive"}, Names())
+
+	for _, name := range []string{"naive", "graph", "external", "iblt", "merkle"} {
+		a := newTestLogServer(t, name+"-a", records[:4])
+		b := newTestLogServer(t, name+"-b", records)
+
+		opts := Options{
+			BatchSize: 2,
+			Verifier:  &gdp.HashChainVerifier{HashOnly: true},
+		}
+		bPolicy, err := New(name, b, opts)
+		assert.Nil(t, err)
+
+		traced := &bytes.Buffer{}
+		opts.Tracer = trace.New(gdp.GenerateHash(name), traced)
+		aPolicy, err := New(name, a, opts)
+		assert.Nil(t, err)
+
+		// A batch size of 2 takes more than a single round trip
+		assert.True(t, runConversation(t, aPolicy, bPolicy) > 3, name)
+		assertSameRecords(t, a, b)
+
+		// Records written from the peer are traced, including records
+		// some policies send again
+		events, err := trace.Read(traced)
+		assert.Nil(t, err)
+		written := make(map[gdp.Hash]bool)
+		for _, event := range events {
+			assert.Equal(t, gdp.GenerateHash("responder"), event.Origin)
+			assert.Equal(t, gdp.GenerateHash(name), event.Replica)
+			written[event.Record] = true
+		}
+		for _, record := range records[4:] {
+			assert.True(t, written[record.Hash], name)
+		}
+	}
+
+	_, err := New("missing", newTestLogServer(t, "missing", nil), Options{})
+	assert.Equal(t, ErrUnknownPolicy, err)
+
+	// Registered factories are created like the builtin ones
+	var created logserver.SnapshotLogServer
+	Register("test", func(server logserver.SnapshotLogServer, opts Options) (Policy, error) {
+		created = server
+		return NewNaivePolicy(newTestGraph(t, server)), nil
+	})
+	defer func() {
+		factoriesMutex.Lock()
+		delete(factories, "test")
+		factoriesMutex.Unlock()
+	}()
+
+	server := newTestLogServer(t, "test", nil)
+	_, err = New("test", server, Options{})
+	assert.Nil(t, err)
+	assert.Equal(t, server, created)
+}
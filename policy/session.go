@@ -0,0 +1,44 @@
+package policy
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+/*
+A conversation is identified by the peer and a session ID chosen at
+random by the initiator. Every message of the conversation carries the
+session ID, so when two peers initiate conversations with each other at
+the same time, both conversations proceed independently.
+
+Each side keeps at most one conversation it initiated and one it
+responds to per peer. A new conversation replaces the previous one in
+the same role.
+*/
+
+// conversationKey identifies a conversation with a peer
+type conversationKey struct {
+	peer    gdp.Hash
+	session uint64
+}
+
+// newSessionID returns a random session ID, never 0
+func newSessionID() uint64 {
+	var buf [8]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			panic(err)
+		}
+		if session := binary.BigEndian.Uint64(buf[:]); session != 0 {
+			return session
+		}
+	}
+}
+
+// peerKey identifies the only conversation with peer, for policies
+// without sessions
+func peerKey(peer gdp.Hash) conversationKey {
+	return conversationKey{peer: peer}
+}
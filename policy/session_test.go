@@ -0,0 +1,61 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
+)
+
+func TestSimultaneousConversations(t *testing.T) {
+	records := gdptest.Chain("record", 12)
+	a := newTestLogServer(t, "a", records[:4])
+	b := newTestLogServer(t, "b", records)
+
+	aAddr := gdp.GenerateHash("a")
+	bAddr := gdp.GenerateHash("b")
+	aPolicy := NewGraphDiffPolicy(newTestGraph(t, a))
+	bPolicy := NewGraphDiffPolicy(newTestGraph(t, b))
+
+	// Both peers start a conversation before either sees the other's
+	aMsg, err := aPolicy.GenerateMessage(bAddr)
+	assert.Nil(t, err)
+	bMsg, err := bPolicy.GenerateMessage(aAddr)
+	assert.Nil(t, err)
+	assert.NotEqual(t, aMsg.(*GraphMsgContent).Session, bMsg.(*GraphMsgContent).Session)
+
+	// Deliver messages of both conversations alternately
+	finished := 0
+	deliver := func(receiver Policy, src gdp.Hash, msg interface{}) interface{} {
+		resp, err := receiver.ProcessMessage(src, msg)
+		if err == ErrConversationFinished {
+			finished++
+			return nil
+		}
+		assert.Nil(t, err)
+		if err != nil {
+			t.FailNow()
+		}
+		return resp
+	}
+	for aMsg != nil || bMsg != nil {
+		if aMsg != nil {
+			aMsg = deliver(bPolicy, aAddr, aMsg)
+		}
+		if aMsg != nil {
+			aMsg = deliver(aPolicy, bAddr, aMsg)
+		}
+		if bMsg != nil {
+			bMsg = deliver(aPolicy, bAddr, bMsg)
+		}
+		if bMsg != nil {
+			bMsg = deliver(bPolicy, aAddr, bMsg)
+		}
+	}
+
+	assert.Equal(t, 2, finished)
+	assertSameRecords(t, a, b)
+	assert.Empty(t, aPolicy.peers.get(bAddr).graphInUse)
+	assert.Empty(t, bPolicy.peers.get(aAddr).graphInUse)
+}
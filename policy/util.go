@@ -1,6 +1,13 @@
 package policy
 
-import "github.com/tonyyanga/gdp-replicate/gdp"
+import (
+	"fmt"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+	"github.com/tonyyanga/gdp-replicate/trace"
+	"go.uber.org/zap"
+)
 
 type PeerState int
 
@@ -36,3 +43,88 @@ func findDifferences(
 
 	return onlyMine, onlyTheirs
 }
+
+// RecordRejectedError is returned when a peer sends a record that fails
+// verification. None of the records in the batch are persisted.
+type RecordRejectedError struct {
+	Peer   gdp.Hash
+	Record gdp.Hash
+	Err    error
+}
+
+func (e *RecordRejectedError) Error() string {
+	return fmt.Sprintf(
+		"record %s from peer %s rejected: %v",
+		e.Record.Readable(),
+		e.Peer.Readable(),
+		e.Err,
+	)
+}
+
+// writeRecords persists records received from peer with write and
+// traces those inserted, which are returned. Records held with other
+// contents and records refused by the database are logged and dropped,
+// so the rest of the batch is still written.
+func writeRecords(
+	write func([]gdp.Record) ([]logserver.WriteResult, error),
+	tracer *trace.Tracer,
+	peer gdp.Hash,
+	records []gdp.Record,
+) ([]gdp.Record, error) {
+	results, err := write(records)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, result := range results {
+		switch result.Status {
+		case logserver.Conflict:
+			zap.S().Errorw(
+				"Record from peer conflicts with record held",
+				"peer", peer.Readable(),
+				"record", result.Hash.Readable(),
+			)
+		case logserver.Rejected:
+			zap.S().Errorw(
+				"Record from peer refused by database",
+				"peer", peer.Readable(),
+				"record", result.Hash.Readable(),
+				"error", result.Err,
+			)
+		}
+	}
+
+	inserted := logserver.InsertedRecords(records, results)
+	tracer.Written(peer, inserted)
+	return inserted, nil
+}
+
+// verifyRecords checks all records received from peer before they are
+// written. A nil verifier accepts all records.
+func verifyRecords(
+	verifier gdp.RecordVerifier,
+	peer gdp.Hash,
+	records []gdp.Record,
+) error {
+	if verifier == nil {
+		return nil
+	}
+
+	for i := range records {
+		err := verifier.VerifyRecord(&records[i])
+		if err != nil {
+			zap.S().Errorw(
+				"Rejected record from peer",
+				"peer", peer.Readable(),
+				"record", records[i].Hash.Readable(),
+				"error", err,
+			)
+			return &RecordRejectedError{
+				Peer:   peer,
+				Record: records[i].Hash,
+				Err:    err,
+			}
+		}
+	}
+	return nil
+}
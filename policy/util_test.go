@@ -0,0 +1,72 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"github.com/tonyyanga/gdp-replicate/internal/gdptest"
+	"github.com/tonyyanga/gdp-replicate/logserver"
+)
+
+// writeLogger is a log server that remembers the records written
+type writeLogger struct {
+	*logserver.SqliteServer
+	written map[gdp.Hash]bool
+}
+
+func (server *writeLogger) WriteRecords(records []gdp.Record) ([]logserver.WriteResult, error) {
+	for _, record := range records {
+		server.written[record.Hash] = true
+	}
+	return server.SqliteServer.WriteRecords(records)
+}
+
+// rejectVerifier rejects one record
+type rejectVerifier gdp.Hash
+
+func (verifier rejectVerifier) VerifyRecord(record *gdp.Record) error {
+	if record.Hash == gdp.Hash(verifier) {
+		return gdp.ErrBadSignature
+	}
+	return nil
+}
+
+func TestRejectedRecordsNotWritten(t *testing.T) {
+	records := gdptest.Chain("record", 10)
+	rejected := records[5].Hash
+
+	for _, name := range []string{"naive", "graph", "external", "iblt", "merkle"} {
+		a := &writeLogger{
+			SqliteServer: newTestLogServer(t, name+"-a", nil),
+			written:      make(map[gdp.Hash]bool),
+		}
+		b := newTestLogServer(t, name+"-b", records)
+
+		aPolicy, err := New(name, a, Options{BatchSize: 2, Verifier: rejectVerifier(rejected)})
+		assert.Nil(t, err)
+		bPolicy, err := New(name, b, Options{BatchSize: 2})
+		assert.Nil(t, err)
+
+		// The conversation stops at the batch holding the record
+		addrs := map[Policy]gdp.Hash{
+			aPolicy: gdp.GenerateHash("a"),
+			bPolicy: gdp.GenerateHash("b"),
+		}
+		msg, err := aPolicy.GenerateMessage(addrs[bPolicy])
+		assert.Nil(t, err)
+		sender, receiver := aPolicy, bPolicy
+		for i := 0; msg != nil && err == nil && i < 1000; i++ {
+			msg, err = receiver.ProcessMessage(addrs[sender], msg)
+			sender, receiver = receiver, sender
+		}
+		if rejectedErr, ok := err.(*RecordRejectedError); assert.True(t, ok, name) {
+			assert.Equal(t, rejected, rejectedErr.Record, name)
+		}
+
+		assert.False(t, a.written[rejected], name)
+		held, err := a.ReadMetadata([]gdp.Hash{rejected})
+		assert.Nil(t, err)
+		assert.Empty(t, held, name)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Package scheduler runs periodic anti-entropy rounds, each starting
+conversations with some of the peers of a log.
+*/
+package scheduler
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"go.uber.org/zap"
+)
+
+// Strategy chooses the peers of a round
+type Strategy int
+
+// Strategies
+const (
+	// FanOut picks fanout distinct peers at random
+	FanOut Strategy = iota
+
+	// Cycle picks the next fanout peers in turn
+	Cycle
+
+	// Random picks fanout peers at random, possibly repeating peers
+	Random
+)
+
+var (
+	errAlreadyRunning  = errors.New("scheduler already running")
+	errBadInterval     = errors.New("interval must be positive")
+	errBadFanout       = errors.New("fanout must be positive")
+	errUnknownStrategy = errors.New("unknown strategy")
+)
+
+// SyncFunc starts a conversation with peer
+type SyncFunc func(peer gdp.Hash) error
+
+// Scheduler runs rounds in the background between Start and Stop.
+// All methods are safe for concurrent use.
+type Scheduler struct {
+	sync SyncFunc
+
+	mutex sync.Mutex
+	peers []gdp.Hash
+
+	// index of the next peer of the Cycle strategy
+	next int
+
+	// closed to stop the rounds, nil if not running
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewScheduler creates a Scheduler whose rounds call syncFunc for every
+// peer chosen
+func NewScheduler(syncFunc SyncFunc) *Scheduler {
+	return &Scheduler{sync: syncFunc}
+}
+
+// SetPeers replaces the peers rounds choose from. Takes effect from the
+// next round.
+func (s *Scheduler) SetPeers(peers []gdp.Hash) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.peers = append([]gdp.Hash(nil), peers...)
+	s.next = 0
+}
+
+// Peers returns the peers rounds choose from
+func (s *Scheduler) Peers() []gdp.Hash {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]gdp.Hash(nil), s.peers...)
+}
+
+// Start runs a round every interval until Stop is called. The first
+// round starts after a random delay of less than interval, so peers
+// started together do not initiate conversations with each other at the
+// same time. Rounds choose at most all peers, and none while there are
+// no peers, since peers may change while running.
+func (s *Scheduler) Start(interval time.Duration, fanout int, strategy Strategy) error {
+	if interval <= 0 {
+		return errBadInterval
+	}
+	if strategy < FanOut || strategy > Random {
+		return errUnknownStrategy
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.stop != nil {
+		return errAlreadyRunning
+	}
+	if fanout <= 0 {
+		return errBadFanout
+	}
+
+	zap.S().Infow(
+		"scheduling rounds",
+		"interval", interval,
+		"fanout", fanout,
+		"strategy", strategy,
+	)
+
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.run(interval, fanout, strategy, s.stop, s.done)
+	return nil
+}
+
+// Stop ends the rounds started by Start and waits for the round in
+// progress. Does nothing if the scheduler is not running.
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.mutex.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (s *Scheduler) run(
+	interval time.Duration,
+	fanout int,
+	strategy Strategy,
+	stop <-chan struct{},
+	done chan<- struct{},
+) {
+	defer close(done)
+
+	delay := time.NewTimer(time.Duration(rand.Int63n(int64(interval))))
+	select {
+	case <-delay.C:
+	case <-stop:
+		delay.Stop()
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.Round(fanout, strategy)
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Round starts conversations with fanout peers chosen by strategy.
+// Failures are logged and do not stop the round.
+func (s *Scheduler) Round(fanout int, strategy Strategy) {
+	chosen := s.choosePeers(fanout, strategy)
+	zap.S().Infow(
+		"sending round",
+		"numPeers", len(chosen),
+	)
+
+	for _, peer := range chosen {
+		err := s.sync(peer)
+		if err != nil {
+			zap.S().Errorw(
+				"Failed to start conversation",
+				"peer", peer.Readable(),
+				"error", err,
+			)
+		}
+	}
+}
+
+// choosePeers returns the peers of a round
+func (s *Scheduler) choosePeers(fanout int, strategy Strategy) []gdp.Hash {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	numPeers := len(s.peers)
+	if numPeers == 0 {
+		return nil
+	}
+	if fanout > numPeers && strategy != Random {
+		fanout = numPeers
+	}
+
+	chosen := make([]gdp.Hash, 0, fanout)
+	switch strategy {
+	case Cycle:
+		for i := 0; i < fanout; i++ {
+			chosen = append(chosen, s.peers[s.next%numPeers])
+			s.next = (s.next + 1) % numPeers
+		}
+	case Random:
+		for i := 0; i < fanout; i++ {
+			chosen = append(chosen, s.peers[rand.Intn(numPeers)])
+		}
+	default:
+		for _, i := range rand.Perm(numPeers)[:fanout] {
+			chosen = append(chosen, s.peers[i])
+		}
+	}
+	return chosen
+}
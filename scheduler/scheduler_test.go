@@ -0,0 +1,86 @@
+package scheduler
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func testPeers(n int) []gdp.Hash {
+	peers := make([]gdp.Hash, 0, n)
+	for i := 0; i < n; i++ {
+		peers = append(peers, gdp.GenerateHash(fmt.Sprint(i)))
+	}
+	return peers
+}
+
+func TestChoosePeers(t *testing.T) {
+	peers := testPeers(4)
+	s := NewScheduler(nil)
+	s.SetPeers(peers)
+
+	// Cycle visits every peer in turn
+	assert.Equal(t, peers[:3], s.choosePeers(3, Cycle))
+	assert.Equal(t, []gdp.Hash{peers[3], peers[0], peers[1]}, s.choosePeers(3, Cycle))
+
+	// FanOut never repeats a peer
+	chosen := s.choosePeers(4, FanOut)
+	assert.ElementsMatch(t, peers, chosen)
+	assert.Equal(t, 4, len(s.choosePeers(10, FanOut)))
+
+	assert.Equal(t, 6, len(s.choosePeers(6, Random)))
+
+	s.SetPeers(nil)
+	assert.Empty(t, s.choosePeers(2, FanOut))
+}
+
+func TestStartStop(t *testing.T) {
+	peers := testPeers(3)
+
+	mutex := &sync.Mutex{}
+	synced := make(map[gdp.Hash]int)
+	s := NewScheduler(func(peer gdp.Hash) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		synced[peer]++
+		return nil
+	})
+
+	assert.Equal(t, errBadFanout, s.Start(time.Millisecond, 0, FanOut))
+
+	// Rounds without peers do nothing
+	assert.Nil(t, s.Start(time.Millisecond, 1, FanOut))
+	time.Sleep(5 * time.Millisecond)
+	s.Stop()
+	assert.Empty(t, synced)
+
+	s.SetPeers(peers)
+	assert.Equal(t, errBadInterval, s.Start(0, 1, FanOut))
+	assert.Equal(t, errUnknownStrategy, s.Start(time.Millisecond, 1, Strategy(7)))
+
+	assert.Nil(t, s.Start(time.Millisecond, 3, Cycle))
+	assert.Equal(t, errAlreadyRunning, s.Start(time.Millisecond, 3, Cycle))
+	time.Sleep(20 * time.Millisecond)
+	s.Stop()
+
+	mutex.Lock()
+	rounds := synced[peers[0]]
+	for _, peer := range peers {
+		assert.True(t, synced[peer] > 0)
+	}
+	mutex.Unlock()
+
+	// No rounds after Stop
+	time.Sleep(10 * time.Millisecond)
+	mutex.Lock()
+	assert.Equal(t, rounds, synced[peers[0]])
+	mutex.Unlock()
+
+	s.Stop()
+	assert.Nil(t, s.Start(time.Millisecond, 1, Random))
+	s.Stop()
+}
@@ -0,0 +1,116 @@
+package trace
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+// Report summarizes the propagation of records through a cluster
+type Report struct {
+	// Number of records traced
+	Records int
+
+	// Number of replicas of the cluster
+	Replicas int
+
+	// Time from the first traced write of a record to each following
+	// write, in order. The first hop of a record is not traced, as it is
+	// written to its first replica by a client.
+	Delays []time.Duration
+
+	// Number of writes by hops of the record
+	Hops map[int]int
+
+	// Time from the first to the last traced write of each record held
+	// by all replicas, in order
+	Convergence []time.Duration
+
+	// Number of records not held by all replicas
+	Incomplete int
+}
+
+// Analyze fills in the hops of events and summarizes them. Replicas is
+// the number of replicas of the cluster, replicas seen in events are
+// counted if replicas <= 0.
+//
+// A replica that supplied a record without having written it from a
+// peer is where the record was first written, at hop 0.
+func Analyze(events []Event, replicas int) Report {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Written.Before(events[j].Written)
+	})
+
+	byRecord := make(map[gdp.Hash][]int)
+	seen := make(map[gdp.Hash]bool)
+	for i, event := range events {
+		byRecord[event.Record] = append(byRecord[event.Record], i)
+		seen[event.Replica] = true
+		seen[event.Origin] = true
+	}
+	if replicas <= 0 {
+		replicas = len(seen)
+	}
+
+	report := Report{
+		Records:  len(byRecord),
+		Replicas: replicas,
+		Delays:   make([]time.Duration, 0, len(events)),
+		Hops:     make(map[int]int),
+	}
+
+	for _, indexes := range byRecord {
+		first := events[indexes[0]].Written
+		last := first
+
+		// hops of the replicas holding the record
+		hops := make(map[gdp.Hash]int)
+		for _, i := range indexes {
+			event := &events[i]
+			if _, ok := hops[event.Origin]; !ok {
+				hops[event.Origin] = 0
+			}
+			if _, ok := hops[event.Replica]; ok {
+				// written again, e.g. after the replica lost it
+				continue
+			}
+
+			event.Hop = hops[event.Origin] + 1
+			hops[event.Replica] = event.Hop
+			report.Hops[event.Hop]++
+			report.Delays = append(report.Delays, event.Written.Sub(first))
+			last = event.Written
+		}
+
+		if len(hops) >= replicas {
+			report.Convergence = append(report.Convergence, last.Sub(first))
+		} else {
+			report.Incomplete++
+		}
+	}
+
+	sort.Slice(report.Delays, func(i, j int) bool {
+		return report.Delays[i] < report.Delays[j]
+	})
+	sort.Slice(report.Convergence, func(i, j int) bool {
+		return report.Convergence[i] < report.Convergence[j]
+	})
+	return report
+}
+
+// Percentile returns the p-th percentile, 0 <= p <= 100, of durations
+// in order. Returns 0 if durations is empty.
+func Percentile(durations []time.Duration, p float64) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+
+	i := int(p / 100 * float64(len(durations)-1))
+	if i < 0 {
+		i = 0
+	} else if i >= len(durations) {
+		i = len(durations) - 1
+	}
+	return durations[i]
+}
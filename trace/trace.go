@@ -0,0 +1,171 @@
+/*
+Package trace records when replicas persist records supplied by their
+peers, so the propagation of records through a cluster can be measured
+offline, see Analyze and cmd/gdp-trace.
+
+Each replica appends one Event per record to its trace, as a line of
+JSON. Records carry no history, so a replica only knows the peer that
+supplied a record. The number of hops a record took from the replica it
+was first written to is derived offline by following origins.
+
+Records a peer sends again are traced again, only the first write of a
+record by each replica is analyzed.
+*/
+package trace
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tonyyanga/gdp-replicate/gdp"
+	"go.uber.org/zap"
+)
+
+// Event is the write of a record supplied by a peer
+type Event struct {
+	// Hash of the record
+	Record gdp.Hash
+
+	// Replica that wrote the record
+	Replica gdp.Hash
+
+	// Peer that supplied the record
+	Origin gdp.Hash
+
+	// Number of replicas the record went through since the replica it
+	// was first written to. Not traced, see Analyze.
+	Hop int
+
+	// Time the record was persisted
+	Written time.Time
+}
+
+// eventJSON is the encoding of an Event in traces
+type eventJSON struct {
+	Record  string    `json:"record"`
+	Replica string    `json:"replica"`
+	Origin  string    `json:"origin"`
+	Written time.Time `json:"written"`
+}
+
+// Tracer appends events of a replica to a trace. All methods are safe
+// for concurrent use, and do nothing on a nil Tracer.
+type Tracer struct {
+	mutex   sync.Mutex
+	replica gdp.Hash
+	writer  *bufio.Writer
+	closer  io.Closer
+}
+
+// New creates a tracer writing events of replica to w
+func New(replica gdp.Hash, w io.Writer) *Tracer {
+	return &Tracer{
+		replica: replica,
+		writer:  bufio.NewWriter(w),
+	}
+}
+
+// Open creates a tracer appending events of replica to the file at path
+func Open(replica gdp.Hash, path string) (*Tracer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	tracer := New(replica, file)
+	tracer.closer = file
+	return tracer, nil
+}
+
+// Written records that records supplied by origin were persisted
+func (tracer *Tracer) Written(origin gdp.Hash, records []gdp.Record) {
+	if tracer == nil || len(records) == 0 {
+		return
+	}
+
+	now := time.Now()
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+
+	encoder := json.NewEncoder(tracer.writer)
+	for _, record := range records {
+		err := encoder.Encode(&eventJSON{
+			Record:  hex.EncodeToString(record.Hash[:]),
+			Replica: hex.EncodeToString(tracer.replica[:]),
+			Origin:  hex.EncodeToString(origin[:]),
+			Written: now,
+		})
+		if err != nil {
+			zap.S().Errorw(
+				"Failed to trace record",
+				"record", record.Hash.Readable(),
+				"error", err,
+			)
+			return
+		}
+	}
+
+	err := tracer.writer.Flush()
+	if err != nil {
+		zap.S().Errorw(
+			"Failed to flush trace",
+			"error", err,
+		)
+	}
+}
+
+// Close flushes the trace and closes the file opened by Open
+func (tracer *Tracer) Close() error {
+	if tracer == nil {
+		return nil
+	}
+
+	tracer.mutex.Lock()
+	defer tracer.mutex.Unlock()
+
+	err := tracer.writer.Flush()
+	if tracer.closer != nil {
+		closeErr := tracer.closer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Read returns the events of a trace
+func Read(r io.Reader) ([]Event, error) {
+	events := make([]Event, 0)
+	decoder := json.NewDecoder(r)
+	for {
+		encoded := &eventJSON{}
+		err := decoder.Decode(encoded)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+
+		event := Event{Written: encoded.Written}
+		for _, field := range []struct {
+			hash    *gdp.Hash
+			encoded string
+		}{
+			{&event.Record, encoded.Record},
+			{&event.Replica, encoded.Replica},
+			{&event.Origin, encoded.Origin},
+		} {
+			*field.hash, err = gdp.ParseHash(field.encoded)
+			if err != nil {
+				return events, err
+			}
+		}
+		events = append(events, event)
+	}
+}
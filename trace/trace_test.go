@@ -0,0 +1,78 @@
+package trace
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tonyyanga/gdp-replicate/gdp"
+)
+
+func TestReadWritten(t *testing.T) {
+	replica := gdp.GenerateHash("replica")
+	origin := gdp.GenerateHash("origin")
+	records := []gdp.Record{
+		{Metadatum: gdp.Metadatum{Hash: gdp.GenerateHash("1")}},
+		{Metadatum: gdp.Metadatum{Hash: gdp.GenerateHash("2")}},
+	}
+
+	buf := &bytes.Buffer{}
+	tracer := New(replica, buf)
+	tracer.Written(origin, records)
+	tracer.Written(origin, nil)
+	assert.Nil(t, tracer.Close())
+
+	events, err := Read(buf)
+	assert.Nil(t, err)
+	assert.Len(t, events, 2)
+	for i, event := range events {
+		assert.Equal(t, records[i].Hash, event.Record)
+		assert.Equal(t, replica, event.Replica)
+		assert.Equal(t, origin, event.Origin)
+		assert.False(t, event.Written.IsZero())
+	}
+
+	// A nil tracer traces nothing
+	var disabled *Tracer
+	disabled.Written(origin, records)
+	assert.Nil(t, disabled.Close())
+
+	_, err = Read(bytes.NewBufferString(`{"record": "abcd"}`))
+	assert.NotNil(t, err)
+}
+
+func TestAnalyze(t *testing.T) {
+	a, b, c := gdp.GenerateHash("a"), gdp.GenerateHash("b"), gdp.GenerateHash("c")
+	full, partial := gdp.GenerateHash("full"), gdp.GenerateHash("partial")
+	start := time.Now()
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+
+	// full is written to a by a client, then reaches c through b.
+	// partial is written to b, and only reaches a.
+	events := []Event{
+		{Record: full, Replica: c, Origin: b, Written: at(3)},
+		{Record: full, Replica: b, Origin: a, Written: at(1)},
+		{Record: partial, Replica: a, Origin: b, Written: at(2)},
+	}
+
+	report := Analyze(events, 0)
+	assert.Equal(t, 2, report.Records)
+	assert.Equal(t, 3, report.Replicas)
+	assert.Equal(t, []time.Duration{0, 0, 2 * time.Second}, report.Delays)
+	assert.Equal(t, map[int]int{1: 2, 2: 1}, report.Hops)
+	assert.Equal(t, []time.Duration{2 * time.Second}, report.Convergence)
+	assert.Equal(t, 1, report.Incomplete)
+
+	assert.Equal(t, 2, events[2].Hop)
+	assert.Equal(t, 2*time.Second, Percentile(report.Delays, 100))
+	assert.Equal(t, time.Duration(0), Percentile(report.Delays, 50))
+	assert.Equal(t, time.Duration(0), Percentile(nil, 50))
+
+	// Replicas that never wrote a traced record are not seen
+	report = Analyze(events, 4)
+	assert.Empty(t, report.Convergence)
+	assert.Equal(t, 2, report.Incomplete)
+}
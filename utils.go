@@ -1,5 +1,6 @@
 package main
 
+// #include <stdlib.h>
 // #include "gdp_types.h"
 // #include "gdp_helper.h"
 import "C"
@@ -10,6 +11,7 @@ import (
 	"reflect"
 	"unsafe"
 
+	"github.com/tonyyanga/gdp-replicate/codec"
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/policy"
 )
@@ -20,20 +22,41 @@ func peerAddrToHash(addr C.PeerAddr) gdp.Hash {
 	return ret
 }
 
-func toCMsg(msg interface{}) C.Msg {
-	dest := &bytes.Buffer{}
+func hashToPeerAddr(hash gdp.Hash) C.PeerAddr {
+	var addr C.PeerAddr
+	for i, b := range hash {
+		addr.addr[i] = C.char(b)
+	}
+	return addr
+}
 
-	encoder := gob.NewEncoder(dest)
-	gob.Register(&policy.GraphMsgContent{})
+// freeMsg releases the data of a C.Msg created by toCMsg
+func freeMsg(msg C.Msg) {
+	C.free(msg.data)
+}
 
-	err := encoder.Encode(msg)
+// toCMsg serializes msg for C in an envelope of msgCodec. If msgCodec
+// is nil, graph messages are bare gob like the messages of older
+// replicas, and other messages use the gob codec.
+func toCMsg(msg interface{}, msgCodec codec.Codec) (C.Msg, error) {
+	var destBytes []byte
+	var err error
+	if _, ok := msg.(*policy.GraphMsgContent); ok && msgCodec == nil {
+		dest := &bytes.Buffer{}
+		err = gob.NewEncoder(dest).Encode(msg)
+		destBytes = dest.Bytes()
+	} else {
+		if msgCodec == nil {
+			msgCodec = codec.Gob
+		}
+		destBytes, err = codec.Marshal(msgCodec, msg)
+	}
 	if err != nil {
-		panic(err)
+		return C.Msg{}, err
 	}
 
 	// convert dest to a c array
-	length := dest.Len()
-	destBytes := dest.Bytes()
+	length := len(destBytes)
 	destCArray := C.malloc(C.size_t(C.int(length)))
 
 	// create a temporary slice as copy destination
@@ -48,17 +71,22 @@ func toCMsg(msg interface{}) C.Msg {
 	return C.Msg{
 		length: C.uint(length),
 		data:   destCArray,
-	}
+	}, nil
+}
+
+// msgBytes copies the data of a C.Msg
+func msgBytes(msg C.Msg) []byte {
+	return C.GoBytes(msg.data, C.int(msg.length))
 }
 
-func toGoMsg(msg C.Msg) interface{} {
-	// convert a c array to a buffer
-	length := msg.length
-	srcCArray := msg.data
+func toGoMsg(msg C.Msg) (interface{}, error) {
+	srcBytes := msgBytes(msg)
 
-	srcBytes := make([]byte, int(length))
-	copy(srcBytes, C.GoBytes(unsafe.Pointer(srcCArray), C.int(length)))
+	if codec.IsEnvelope(srcBytes) {
+		return codec.Unmarshal(srcBytes)
+	}
 
+	// messages of older replicas are bare gob encoded graph messages
 	src := bytes.NewReader(srcBytes)
 
 	decoder := gob.NewDecoder(src)
@@ -68,8 +96,8 @@ func toGoMsg(msg C.Msg) interface{} {
 
 	err := decoder.Decode(&resp)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return resp
+	return resp, nil
 }
@@ -4,6 +4,7 @@ import (
 	"log"
 	"testing"
 
+	"github.com/tonyyanga/gdp-replicate/codec"
 	"github.com/tonyyanga/gdp-replicate/gdp"
 	"github.com/tonyyanga/gdp-replicate/policy"
 )
@@ -18,12 +19,39 @@ func TestMsgConv(t *testing.T) {
 		RecordsNotInRX: []gdp.Record{},
 	}
 
-	cMsg := toCMsg(msg)
+	// Older replicas read bare gob graph messages
+	for _, msgCodec := range []codec.Codec{nil, codec.Gob, codec.Binary} {
+		cMsg, err := toCMsg(msg, msgCodec)
+		if err != nil {
+			log.Fatalf("Failed to encode: %v", err)
+		}
+		if codec.IsEnvelope(msgBytes(cMsg)) != (msgCodec != nil) {
+			log.Fatalf("Wrong envelope for codec %v", msgCodec)
+		}
 
-	resp := toGoMsg(cMsg)
+		resp, err := toGoMsg(cMsg)
+		freeMsg(cMsg)
+		if err != nil {
+			log.Fatalf("Failed to decode: %v", err)
+		}
 
-	_, ok := resp.(*policy.GraphMsgContent)
-	if !ok {
+		_, ok := resp.(*policy.GraphMsgContent)
+		if !ok {
+			log.Fatalf("Wrong output content: %v", resp)
+		}
+	}
+
+	// Messages of other policies are never bare gob
+	cMsg, err := toCMsg(&policy.NaiveMsgContent{}, nil)
+	if err != nil {
+		log.Fatalf("Failed to encode: %v", err)
+	}
+	defer freeMsg(cMsg)
+	resp, err := toGoMsg(cMsg)
+	if err != nil {
+		log.Fatalf("Failed to decode: %v", err)
+	}
+	if _, ok := resp.(*policy.NaiveMsgContent); !ok {
 		log.Fatalf("Wrong output content: %v", resp)
 	}
 }